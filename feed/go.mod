@@ -3,6 +3,7 @@ module feed
 go 1.23
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs v1.0.0
 	google.golang.org/protobuf v1.36.11
 	gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"feed/internal/feeds"
+)
+
+// withoutOrigin drops trains still waiting at their origin terminal
+// (?exclude=departures), which otherwise show up as "0 min" phantoms.
+func withoutOrigin(arrivals []feeds.Arrival) []feeds.Arrival {
+	var result []feeds.Arrival
+	for _, a := range arrivals {
+		if !a.Origin {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// onlyAssigned keeps trains NYCT reports as physically in service
+// (?assigned=true), dropping schedule-only predictions.
+func onlyAssigned(arrivals []feeds.Arrival) []feeds.Arrival {
+	var result []feeds.Arrival
+	for _, a := range arrivals {
+		if a.Assigned {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// onlyLines keeps arrivals on one of the given lines.
+func onlyLines(arrivals []feeds.Arrival, lines map[string]bool) []feeds.Arrival {
+	var result []feeds.Arrival
+	for _, a := range arrivals {
+		if lines[a.Line] {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// onlyDirection keeps arrivals with the given direction code (N, S, E, W).
+func onlyDirection(arrivals []feeds.Arrival, dir string) []feeds.Arrival {
+	var result []feeds.Arrival
+	for _, a := range arrivals {
+		if a.DirectionCode == dir {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// atLeastMinutes drops trains arriving sooner than min minutes
+// (?min_minutes=), e.g. ones a rider can't walk to the platform in time for.
+func atLeastMinutes(arrivals []feeds.Arrival, min int) []feeds.Arrival {
+	var result []feeds.Arrival
+	for _, a := range arrivals {
+		if a.Minutes >= min {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// withinLookahead drops arrivals more than lookahead away, except that the
+// soonest minKeep at each stop and direction always stay. Input is sorted
+// by minutes.
+func withinLookahead(arrivals []feeds.Arrival, lookahead time.Duration, minKeep int) []feeds.Arrival {
+	if lookahead <= 0 {
+		return arrivals
+	}
+
+	type key struct{ stopID, dir string }
+	counts := make(map[key]int)
+	maxMinutes := int(lookahead / time.Minute)
+
+	var result []feeds.Arrival
+	for _, a := range arrivals {
+		k := key{a.StopID, a.DirectionCode}
+		if a.Minutes > maxMinutes && counts[k] >= minKeep {
+			continue
+		}
+		counts[k]++
+		result = append(result, a)
+	}
+	return result
+}
+
+// trimPerDirection keeps the first n arrivals for each line and direction
+// at every stop. Input is sorted by minutes, so those are the soonest.
+func trimPerDirection(arrivals []feeds.Arrival, n int) []feeds.Arrival {
+	if n <= 0 {
+		return arrivals
+	}
+
+	type key struct{ stopID, line, dir string }
+	counts := make(map[key]int)
+
+	var result []feeds.Arrival
+	for _, a := range arrivals {
+		k := key{a.StopID, a.Line, a.DirectionCode}
+		if counts[k] >= n {
+			continue
+		}
+		counts[k]++
+		result = append(result, a)
+	}
+	return result
+}
+
+// arrivalFilters are the filters applied to a stop's arrivals before they
+// are listed. /arrivals and /arrivals/count parse them from the same query
+// parameters, so a count always matches the list it summarises.
+type arrivalFilters struct {
+	excludeDepartures bool            // ?exclude=departures
+	assignedOnly      bool            // ?assigned=true
+	lines             map[string]bool // nil keeps every line
+	direction         string          // "" keeps every direction
+	minMinutes        int             // -1 when unset
+	perDirection      int
+}
+
+// parseArrivalFilters reads the /arrivals filter parameters. perDirection
+// and maxPerDirection are the configured default and cap for
+// ?per_direction=.
+func parseArrivalFilters(q url.Values, perDirection, maxPerDirection int) (arrivalFilters, error) {
+	f := arrivalFilters{
+		excludeDepartures: q.Get("exclude") == "departures",
+		assignedOnly:      q.Get("assigned") == "true",
+		minMinutes:        -1,
+	}
+	if v := q.Get("min_minutes"); v != "" {
+		min, err := strconv.Atoi(v)
+		if err != nil || min < 0 {
+			return f, fmt.Errorf("invalid min_minutes")
+		}
+		f.minMinutes = min
+	}
+	n, err := parsePerDirection(q.Get("per_direction"), perDirection, maxPerDirection)
+	if err != nil {
+		return f, err
+	}
+	f.perDirection = n
+	return f, nil
+}
+
+// apply filters minutes-sorted arrivals, then applies the lookahead and
+// per-direction trimming. lookahead and minKeep are as in withinLookahead.
+func (f arrivalFilters) apply(arrivals []feeds.Arrival, lookahead time.Duration, minKeep int) []feeds.Arrival {
+	if f.excludeDepartures {
+		arrivals = withoutOrigin(arrivals)
+	}
+	if f.assignedOnly {
+		arrivals = onlyAssigned(arrivals)
+	}
+	if f.lines != nil {
+		arrivals = onlyLines(arrivals, f.lines)
+	}
+	if f.direction != "" {
+		arrivals = onlyDirection(arrivals, f.direction)
+	}
+	if f.minMinutes >= 0 {
+		arrivals = atLeastMinutes(arrivals, f.minMinutes)
+	}
+	arrivals = withinLookahead(arrivals, lookahead, minKeep)
+	return trimPerDirection(arrivals, f.perDirection)
+}
+
+// parsePerDirection reads ?per_direction=, overriding the configured
+// arrivals_per_direction for one request. It is bounded by max.
+func parsePerDirection(param string, def, max int) (int, error) {
+	if param == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(param)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid per_direction %q", param)
+	}
+	if max > 0 && n > max {
+		n = max
+	}
+	return n, nil
+}
+
+// parseLimit reads ?limit=, bounded by the server maximum. An absent limit
+// means the maximum; a max of 0 means unbounded.
+func parseLimit(param string, max int) (int, error) {
+	if param == "" {
+		return max, nil
+	}
+	n, err := strconv.Atoi(param)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid limit %q", param)
+	}
+	if max > 0 && n > max {
+		n = max
+	}
+	return n, nil
+}
+
+// sortArrivals reorders minutes-sorted arrivals by ?sort=key[:desc]. The
+// sort is stable, so arrivals that tie on the key stay soonest-first.
+func sortArrivals(arrivals []feeds.Arrival, param string) error {
+	if param == "" {
+		return nil
+	}
+
+	field, order, _ := strings.Cut(param, ":")
+	if order != "" && order != "asc" && order != "desc" {
+		return fmt.Errorf("invalid sort order %q", order)
+	}
+	desc := order == "desc"
+
+	var less func(a, b feeds.Arrival) bool
+	switch field {
+	case "minutes":
+		less = func(a, b feeds.Arrival) bool { return a.Minutes < b.Minutes }
+	case "line":
+		less = func(a, b feeds.Arrival) bool { return a.Line < b.Line }
+	case "station":
+		less = func(a, b feeds.Arrival) bool { return a.Station < b.Station }
+	case "direction":
+		less = func(a, b feeds.Arrival) bool { return a.DirectionCode < b.DirectionCode }
+	default:
+		return fmt.Errorf("invalid sort key %q", field)
+	}
+
+	sort.SliceStable(arrivals, func(i, j int) bool {
+		if desc {
+			return less(arrivals[j], arrivals[i])
+		}
+		return less(arrivals[i], arrivals[j])
+	})
+	return nil
+}
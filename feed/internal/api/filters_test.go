@@ -0,0 +1,449 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"feed/internal/feeds"
+)
+
+// arrivalsFor GETs path and decodes the ArrivalsResponse.
+func arrivalsFor(t *testing.T, e *testEnv, path string) ArrivalsResponse {
+	t.Helper()
+	rec := e.get(path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", path, rec.Code, rec.Body)
+	}
+	var resp ArrivalsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func tripIDs(arrivals []feeds.Arrival) []string {
+	ids := make([]string, len(arrivals))
+	for i, a := range arrivals {
+		ids[i] = a.TripID
+	}
+	return ids
+}
+
+func TestArrivalsExcludeDepartures(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L01": {
+			{StopID: "L01", Station: "8 Av", Line: "L", DirectionCode: "S", Minutes: 0, TripID: "waiting", Origin: true},
+			{StopID: "L01", Station: "8 Av", Line: "L", DirectionCode: "N", Minutes: 2, TripID: "inbound"},
+		},
+	})
+
+	if got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L01").Arrivals); len(got) != 2 {
+		t.Errorf("unfiltered: %v, want both trips", got)
+	}
+	got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L01&exclude=departures").Arrivals)
+	if len(got) != 1 || got[0] != "inbound" {
+		t.Errorf("exclude=departures: %v, want [inbound]", got)
+	}
+}
+
+func TestArrivalsAssignedOnly(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 1, TripID: "ghost"},
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 3, TripID: "real", Assigned: true},
+		},
+	})
+	got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L08&assigned=true").Arrivals)
+	if len(got) != 1 || got[0] != "real" {
+		t.Errorf("assigned=true: %v, want [real]", got)
+	}
+	if got := arrivalsFor(t, e, "/arrivals?stops=L08").Arrivals; len(got) != 2 {
+		t.Errorf("unfiltered: %d arrivals, want 2", len(got))
+	}
+}
+
+func TestStopIDsAreNormalized(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 2, TripID: "t1"}},
+		"A24": {{StopID: "A24", Line: "A", DirectionCode: "S", Minutes: 4, TripID: "t2"}},
+	})
+
+	resp := arrivalsFor(t, e, "/arrivals?stops=%20l08%20,a24%20")
+	if got := tripIDs(resp.Arrivals); len(got) != 2 || len(resp.UnknownStops) != 0 {
+		t.Errorf("padded lowercase stops: trips %v, unknown %v", got, resp.UnknownStops)
+	}
+
+	rec := e.get("/arrivals/stop/l08")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/arrivals/stop/l08: status %d", rec.Code)
+	}
+	var stop StopArrivalsResponse
+	json.Unmarshal(rec.Body.Bytes(), &stop)
+	if stop.StopID != "L08" || len(stop.Directions["N"].Arrivals) != 1 {
+		t.Errorf("/arrivals/stop/l08 = %+v", stop)
+	}
+}
+
+// spreadArrivals puts northbound and southbound trains at L08 and L06 a
+// minute apart, interleaved across the two stops.
+func spreadArrivals(e *testEnv) {
+	update := map[string][]feeds.Arrival{}
+	for m := 0; m < 8; m++ {
+		stop := []string{"L08", "L06"}[m%2]
+		update[stop] = append(update[stop], feeds.Arrival{
+			StopID: stop, Line: "L", DirectionCode: []string{"N", "N", "S", "S"}[m%4],
+			Minutes: m, TripID: fmt.Sprintf("m%d", m),
+		})
+	}
+	e.cache.Update(update)
+}
+
+func TestArrivalsLimit(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  arrivals_per_direction: 10\n")
+	spreadArrivals(e)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"limit=3", []string{"m0", "m1", "m2"}},
+		{"limit=100", []string{"m0", "m1", "m2", "m3", "m4", "m5", "m6", "m7"}},
+		// Per direction at each stop first (m0, m1 north; m2, m3 south),
+		// then the cap
+		{"per_direction=1&limit=3", []string{"m0", "m1", "m2"}},
+		{"per_direction=1&limit=6", []string{"m0", "m1", "m2", "m3"}},
+		// The cap keeps the soonest; sort only reorders what's left
+		{"limit=3&sort=minutes:desc", []string{"m2", "m1", "m0"}},
+	}
+	for _, tt := range tests {
+		got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L08,L06&"+tt.query).Arrivals)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"0", "-1", "lots"} {
+		if rec := e.get("/arrivals?stops=L08&limit=" + bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("limit=%s: status %d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+func TestArrivalsMaxArrivals(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  arrivals_per_direction: 10\nserver:\n  max_arrivals: 2\n")
+	spreadArrivals(e)
+	for _, query := range []string{"", "&limit=5", "&limit=2"} {
+		got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L08,L06"+query).Arrivals)
+		if !slices.Equal(got, []string{"m0", "m1"}) {
+			t.Errorf("max_arrivals 2%s: %v, want [m0 m1]", query, got)
+		}
+	}
+	if got := arrivalsFor(t, e, "/arrivals?stops=L08,L06&limit=1").Arrivals; len(got) != 1 {
+		t.Errorf("limit below the max: %d arrivals, want 1", len(got))
+	}
+}
+
+func TestArrivalsPerDirectionOverride(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  arrivals_per_direction: 3\nserver:\n  max_per_direction: 4\n")
+	update := map[string][]feeds.Arrival{}
+	for m := 0; m < 6; m++ {
+		for _, dir := range []string{"N", "S"} {
+			update["L08"] = append(update["L08"], feeds.Arrival{
+				StopID: "L08", Line: "L", DirectionCode: dir, Minutes: m, TripID: fmt.Sprintf("%s%d", dir, m),
+			})
+		}
+	}
+	e.cache.Update(update)
+
+	tests := []struct {
+		query string
+		want  int // per direction
+	}{
+		{"", 3},                 // the configured default
+		{"&per_direction=1", 1}, // a watch
+		{"&per_direction=4", 4},
+		{"&per_direction=50", 4}, // bounded by max_per_direction
+	}
+	for _, tt := range tests {
+		perDir := map[string]int{}
+		for _, a := range arrivalsFor(t, e, "/arrivals?stops=L08"+tt.query).Arrivals {
+			perDir[a.DirectionCode]++
+		}
+		if perDir["N"] != tt.want || perDir["S"] != tt.want {
+			t.Errorf("%q: %v per direction, want %d each", tt.query, perDir, tt.want)
+		}
+	}
+
+	// Trimming keeps the soonest in each direction
+	got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L08&per_direction=1").Arrivals)
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"N0", "S0"}) {
+		t.Errorf("per_direction=1: %v, want [N0 S0]", got)
+	}
+
+	for _, bad := range []string{"0", "-2", "two"} {
+		if rec := e.get("/arrivals?stops=L08&per_direction=" + bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("per_direction=%s: status %d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+func TestArrivalsLookaheadKeepsMinimum(t *testing.T) {
+	arrival := func(stop, dir string, minutes int) feeds.Arrival {
+		return feeds.Arrival{StopID: stop, Line: "L", DirectionCode: dir, Minutes: minutes, TripID: fmt.Sprintf("%s%s%d", stop, dir, minutes)}
+	}
+	update := map[string][]feeds.Arrival{
+		"L08": {arrival("L08", "N", 3), arrival("L08", "N", 8), arrival("L08", "N", 25), arrival("L08", "S", 25), arrival("L08", "S", 40)},
+		// Overnight: the only train is well past the window
+		"L06": {arrival("L06", "N", 25)},
+	}
+
+	tests := []struct {
+		config string
+		want   []string
+	}{
+		{"lookahead: 10m\n  min_per_direction: 1", []string{"L08N3", "L08N8", "L08S25", "L06N25"}},
+		{"lookahead: 10m\n  min_per_direction: 2", []string{"L08N3", "L08N8", "L08S25", "L08S40", "L06N25"}},
+		{"lookahead: 10m\n  min_per_direction: 0", []string{"L08N3", "L08N8"}},
+		{"lookahead: 0s\n  min_per_direction: 1", []string{"L08N3", "L08N8", "L08N25", "L08S25", "L08S40", "L06N25"}},
+	}
+	for _, tt := range tests {
+		e := newTestEnv(t, "polling:\n  arrivals_per_direction: 10\nserver:\n  "+tt.config+"\n")
+		e.cache.Update(update)
+		got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L08,L06").Arrivals)
+		slices.Sort(got)
+		want := slices.Clone(tt.want)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("%q: %v, want %v", tt.config, got, want)
+		}
+	}
+}
+
+func TestSortArrivals(t *testing.T) {
+	// Soonest first, as the cache returns them
+	base := []feeds.Arrival{
+		{TripID: "a", Line: "G", Station: "Court Sq", DirectionCode: "S", Minutes: 1},
+		{TripID: "b", Line: "L", Station: "Bedford Av", DirectionCode: "N", Minutes: 2},
+		{TripID: "c", Line: "A", Station: "59 St", DirectionCode: "S", Minutes: 3},
+		{TripID: "d", Line: "L", Station: "1 Av", DirectionCode: "S", Minutes: 4},
+		{TripID: "e", Line: "G", Station: "Bedford-Nostrand Avs", DirectionCode: "N", Minutes: 5},
+	}
+
+	tests := []struct {
+		param string
+		want  string
+	}{
+		{"", "abcde"},
+		{"minutes", "abcde"},
+		{"minutes:asc", "abcde"},
+		{"minutes:desc", "edcba"},
+		// Ties on the key stay soonest first, in either order
+		{"line", "caebd"},
+		{"line:desc", "bdaec"},
+		{"station", "dcbea"},
+		{"station:desc", "aebcd"},
+		{"direction", "beacd"},
+		{"direction:desc", "acdbe"},
+	}
+	for _, tt := range tests {
+		arrivals := slices.Clone(base)
+		if err := sortArrivals(arrivals, tt.param); err != nil {
+			t.Errorf("sort=%s: %v", tt.param, err)
+			continue
+		}
+		if got := strings.Join(tripIDs(arrivals), ""); got != tt.want {
+			t.Errorf("sort=%s: %s, want %s", tt.param, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"delay", "line:up", ":desc"} {
+		if err := sortArrivals(slices.Clone(base), bad); err == nil {
+			t.Errorf("sort=%s: no error", bad)
+		}
+	}
+}
+
+func TestArrivalsSortParam(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 1, TripID: "n"},
+			{StopID: "L08", Line: "L", DirectionCode: "S", Minutes: 6, TripID: "s"},
+		},
+		"G29": {{StopID: "G29", Line: "G", DirectionCode: "N", Minutes: 3, TripID: "g"}},
+	})
+	if got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L08,G29").Arrivals); !slices.Equal(got, []string{"n", "g", "s"}) {
+		t.Errorf("default: %v, want minutes order", got)
+	}
+	if got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L08,G29&sort=line:desc").Arrivals); !slices.Equal(got, []string{"n", "s", "g"}) {
+		t.Errorf("sort=line:desc: %v", got)
+	}
+}
+
+func TestArrivalsUnknownStops(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 2, TripID: "t1"}},
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		resp := arrivalsFor(t, e, "/arrivals?stops=L08,ZZ9,BADID")
+		if got := tripIDs(resp.Arrivals); !slices.Equal(got, []string{"t1"}) {
+			t.Errorf("arrivals %v, want the known stop's", got)
+		}
+		if !slices.Equal(resp.UnknownStops, []string{"BADID", "ZZ9"}) {
+			t.Errorf("unknown_stops %v, want [BADID ZZ9]", resp.UnknownStops)
+		}
+
+		rec := e.get("/arrivals?stops=L08")
+		if strings.Contains(rec.Body.String(), "unknown_stops") {
+			t.Errorf("all stops known, but the body names unknown_stops: %s", rec.Body)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		rec := e.get("/arrivals?stops=L08,ZZ9&strict=true")
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("status %d, want 400", rec.Code)
+		}
+		var body struct {
+			UnknownStops []string `json:"unknown_stops"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(body.UnknownStops, []string{"ZZ9"}) {
+			t.Errorf("unknown_stops %v, want [ZZ9]", body.UnknownStops)
+		}
+
+		if got := tripIDs(arrivalsFor(t, e, "/arrivals?stops=L08&strict=true").Arrivals); len(got) != 1 {
+			t.Errorf("strict with known stops: %v, want one arrival", got)
+		}
+	})
+}
+
+func TestArrivalsBBox(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 1, TripID: "bedford"}},
+		"G29": {{StopID: "G29", Line: "G", DirectionCode: "S", Minutes: 2, TripID: "metropolitan"}},
+		"L06": {{StopID: "L06", Line: "L", DirectionCode: "N", Minutes: 3, TripID: "first-av"}},
+	})
+
+	// Williamsburg: Bedford Av, Lorimer St and Metropolitan Av, not 1 Av
+	resp := arrivalsFor(t, e, "/arrivals/bbox?minLat=40.71&minLon=-73.96&maxLat=40.72&maxLon=-73.95")
+	if got := tripIDs(resp.Arrivals); !slices.Equal(got, []string{"bedford", "metropolitan"}) {
+		t.Errorf("in the box: %v, want [bedford metropolitan]", got)
+	}
+
+	tests := []struct {
+		query, want string
+	}{
+		{"minLat=40.5&minLon=-74.3&maxLat=40.95&maxLon=-73.7", "max is 100"},
+		{"minLat=40.72&minLon=-73.96&maxLat=40.71&maxLon=-73.95", "min bounds"},
+		{"minLat=40.71&minLon=-73.96&maxLat=40.72", "invalid maxLon"},
+	}
+	for _, tt := range tests {
+		rec := e.get("/arrivals/bbox?" + tt.query)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: %d %s, want 400 with %q", tt.query, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestArrivalsMinMinutes(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 3, TripID: "m3", Assigned: true},
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 4, TripID: "m4", Assigned: true},
+			{StopID: "L08", Line: "L", DirectionCode: "S", Minutes: 5, TripID: "m5"},
+			{StopID: "L08", Line: "L", DirectionCode: "S", Minutes: 9, TripID: "m9", Assigned: true},
+		},
+	})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"min_minutes=0", []string{"m3", "m4", "m5", "m9"}},
+		// A train exactly the walk time away is still catchable
+		{"min_minutes=4", []string{"m4", "m5", "m9"}},
+		{"min_minutes=5", []string{"m5", "m9"}},
+		{"min_minutes=4&assigned=true", []string{"m4", "m9"}},
+		{"min_minutes=10", []string{}},
+	}
+	for _, tt := range tests {
+		resp := arrivalsFor(t, e, "/arrivals?stops=L08&"+tt.query)
+		if got := tripIDs(resp.Arrivals); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.query, got, tt.want)
+		}
+	}
+	if rec := e.get("/arrivals?stops=L08&min_minutes=10"); !strings.Contains(rec.Body.String(), `"arrivals":[]`) {
+		t.Errorf("everything filtered out: %s, want an empty list", rec.Body)
+	}
+	if rec := e.get("/arrivals?stops=L08&min_minutes=four"); rec.Code != http.StatusBadRequest {
+		t.Errorf("min_minutes=four: status %d, want 400", rec.Code)
+	}
+}
+
+func TestArrivalsCountMatchesList(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  arrivals_per_direction: 2\nserver:\n  lookahead: 20m\n")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 0, TripID: "origin", Origin: true, Assigned: true},
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 2, TripID: "n2"},
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 5, TripID: "n5", Assigned: true},
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 8, TripID: "n8", Assigned: true},
+			{StopID: "L08", Line: "L", DirectionCode: "S", Minutes: 4, TripID: "s4", Assigned: true},
+			{StopID: "L08", Line: "L", DirectionCode: "S", Minutes: 25, TripID: "s25", Assigned: true},
+			{StopID: "L08", Line: "L", DirectionCode: "S", Minutes: 40, TripID: "s40", Assigned: true},
+		},
+	})
+
+	for _, query := range []string{
+		"",
+		"exclude=departures",
+		"assigned=true",
+		"min_minutes=3",
+		"per_direction=1",
+		"per_direction=5",
+		"exclude=departures&min_minutes=1&per_direction=3",
+	} {
+		want := map[string]int{}
+		for _, a := range arrivalsFor(t, e, "/arrivals?stops=L08&"+query).Arrivals {
+			want[a.DirectionCode]++
+		}
+
+		rec := e.get("/arrivals/count?stops=L08&" + query)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("count %s: status %d: %s", query, rec.Code, rec.Body)
+		}
+		var counts map[string]map[string]int
+		if err := json.Unmarshal(rec.Body.Bytes(), &counts); err != nil {
+			t.Fatal(err)
+		}
+		if got := counts["L08"]; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%q: counts %v, /arrivals lists %v", query, got, want)
+		}
+	}
+
+	// within narrows what /arrivals lists, never widens it
+	rec := e.get("/arrivals/count?stops=L08&per_direction=1&within=10m")
+	if !strings.Contains(rec.Body.String(), `{"L08":{"N":1,"S":1}}`) {
+		t.Errorf("per_direction=1&within=10m: %s", rec.Body)
+	}
+	for _, query := range []string{"min_minutes=-1", "per_direction=abc"} {
+		if rec := e.get("/arrivals/count?stops=L08&" + query); rec.Code != http.StatusBadRequest {
+			t.Errorf("count %s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"feed/internal/feeds"
+)
+
+// arrivalsFormat picks the /arrivals representation: ?format= wins, then
+// the Accept header, defaulting to JSON.
+func arrivalsFormat(r *http.Request) string {
+	switch f := r.URL.Query().Get("format"); f {
+	case "csv", "text", "json":
+		return f
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return "csv"
+	case strings.Contains(accept, "text/plain"):
+		return "text"
+	}
+	return "json"
+}
+
+var arrivalColumns = []string{"stop_id", "station", "line", "direction", "direction_code", "minutes"}
+
+func writeArrivalsCSV(w io.Writer, arrivals []feeds.Arrival) error {
+	cw := csv.NewWriter(w)
+	cw.Write(arrivalColumns)
+	for _, a := range arrivals {
+		cw.Write([]string{a.StopID, a.Station, a.Line, a.Direction, a.DirectionCode, strconv.Itoa(a.Minutes)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeArrivalsText(w io.Writer, arrivals []feeds.Arrival) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tSTATION\tDIRECTION\tMIN")
+	for _, a := range arrivals {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", a.Line, a.Station, a.Direction, a.Minutes)
+	}
+	return tw.Flush()
+}
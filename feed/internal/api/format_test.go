@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/csv"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"feed/internal/feeds"
+)
+
+func TestWriteArrivalsCSVEscaping(t *testing.T) {
+	arrivals := []feeds.Arrival{
+		{StopID: "A24", Station: "59 St-Columbus Circle, Upper West", Line: "A", Direction: "Uptown", DirectionCode: "N", Minutes: 3},
+		{StopID: "R14", Station: `57 St "7 Av"`, Line: "N", Direction: "Downtown", DirectionCode: "S", Minutes: 11},
+	}
+	var b strings.Builder
+	if err := writeArrivalsCSV(&b, arrivals); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "stop_id,station,line,direction,direction_code,minutes\n" +
+		"A24,\"59 St-Columbus Circle, Upper West\",A,Uptown,N,3\n" +
+		"R14,\"57 St \"\"7 Av\"\"\",N,Downtown,S,11\n"
+	if b.String() != want {
+		t.Errorf("CSV:\n%s\nwant:\n%s", b.String(), want)
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range arrivals {
+		if got := rows[i+1][1]; got != a.Station {
+			t.Errorf("row %d station %q, want %q", i+1, got, a.Station)
+		}
+	}
+}
+
+func TestArrivalsFormatNegotiation(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {{StopID: "L08", Station: "Bedford Av, Williamsburg", Line: "L", Direction: "Manhattan", DirectionCode: "N", Minutes: 4}},
+	})
+
+	tests := []struct {
+		name, path, accept string
+		wantType, wantBody string
+	}{
+		{"query csv", "/arrivals?stops=L08&format=csv", "", "text/csv", `L08,"Bedford Av, Williamsburg",L,Manhattan,N,4`},
+		{"accept csv", "/arrivals?stops=L08", "text/csv", "text/csv", `L08,"Bedford Av, Williamsburg",L,Manhattan,N,4`},
+		{"query text", "/arrivals?stops=L08&format=text", "", "text/plain", "Bedford Av, Williamsburg  Manhattan"},
+		{"query beats accept", "/arrivals?stops=L08&format=json", "text/csv", "application/json", `"station":"Bedford Av, Williamsburg"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := e.do(req)
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type %q, want %s", ct, tt.wantType)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body:\n%s\nwant it to contain %s", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"feed/internal/feeds"
+	"feed/internal/stations"
+)
+
+// GeoJSON (RFC 7946) output for mapping libraries. Stations without
+// coordinates in stations.csv are left out rather than drawn at 0,0.
+
+type FeatureCollection struct {
+	Type     string    `json:"type"` // always "FeatureCollection"
+	Features []Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string         `json:"type"` // always "Feature"
+	ID         string         `json:"id"`
+	Geometry   Point          `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type Point struct {
+	Type        string     `json:"type"`        // always "Point"
+	Coordinates [2]float64 `json:"coordinates"` // longitude, latitude
+}
+
+func newFeatureCollection() FeatureCollection {
+	return FeatureCollection{Type: "FeatureCollection", Features: []Feature{}}
+}
+
+// stationFeature returns a station as a point, or false if it has no
+// coordinates.
+func stationFeature(s stations.StationInfo) (Feature, bool) {
+	if s.Lat == 0 && s.Lon == 0 {
+		return Feature{}, false
+	}
+	return Feature{
+		Type:     "Feature",
+		ID:       s.StopID,
+		Geometry: Point{Type: "Point", Coordinates: [2]float64{s.Lon, s.Lat}},
+		Properties: map[string]any{
+			"stop_id":    s.StopID,
+			"name":       s.Name,
+			"lines":      s.Lines,
+			"complex_id": s.ComplexID,
+		},
+	}, true
+}
+
+// annotateArrivals adds a station's upcoming arrivals, soonest first, and
+// the minutes until the first of them (null when none are cached).
+func annotateArrivals(f Feature, arrivals []feeds.Arrival) Feature {
+	if arrivals == nil {
+		arrivals = []feeds.Arrival{}
+	}
+	f.Properties["arrivals"] = arrivals
+	if len(arrivals) > 0 {
+		f.Properties["next_minutes"] = arrivals[0].Minutes
+	} else {
+		f.Properties["next_minutes"] = nil
+	}
+	return f
+}
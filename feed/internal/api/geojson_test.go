@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"feed/internal/feeds"
+	"feed/internal/stations"
+)
+
+// geoJSON decodes a GeoJSON response and checks the shape RFC 7946 and
+// mapping libraries expect: a FeatureCollection of Point features, each
+// with an id, [lon, lat] coordinates and a properties object. It returns
+// the features keyed by id.
+func geoJSON(t *testing.T, e *testEnv, path string) map[string]map[string]any {
+	t.Helper()
+	rec := e.get(path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", path, rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/geo+json" {
+		t.Errorf("%s: Content-Type %q", path, ct)
+	}
+
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Type     string `json:"type"`
+			ID       string `json:"id"`
+			Geometry struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]any `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "FeatureCollection" {
+		t.Errorf("%s: type %q", path, fc.Type)
+	}
+
+	features := make(map[string]map[string]any, len(fc.Features))
+	for _, f := range fc.Features {
+		if f.Type != "Feature" || f.Geometry.Type != "Point" || f.ID == "" {
+			t.Errorf("%s: feature %q is %s/%s", path, f.ID, f.Type, f.Geometry.Type)
+		}
+		// Longitude first; every NYC station is near -74, 40.7
+		if c := f.Geometry.Coordinates; len(c) != 2 || c[0] < -75 || c[0] > -73 || c[1] < 40 || c[1] > 41 {
+			t.Errorf("%s: %s coordinates %v, want [lon, lat]", path, f.ID, c)
+		}
+		if f.Properties == nil || f.Properties["stop_id"] != f.ID || f.Properties["name"] == "" {
+			t.Errorf("%s: %s properties %v", path, f.ID, f.Properties)
+		}
+		if _, ok := f.Properties["lines"].([]any); !ok {
+			t.Errorf("%s: %s lines %v, want a list", path, f.ID, f.Properties["lines"])
+		}
+		features[f.ID] = f.Properties
+	}
+	return features
+}
+
+func TestStationsGeoJSON(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	features := geoJSON(t, e, "/stations?format=geojson")
+	if want := len(e.stationDB.Load().GetAllStations()); len(features) != want {
+		t.Errorf("%d features, want one per station (%d)", len(features), want)
+	}
+	bedford := features["L08"]
+	if bedford["name"] != "Bedford Av" || bedford["complex_id"] != "120" {
+		t.Errorf("L08 properties %v", bedford)
+	}
+	if _, ok := bedford["arrivals"]; ok {
+		t.Errorf("station features carry arrivals: %v", bedford)
+	}
+}
+
+func TestArrivalsGeoJSON(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  arrivals_per_direction: 10\n")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {
+			{StopID: "L08", Line: "L", DirectionCode: "S", Minutes: 6, TripID: "b"},
+			{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 2, TripID: "a"},
+		},
+	})
+
+	features := geoJSON(t, e, "/arrivals/geojson?stops=L08,L06,ZZ9")
+	if len(features) != 2 {
+		t.Fatalf("%d features, want L08 and L06 only", len(features))
+	}
+
+	// The soonest arrival leads and sets next_minutes; JSON numbers
+	// decode as float64
+	bedford := features["L08"]
+	arrivals, _ := bedford["arrivals"].([]any)
+	if len(arrivals) != 2 || bedford["next_minutes"] != 2.0 {
+		t.Errorf("L08 arrivals %v next_minutes %v", arrivals, bedford["next_minutes"])
+	} else if first, _ := arrivals[0].(map[string]any); first["trip_id"] != "a" {
+		t.Errorf("L08 first arrival %v, want trip a", first)
+	}
+
+	// No arrivals: an empty list and a null next_minutes, still present
+	first := features["L06"]
+	if arrivals, ok := first["arrivals"].([]any); !ok || len(arrivals) != 0 {
+		t.Errorf("L06 arrivals %v, want []", first["arrivals"])
+	}
+	if v, ok := first["next_minutes"]; !ok || v != nil {
+		t.Errorf("L06 next_minutes %v (present %t), want null", v, ok)
+	}
+}
+
+func TestGeoJSONSkipsStationsWithoutCoordinates(t *testing.T) {
+	csv := `Station ID,Complex ID,GTFS Stop ID,Division,Line,Stop Name,Borough,Daytime Routes,Structure,GTFS Latitude,GTFS Longitude,North Direction Label,South Direction Label
+1,611,L08,BMT,Canarsie,Bedford Av,Bk,L,Subway,40.717304,-73.956872,Manhattan,Canarsie - Rockaway Parkway
+2,612,L06,BMT,Canarsie,1 Av,M,L,Subway,,,8 Av,Brooklyn
+`
+	path := filepath.Join(t.TempDir(), "stations.csv")
+	if err := os.WriteFile(path, []byte(csv), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := stations.LoadStationDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEnvDB(t, "{}", db)
+
+	// Drawn at 0,0 it would sit off the coast of Africa
+	for _, path := range []string{"/stations?format=geojson", "/arrivals/geojson", "/arrivals/geojson?stops=L06,L08"} {
+		features := geoJSON(t, e, path)
+		if _, ok := features["L08"]; len(features) != 1 || !ok {
+			t.Errorf("%s: features %v, want L08 only", path, features)
+		}
+	}
+}
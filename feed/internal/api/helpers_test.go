@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"feed/internal/config"
+	"feed/internal/feeds"
+	"feed/internal/stations"
+)
+
+// testEnv wires the API the way main does, without listening: requests go
+// straight to the servers' handlers.
+type testEnv struct {
+	cfg       *config.Config
+	stationDB *stations.Holder
+	cache     *feeds.ArrivalCache
+	notifier  *feeds.Notifier
+	fetcher   *feeds.FeedFetcher
+	hub       *SSEHub
+	public    *http.Server
+	admin     *http.Server // nil unless admin_port is set
+}
+
+func newTestEnv(tb testing.TB, yaml string) *testEnv {
+	tb.Helper()
+	db, err := stations.LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return newTestEnvDB(tb, yaml, db)
+}
+
+// newTestEnvDB is newTestEnv with the given station DB instead of the
+// checked-in stations.csv.
+func newTestEnvDB(tb testing.TB, yaml string, db *stations.StationDB) *testEnv {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	e := &testEnv{
+		cfg:       cfg,
+		stationDB: stations.NewHolder(db),
+		cache:     feeds.NewArrivalCache(),
+		notifier:  feeds.NewNotifier(),
+	}
+	e.cache.EnableHistory(cfg.Polling.HistorySize)
+	e.cache.EnableFrequency(cfg.Polling.FrequencyWindow)
+	e.hub = NewSSEHub(e.cache, e.stationDB, e.notifier, HubOptions{
+		Keepalive:   cfg.Server.SSEKeepalive,
+		StrictStops: cfg.Server.StrictStops,
+		AllowAll:    cfg.Server.StreamAll,
+		MaxAll:      cfg.Server.StreamAllMax,
+		MaxStops:    cfg.Server.MaxStops,
+	})
+	e.fetcher = feeds.NewFeedFetcher(cfg, e.cache, e.stationDB, nil, e.notifier)
+	e.public, e.admin = NewServer(cfg, e.hub, e.stationDB, nil, e.cache, e.fetcher)
+	return e
+}
+
+// do serves one request on the public handler.
+func (e *testEnv) do(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.public.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (e *testEnv) get(path string) *httptest.ResponseRecorder {
+	return e.do(httptest.NewRequest("GET", path, nil))
+}
+
+// serveFixtures serves testdata files by name, e.g. /l_trip_updates.pb.
+func serveFixtures(tb testing.TB) *httptest.Server {
+	tb.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		http.ServeFile(w, r, filepath.Join("testdata", filepath.Base(r.URL.Path)))
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
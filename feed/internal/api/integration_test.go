@@ -0,0 +1,297 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+
+	"feed/internal/feeds"
+	"feed/internal/stations"
+)
+
+// The fixtures were recorded at a fixed time, so minutes are counted from
+// the feed header (use_feed_clock) rather than the wall clock:
+//
+//   - l_trip_updates.pb: 24 L trips over every L stop, 12 per direction;
+//     trip L-N-03 skips Bedford Av.
+//   - a_with_alerts.pb: 3 southbound A trips from 59 St to Canal St plus
+//     two service alerts, which arrivals ignore.
+func TestIntegrationFetchToArrivals(t *testing.T) {
+	fixtures := serveFixtures(t)
+	e := newTestEnv(t, `
+polling:
+  use_feed_clock: true
+feeds:
+  L: `+fixtures.URL+`/l_trip_updates.pb
+  ACE: `+fixtures.URL+`/a_with_alerts.pb
+`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.fetcher.Start(ctx)
+	select {
+	case <-e.fetcher.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("initial fetch did not finish")
+	}
+
+	for _, st := range e.fetcher.Status() {
+		if st.LastError != "" {
+			t.Fatalf("feed %s: %s", st.Name, st.LastError)
+		}
+	}
+
+	var resp ArrivalsResponse
+	rec := e.get("/arrivals?stops=L08,A31")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.DataAvailable || resp.Stale {
+		t.Errorf("data_available=%t stale=%t, want true, false", resp.DataAvailable, resp.Stale)
+	}
+
+	byStop := map[string][]feeds.Arrival{}
+	for _, a := range resp.Arrivals {
+		byStop[a.StopID] = append(byStop[a.StopID], a)
+	}
+	if len(byStop) != 2 || len(byStop["L08"]) == 0 || len(byStop["A31"]) == 0 {
+		t.Fatalf("arrivals cover stops %v, want L08 and A31", keys(byStop))
+	}
+
+	if !sort.SliceIsSorted(resp.Arrivals, func(i, j int) bool {
+		return resp.Arrivals[i].Minutes < resp.Arrivals[j].Minutes
+	}) {
+		t.Errorf("arrivals not in minutes order: %v", minutes(resp.Arrivals))
+	}
+
+	for _, a := range byStop["L08"] {
+		if a.Line != "L" || a.Station != "Bedford Av" {
+			t.Errorf("L08 arrival %+v: want line L at Bedford Av", a)
+		}
+		if a.TripID == "L-N-03" {
+			t.Errorf("skipped stop served trip %s", a.TripID)
+		}
+		if a.Minutes < 0 {
+			t.Errorf("past arrival kept: %+v", a)
+		}
+	}
+	directions := map[string]string{}
+	for _, a := range byStop["L08"] {
+		directions[a.DirectionCode] = a.Direction
+	}
+	if directions["N"] != "Manhattan" || directions["S"] != "Canarsie - Rockaway Parkway" {
+		t.Errorf("L08 direction labels %v", directions)
+	}
+
+	// Three A trips six minutes apart, all southbound
+	a31 := byStop["A31"]
+	if len(a31) != 3 {
+		t.Fatalf("A31 has %d arrivals, want 3", len(a31))
+	}
+	for i, a := range a31 {
+		if a.DirectionCode != "S" || a.Line != "A" {
+			t.Errorf("A31 arrival %d: %+v", i, a)
+		}
+		if i > 0 && a.Minutes-a31[i-1].Minutes != 6 {
+			t.Errorf("A31 headway %d..%d: %v", i-1, i, minutes(a31))
+		}
+	}
+}
+
+func keys(m map[string][]feeds.Arrival) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+func minutes(arrivals []feeds.Arrival) []int {
+	ms := make([]int, len(arrivals))
+	for i, a := range arrivals {
+		ms[i] = a.Minutes
+	}
+	return ms
+}
+
+// Run with -race: fetch cycles and handlers read the station DB through
+// the holder while reloads swap it.
+func TestStationReloadDuringFetchAndRequests(t *testing.T) {
+	fixtures := serveFixtures(t)
+	e := newTestEnv(t, `
+polling:
+  interval: 20ms
+  use_feed_clock: true
+feeds:
+  L: `+fixtures.URL+`/l_trip_updates.pb
+`)
+	reloaded, err := stations.LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := e.stationDB.Load()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.fetcher.Start(ctx)
+	<-e.fetcher.Ready()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, path := range []string{"/arrivals?stops=L08", "/stations/search?q=bedford", "/arrivals/stop/L08"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if rec := e.get(path); rec.Code != http.StatusOK {
+					t.Errorf("GET %s during reload: status %d", path, rec.Code)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		if i%2 == 0 {
+			e.stationDB.Store(reloaded)
+		} else {
+			e.stationDB.Store(original)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+}
+
+// With allow_missing_stations main starts on an empty DB; a fetch and the
+// handlers must then come up empty rather than fail.
+func TestEmptyStationDB(t *testing.T) {
+	fixtures := serveFixtures(t)
+	e := newTestEnvDB(t, `
+polling:
+  use_feed_clock: true
+feeds:
+  L: `+fixtures.URL+`/l_trip_updates.pb
+`, stations.NewStationDB())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.fetcher.Start(ctx)
+	select {
+	case <-e.fetcher.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("initial fetch did not finish")
+	}
+
+	empty := map[string]string{
+		"/stations":                   `[]`,
+		"/stations/search?q=bedford":  `[]`,
+		"/arrivals/geojson?stops=L08": `{"type":"FeatureCollection","features":[]}`,
+	}
+	for path, want := range empty {
+		rec := e.get(path)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", path, rec.Code, rec.Body)
+		} else if got := strings.TrimSpace(rec.Body.String()); got != want {
+			t.Errorf("%s = %s, want %s", path, got, want)
+		}
+	}
+
+	var resp ArrivalsResponse
+	rec := e.get("/arrivals?stops=L08")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/arrivals: status %d: %s", rec.Code, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Arrivals) != 0 {
+		t.Errorf("/arrivals returned %d arrivals from an empty DB", len(resp.Arrivals))
+	}
+
+	for _, path := range []string{"/snapshot?stops=L08", "/arrivals/count?stops=L08", "/lines", "/feeds/status"} {
+		if rec := e.get(path); rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", path, rec.Code, rec.Body)
+		}
+	}
+	for _, path := range []string{"/arrivals/stop/L08", "/stations/L08/transfers"} {
+		if rec := e.get(path); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+// An empty list from a healthy feed means no trains; from a failing one it
+// means no data, and data_available says which.
+func TestDataAvailable(t *testing.T) {
+	empty, err := proto.Marshal(&gtfs.FeedMessage{Header: &gtfs.FeedHeader{
+		GtfsRealtimeVersion: proto.String("2.0"),
+		Timestamp:           proto.Uint64(uint64(time.Now().Unix())),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(empty)
+	}))
+	defer quiet.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	e := newTestEnv(t, "feeds:\n  L: "+quiet.URL+"\n  G: "+down.URL+"\n")
+	check := func(when, path string, want bool) {
+		t.Helper()
+		rec := e.get(path)
+		var resp struct {
+			Arrivals      []feeds.Arrival `json:"arrivals"`
+			DataAvailable bool            `json:"data_available"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s %s: status %d: %v", when, path, rec.Code, err)
+		}
+		if len(resp.Arrivals) != 0 || resp.DataAvailable != want {
+			t.Errorf("%s %s: %d arrivals, data_available %t, want none and %t", when, path, len(resp.Arrivals), resp.DataAvailable, want)
+		}
+	}
+
+	// Nothing fetched yet: no data anywhere
+	check("before a fetch", "/arrivals?stops=L08", false)
+
+	e.fetcher.FetchOnce(context.Background())
+	check("quiet feed", "/arrivals?stops=L08", true)
+	check("feed down", "/arrivals?stops=G29", false)
+	check("one feed down", "/arrivals?stops=L08,G29", false)
+	check("feed down", "/arrivals/bbox?minLat=40.7125&minLon=-73.9516&maxLat=40.7130&maxLon=-73.9512", false)
+
+	rec := e.get("/arrivals/stop/G29")
+	var stop StopArrivalsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &stop); err != nil {
+		t.Fatal(err)
+	}
+	if stop.DataAvailable {
+		t.Error("/arrivals/stop/G29: data_available with its feed down")
+	}
+	if err := json.Unmarshal(e.get("/arrivals/stop/L08").Body.Bytes(), &stop); err != nil || !stop.DataAvailable {
+		t.Errorf("/arrivals/stop/L08: data_available %t (%v), want true", stop.DataAvailable, err)
+	}
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"feed/internal/feeds"
+)
+
+// openAPIDoc decodes the embedded spec.
+func openAPIDoc(t *testing.T) map[string]any {
+	t.Helper()
+	var doc map[string]any
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	return doc
+}
+
+// responseSchema returns the schema documented for a 200 from the
+// operation, in the given media type.
+func responseSchema(t *testing.T, doc map[string]any, method, path, mediaType string) map[string]any {
+	t.Helper()
+	op, _ := doc["paths"].(map[string]any)[path].(map[string]any)[strings.ToLower(method)].(map[string]any)
+	if op == nil {
+		t.Fatalf("%s %s is not in openapi.json", method, path)
+	}
+	content, _ := op["responses"].(map[string]any)["200"].(map[string]any)["content"].(map[string]any)
+	media, _ := content[mediaType].(map[string]any)
+	if media == nil {
+		t.Fatalf("%s %s documents no %s response", method, path, mediaType)
+	}
+	return media["schema"].(map[string]any)
+}
+
+// validate checks v against the subset of JSON Schema openapi.json uses:
+// $ref, type, properties, required, items, additionalProperties and enum.
+// Objects with properties and no additionalProperties are closed, so a
+// field added to a struct but not to the spec fails too.
+func validate(doc map[string]any, schema map[string]any, v any, at string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		target, _ := doc["components"].(map[string]any)["schemas"].(map[string]any)[name].(map[string]any)
+		if target == nil {
+			return []string{at + ": unresolved " + ref}
+		}
+		return validate(doc, target, v, at)
+	}
+
+	var errs []string
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, v) {
+		errs = append(errs, fmt.Sprintf("%s: %v not in %v", at, v, enum))
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: %T, want object", at, v))
+		}
+		props, _ := schema["properties"].(map[string]any)
+		for _, r := range asStrings(schema["required"]) {
+			if _, ok := obj[r]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required %q", at, r))
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := props[k].(map[string]any); ok {
+				errs = append(errs, validate(doc, p, obj[k], at+"."+k)...)
+			} else if extra, ok := schema["additionalProperties"].(map[string]any); ok {
+				errs = append(errs, validate(doc, extra, obj[k], at+"."+k)...)
+			} else if props != nil && schema["additionalProperties"] == nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not documented", at, k))
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: %T, want array", at, v))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range arr {
+				errs = append(errs, validate(doc, items, item, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %T, want string", at, v))
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != float64(int64(n)) {
+			errs = append(errs, fmt.Sprintf("%s: %v, want integer", at, v))
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %T, want number", at, v))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %T, want boolean", at, v))
+		}
+	}
+	return errs
+}
+
+func asStrings(v any) []string {
+	list, _ := v.([]any)
+	out := make([]string, 0, len(list))
+	for _, s := range list {
+		out = append(out, s.(string))
+	}
+	return out
+}
+
+func TestResponsesMatchOpenAPI(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  history_size: 3\n  frequency_window: 1h\n")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {
+			{StopID: "L08", Platform: "L08N", Station: "Bedford Av", Line: "L", Direction: "Manhattan", DirectionCode: "N",
+				Minutes: 2, Status: "approaching", ArrivalClock: "08:02", Assigned: true, Headsign: "8 Av",
+				TripID: "L-N-1", Delay: 30, ArrivalTime: 1700000120},
+			{StopID: "L08", Platform: "L08S", Station: "Bedford Av", Line: "L", Direction: "Brooklyn", DirectionCode: "S",
+				Minutes: 5, Status: "scheduled", TripID: "L-S-1", ArrivalTime: 1700000300},
+		},
+		"L06": {
+			{StopID: "L06", Station: "1 Av", Line: "L", Direction: "Manhattan", DirectionCode: "N", Minutes: 0,
+				Status: "arriving", TripID: "L-N-1"},
+		},
+	})
+	doc := openAPIDoc(t)
+
+	tests := []struct {
+		path, route, mediaType string
+	}{
+		{"/arrivals?stops=L08,L06", "/arrivals", "application/json"},
+		{"/arrivals/geojson?stops=L08", "/arrivals/geojson", "application/geo+json"},
+		{"/arrivals/count?stops=L08", "/arrivals/count", "application/json"},
+		{"/arrivals/stop/L08", "/arrivals/stop/{id}", "application/json"},
+		{"/arrivals/bbox?minLat=40.70&minLon=-73.97&maxLat=40.73&maxLon=-73.94", "/arrivals/bbox", "application/json"},
+		{"/arrivals/history?stop=L08", "/arrivals/history", "application/json"},
+		{"/trips/L-N-1", "/trips/{id}", "application/json"},
+		{"/analytics/frequency?line=L", "/analytics/frequency", "application/json"},
+		{"/stations", "/stations", "application/json"},
+		{"/stations/search?q=bedford", "/stations/search", "application/json"},
+		{"/snapshot?stops=L08", "/snapshot", "application/json"},
+		{"/lines", "/lines", "application/json"},
+		{"/lines/L/arrivals", "/lines/{line}/arrivals", "application/json"},
+		{"/feeds/status", "/feeds/status", "application/json"},
+		{"/stats", "/stats", "application/json"},
+		{"/health?verbose=true", "/health", "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			rec := e.get(tt.path)
+			if rec.Code != 200 {
+				t.Fatalf("GET %s: status %d: %s", tt.path, rec.Code, rec.Body)
+			}
+			var body any
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("GET %s: %v", tt.path, err)
+			}
+			schema := responseSchema(t, doc, "GET", tt.route, tt.mediaType)
+			for _, err := range validate(doc, schema, body, "$") {
+				t.Error(err)
+			}
+		})
+	}
+
+	t.Run("/arrivals/batch", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/arrivals/batch", strings.NewReader(`[{"stops":["L08"]},{"stops":["L06"]}]`))
+		rec := e.do(req)
+		var body any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		for _, err := range validate(doc, responseSchema(t, doc, "POST", "/arrivals/batch", "application/json"), body, "$") {
+			t.Error(err)
+		}
+	})
+}
+
+func TestValidateFlagsDrift(t *testing.T) {
+	doc := openAPIDoc(t)
+	schema := map[string]any{"$ref": "#/components/schemas/Arrival"}
+	var arrival map[string]any
+	raw, _ := json.Marshal(feeds.Arrival{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 2})
+	json.Unmarshal(raw, &arrival)
+	if errs := validate(doc, schema, arrival, "$"); len(errs) != 0 {
+		t.Fatalf("valid arrival: %v", errs)
+	}
+
+	arrival["track"] = "2"
+	arrival["minutes"] = "soon"
+	errs := validate(doc, schema, arrival, "$")
+	if len(errs) != 2 {
+		t.Errorf("errors %v, want an undocumented track and a mistyped minutes", errs)
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Problem is an RFC 7807 error body. Type is always "about:blank", so Title
+// is just the status text and Detail carries the specifics.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	// Extension members
+	UnknownStops []string `json:"unknown_stops,omitempty"`
+}
+
+// writeError answers with application/problem+json, or a plain-text body
+// for clients that ask for text/plain and not JSON.
+func writeError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblem(w, r, Problem{Status: status, Detail: detail})
+}
+
+// writeProblem is writeError for bodies with extension members. Type and
+// Title are filled in from Status.
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	if wantsPlain(r.Header.Get("Accept")) {
+		http.Error(w, p.Detail, p.Status)
+		return
+	}
+
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func wantsPlain(accept string) bool {
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "json")
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorsAreProblemJSON(t *testing.T) {
+	open := newTestEnv(t, `
+server:
+  admin:
+    enabled: true
+    token: s3cret
+`)
+	gated := newTestEnv(t, "server:\n  ready_gate: true\n  ready_timeout: 1m\n")
+	tests := []struct {
+		e            *testEnv
+		method, path string
+		status       int
+		detail       string
+	}{
+		{open, "GET", "/arrivals?stops=L08&limit=lots", http.StatusBadRequest, `invalid limit "lots"`},
+		{open, "GET", "/stations/ZZ9/transfers", http.StatusNotFound, "unknown station"},
+		{open, "GET", "/lines/9/arrivals", http.StatusNotFound, "unknown line"},
+		{open, "GET", "/arrivals?stops=L08,ZZ9&strict=true", http.StatusBadRequest, "unknown stops: ZZ9"},
+		{open, "POST", "/admin/refresh", http.StatusUnauthorized, ""},
+		{gated, "GET", "/arrivals?stops=L08", http.StatusServiceUnavailable, "waiting for initial feed data"},
+	}
+	for _, tt := range tests {
+		rec := tt.e.do(httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s %s: Content-Type %q", tt.method, tt.path, ct)
+		}
+		var p map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+			t.Errorf("%s %s: %v: %s", tt.method, tt.path, err, rec.Body)
+			continue
+		}
+		if p["type"] != "about:blank" || p["title"] != http.StatusText(tt.status) || p["status"] != float64(tt.status) {
+			t.Errorf("%s %s: problem %v", tt.method, tt.path, p)
+		}
+		if detail, _ := p["detail"].(string); !strings.Contains(detail, tt.detail) {
+			t.Errorf("%s %s: detail %q, want it to mention %q", tt.method, tt.path, detail, tt.detail)
+		}
+	}
+
+	// strict=true names the unknown stops in an extension member as well
+	rec := open.get("/arrivals?stops=L08,ZZ9&strict=true")
+	var p Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.UnknownStops) != 1 || p.UnknownStops[0] != "ZZ9" {
+		t.Errorf("strict unknown_stops = %v, want [ZZ9]", p.UnknownStops)
+	}
+}
+
+func TestErrorsPlainWhenAsked(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	for accept, plain := range map[string]bool{
+		"text/plain":                   true,
+		"text/plain, application/json": false,
+		"application/problem+json":     false,
+		"":                             false,
+		"text/html,text/plain;q=0.9":   true,
+	} {
+		req := httptest.NewRequest("GET", "/stations/ZZ9/transfers", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := e.do(req)
+		ct := rec.Header().Get("Content-Type")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Accept %q: status %d", accept, rec.Code)
+		}
+		if plain && (!strings.HasPrefix(ct, "text/plain") || strings.TrimSpace(rec.Body.String()) != "unknown station") {
+			t.Errorf("Accept %q: %q %q, want a plain-text body", accept, ct, rec.Body)
+		}
+		if !plain && ct != "application/problem+json" {
+			t.Errorf("Accept %q: Content-Type %q, want problem+json", accept, ct)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCachedResponses bounds the response cache; past it, expired entries
+// are swept and, if it's still full, the whole map is dropped rather than
+// tracking recency. Entries live one TTL (about a second) at most, so a
+// reset costs one extra render per distinct query, and only when more
+// than this many distinct queries arrive within a TTL, where an LRU would
+// be evicting constantly anyway.
+const maxCachedResponses = 1000
+
+// responseCache keeps rendered /arrivals bodies for a short TTL so bursts
+// of identical polls are served without re-filtering. Keys are ETags,
+// which fold in the cache's update time and the station DB generation, so
+// an entry can't outlive the data it was built from.
+type responseCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// newResponseCache returns nil when ttl is 0; a nil cache never hits.
+func newResponseCache(ttl time.Duration) *responseCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &responseCache{ttl: ttl, entries: make(map[string]cachedResponse)}
+}
+
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	if c == nil {
+		return cachedResponse{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return cachedResponse{}, false
+	}
+	return e, true
+}
+
+func (c *responseCache) put(key, contentType string, body []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= maxCachedResponses {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCachedResponses {
+			c.entries = make(map[string]cachedResponse)
+		}
+	}
+	c.entries[key] = cachedResponse{contentType: contentType, body: body, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"feed/internal/stations"
+)
+
+func TestArrivalsResponseCacheHit(t *testing.T) {
+	e := newTestEnv(t, "server:\n  response_cache_ttl: 1m\n")
+	fillCache(e.cache, 4)
+
+	first := e.get("/arrivals?stops=L08,L06&per_direction=1")
+	if first.Header().Get("X-Cache") != "" {
+		t.Fatal("first request was a cache hit")
+	}
+	second := e.get("/arrivals?stops=L06,L08&per_direction=1")
+	if second.Header().Get("X-Cache") != "hit" {
+		t.Error("identical request (stops reordered) missed the cache")
+	}
+	if second.Body.String() != first.Body.String() || second.Header().Get("Content-Type") != first.Header().Get("Content-Type") {
+		t.Error("cached response differs from the rendered one")
+	}
+
+	if rec := e.get("/arrivals?stops=L08,L06&per_direction=2"); rec.Header().Get("X-Cache") != "" {
+		t.Error("different filters shared a cached response")
+	}
+	if rec := e.get("/arrivals?stops=L08,L06&per_direction=1&format=csv"); rec.Header().Get("X-Cache") != "" {
+		t.Error("different format shared a cached response")
+	}
+
+	// A feed update invalidates
+	fillCache(e.cache, 4)
+	if rec := e.get("/arrivals?stops=L08,L06&per_direction=1"); rec.Header().Get("X-Cache") != "" {
+		t.Error("response cached before a cache update was served after it")
+	}
+}
+
+func TestArrivalsResponseCacheStationReload(t *testing.T) {
+	e := newTestEnv(t, "server:\n  response_cache_ttl: 1m\n")
+	fillCache(e.cache, 2)
+
+	e.get("/arrivals?stops=L08")
+	if rec := e.get("/arrivals?stops=L08"); rec.Header().Get("X-Cache") != "hit" {
+		t.Fatal("second request missed the cache")
+	}
+
+	// After swapping in a DB without L08, the stop is reported unknown
+	// instead of serving the body built from the old DB
+	e.stationDB.Store(stations.NewStationDB())
+	rec := e.get("/arrivals?stops=L08")
+	if rec.Header().Get("X-Cache") != "" {
+		t.Fatal("response built from the old station DB was served after a reload")
+	}
+	var resp ArrivalsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.UnknownStops) != 1 || resp.UnknownStops[0] != "L08" {
+		t.Errorf("unknown_stops = %v, want [L08]", resp.UnknownStops)
+	}
+}
+
+func TestArrivalsResponseCacheTTL(t *testing.T) {
+	e := newTestEnv(t, "server:\n  response_cache_ttl: 200ms\n")
+	fillCache(e.cache, 2)
+
+	e.get("/arrivals?stops=L08")
+	if rec := e.get("/arrivals?stops=L08"); rec.Header().Get("X-Cache") != "hit" {
+		t.Fatal("second request within the TTL missed the cache")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if rec := e.get("/arrivals?stops=L08"); rec.Header().Get("X-Cache") != "" {
+		t.Error("response served after its TTL ran out")
+	}
+
+	// Off unless configured
+	off := newTestEnv(t, "{}")
+	fillCache(off.cache, 2)
+	if off.cfg.Server.ResponseCacheTTL != 0 {
+		t.Errorf("default response_cache_ttl = %s, want 0", off.cfg.Server.ResponseCacheTTL)
+	}
+	off.get("/arrivals?stops=L08")
+	if rec := off.get("/arrivals?stops=L08"); rec.Header().Get("X-Cache") != "" {
+		t.Error("response cache on by default")
+	}
+}
+
+func TestResponseCacheBounded(t *testing.T) {
+	c := newResponseCache(time.Minute)
+	for i := 0; i < maxCachedResponses+10; i++ {
+		c.put(fmt.Sprint(i), "application/json", []byte("{}"))
+	}
+	if n := len(c.entries); n > maxCachedResponses {
+		t.Errorf("%d entries, want at most %d", n, maxCachedResponses)
+	}
+	if _, ok := c.get(fmt.Sprint(maxCachedResponses + 9)); !ok {
+		t.Error("newest entry missing after a reset")
+	}
+
+	if newResponseCache(0) != nil {
+		t.Error("ttl 0 should disable the cache")
+	}
+	var off *responseCache
+	off.put("k", "text/plain", nil)
+	if _, ok := off.get("k"); ok {
+		t.Error("disabled cache hit")
+	}
+}
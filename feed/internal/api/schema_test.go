@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"feed/internal/feeds"
+)
+
+// fill sets every field of v to a non-zero value, so omitempty fields are
+// encoded too.
+func fill(v reflect.Value) {
+	if v.Type() == reflect.TypeOf(time.Time{}) {
+		v.Set(reflect.ValueOf(time.Date(2025, 10, 14, 12, 0, 0, 0, time.UTC)))
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fill(v.Index(0))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fill(v.Field(i))
+			}
+		}
+	}
+}
+
+func TestArrivalsSchemaMatchesStructs(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	rec := e.get("/schema/arrivals")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema["title"] != "ArrivalsResponse" || schema["$schema"] == nil {
+		t.Errorf("title %v, $schema %v", schema["title"], schema["$schema"])
+	}
+
+	var full ArrivalsResponse
+	fill(reflect.ValueOf(&full).Elem())
+	for name, resp := range map[string]ArrivalsResponse{"every field set": full, "empty": {Arrivals: []feeds.Arrival{}}} {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range validate(nil, schema, v, "$") {
+			t.Errorf("%s: %s", name, msg)
+		}
+	}
+
+	// The other way round: every documented arrival field is one the
+	// struct encodes, new ones such as headsign included
+	data, _ := json.Marshal(full.Arrivals[0])
+	var encoded map[string]any
+	json.Unmarshal(data, &encoded)
+	var want []string
+	for k := range encoded {
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	items := schema["properties"].(map[string]any)["arrivals"].(map[string]any)["items"].(map[string]any)
+	var documented []string
+	for k := range items["properties"].(map[string]any) {
+		documented = append(documented, k)
+	}
+	sort.Strings(documented)
+	if !slices.Equal(documented, want) {
+		t.Errorf("schema arrival fields %v, struct encodes %v", documented, want)
+	}
+	for _, f := range []string{"headsign", "platform", "arrival_clock"} {
+		if !slices.Contains(documented, f) {
+			t.Errorf("schema lacks %q", f)
+		}
+	}
+	if required := asStrings(items["required"]); slices.Contains(required, "headsign") || !slices.Contains(required, "minutes") {
+		t.Errorf("arrival required = %v, want minutes but not omitempty headsign", required)
+	}
+}
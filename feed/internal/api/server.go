@@ -1,89 +1,985 @@
 package api
 
 import (
+	"bytes"
+	"crypto/subtle"
+	_ "embed"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"feed/internal/config"
 	"feed/internal/feeds"
 	"feed/internal/stations"
 )
 
+// Hand-maintained; update alongside any route or response struct change.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Bounds on one POST /arrivals/batch request.
+const (
+	maxBatchQueries = 20
+	maxBatchBytes   = 64 << 10
+)
+
+// Long-poll waits; the default stays under common 30s proxy timeouts.
+const (
+	defaultPollWait = 25 * time.Second
+	maxPollWait     = 60 * time.Second
+)
+
+// Keeps a zoomed-out map view from pulling the whole system in one query.
+const maxBBoxStations = 100
+
 type ArrivalsResponse struct {
 	Arrivals []feeds.Arrival `json:"arrivals"`
 	Stale    bool            `json:"stale"`
+	// False when a feed covering the requested stops is down, frozen or
+	// hasn't been fetched yet, so an empty list may just mean no data
+	DataAvailable bool     `json:"data_available"`
+	UnknownStops  []string `json:"unknown_stops,omitempty"`
+	// When the cache last took in a fetch cycle; zero before the first
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// BatchQuery is one entry of a POST /arrivals/batch body. Empty Stops
+// means all stops; Lines and Direction narrow the result when set, and
+// Limit is bounded by server.max_arrivals.
+type BatchQuery struct {
+	Stops     []string `json:"stops"`
+	Lines     []string `json:"lines,omitempty"`
+	Direction string   `json:"direction,omitempty"`
+	Limit     int      `json:"limit,omitempty"`
+}
+
+// SnapshotResponse bundles what a client needs on first load.
+type SnapshotResponse struct {
+	Stations     []stations.StationInfo `json:"stations"`
+	Arrivals     []feeds.Arrival        `json:"arrivals"`
+	Alerts       []json.RawMessage      `json:"alerts"` // reserved for service alerts; always empty for now
+	Stale        bool                   `json:"stale"`
+	UnknownStops []string               `json:"unknown_stops,omitempty"`
+	UpdatedAt    time.Time              `json:"updated_at"`
 }
 
-func NewServer(port int, hub *SSEHub, db *stations.StationDB, cache *feeds.ArrivalCache) *http.Server {
+// StopArrivalsResponse is one stop's arrivals grouped by direction code.
+type StopArrivalsResponse struct {
+	StopID        string                       `json:"stop_id"`
+	Station       string                       `json:"station"`
+	Directions    map[string]DirectionArrivals `json:"directions"`
+	Stale         bool                         `json:"stale"`
+	DataAvailable bool                         `json:"data_available"`
+	UpdatedAt     time.Time                    `json:"updated_at"`
+}
+
+type DirectionArrivals struct {
+	Label    string          `json:"label"`
+	Arrivals []feeds.Arrival `json:"arrivals"`
+}
+
+// LineArrivalsResponse is a line's board: every station it serves, in
+// stations.csv order (which follows the route), with that line's arrivals.
+type LineArrivalsResponse struct {
+	Line          string        `json:"line"`
+	Stations      []LineStation `json:"stations"`
+	Stale         bool          `json:"stale"`
+	DataAvailable bool          `json:"data_available"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+}
+
+type LineStation struct {
+	StopID     string                       `json:"stop_id"`
+	Station    string                       `json:"station"`
+	Directions map[string]DirectionArrivals `json:"directions"`
+}
+
+// TripResponse lists one trip's upcoming stops in order.
+type TripResponse struct {
+	TripID string          `json:"trip_id"`
+	Line   string          `json:"line"`
+	Stops  []feeds.Arrival `json:"stops"`
+}
+
+type FrequencyResponse struct {
+	Line    string                 `json:"line"`
+	StopID  string                 `json:"stop_id,omitempty"`
+	Bucket  string                 `json:"bucket"`
+	Buckets []feeds.FrequencyCount `json:"buckets"`
+}
+
+type HealthDetail struct {
+	Status        string    `json:"status"`
+	Uptime        string    `json:"uptime"`
+	CachedStops   int       `json:"cached_stops"`
+	TotalArrivals int       `json:"total_arrivals"`
+	Clients       int       `json:"sse_clients"`
+	LastUpdate    time.Time `json:"last_update"`
+}
+
+type StatsResponse struct {
+	Uptime        string                      `json:"uptime"`
+	Feeds         map[string]feeds.FetchStats `json:"feeds"`
+	CachedStops   int                         `json:"cached_stops"`
+	TotalArrivals int                         `json:"total_arrivals"`
+	Hub           HubStats                    `json:"hub"`
+}
+
+// NewServer builds the public server and, when server.admin_port is set, a
+// second server hosting health, stats and admin routes; otherwise those
+// share the public mux and the second return is nil.
+func NewServer(cfg *config.Config, hub *SSEHub, stationDB *stations.Holder, static *stations.StaticGTFS, cache *feeds.ArrivalCache, fetcher *feeds.FeedFetcher) (*http.Server, *http.Server) {
+	started := time.Now()
 	mux := http.NewServeMux()
+	ops := mux
+	if cfg.Server.AdminPort != 0 {
+		ops = http.NewServeMux()
+	}
 
-	mux.HandleFunc("/stream", hub.HandleStream)
+	// Whether the feeds behind these stops (all feeds when empty) are
+	// currently delivering
+	dataAvailable := func(stopIDs map[string]bool) bool {
+		var covering []string
+		if len(stopIDs) > 0 {
+			covering = stationDB.Load().GetFeedsForStops(sortedStops(stopIDs))
+			if len(covering) == 0 {
+				return false
+			}
+		}
+		return fetcher.FeedsHealthy(covering)
+	}
 
-	mux.HandleFunc("/arrivals", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+	handleGET(mux, "/stream", hub.HandleStream)
+
+	responses := newResponseCache(cfg.Server.ResponseCacheTTL)
+
+	handleGET(mux, "/arrivals", func(w http.ResponseWriter, r *http.Request) {
+		stopIDs := parseStops(r.URL.Query().Get("stops"))
+		if tooManyStops(w, r, len(stopIDs), cfg.Server.MaxStops) {
+			return
+		}
+		format := arrivalsFormat(r)
+
+		unknown := stationDB.Load().UnknownStops(stopIDs)
+		if len(unknown) > 0 && r.URL.Query().Get("strict") == "true" {
+			writeProblem(w, r, Problem{
+				Status:       http.StatusBadRequest,
+				Detail:       "unknown stops: " + strings.Join(unknown, ","),
+				UnknownStops: unknown,
+			})
+			return
+		}
+
+		// Parameters are checked before the ETag, so a bad request gets its
+		// 400 rather than a 304 or a cached body
+		filters, err := parseArrivalFilters(r.URL.Query(), cfg.Polling.ArrivalsPerDirection, cfg.Server.MaxPerDirection)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit, err := parseLimit(r.URL.Query().Get("limit"), cfg.Server.MaxArrivals)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		sortParam := r.URL.Query().Get("sort")
+		if err := sortArrivals(nil, sortParam); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// The payload only changes when the cache does, so polling clients
+		// can skip the body with If-None-Match.
+		stale := cache.IsStaleFor(stopIDs)
+		available := dataAvailable(stopIDs)
+		updatedAt := cache.UpdatedAt()
+		etag := arrivalsETag(updatedAt, stationDB.Generation(), stopIDs, r.URL.Query(), format, stale, available)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Vary", "Accept")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if resp, ok := responses.get(etag); ok {
+			w.Header().Set("Content-Type", resp.contentType)
+			w.Header().Set("X-Cache", "hit")
+			w.Write(resp.body)
+			return
+		}
 
-		stopsParam := r.URL.Query().Get("stops")
 		var arrivals []feeds.Arrival
+		if len(stopIDs) > 0 {
+			arrivals = cache.GetForStops(stopIDs)
+		} else {
+			arrivals = cache.GetAll()
+		}
+
+		// Per-direction trimming comes first, then the overall cap keeps
+		// the soonest of what's left
+		arrivals = filters.apply(arrivals, cfg.Server.Lookahead, cfg.Server.MinPerDirection)
+		if limit > 0 && len(arrivals) > limit {
+			arrivals = arrivals[:limit]
+		}
+		sortArrivals(arrivals, sortParam)
+
+		// Rendered into a buffer so the response cache can keep the body
+		var body bytes.Buffer
+		var contentType string
+		switch format {
+		case "csv":
+			contentType = "text/csv; charset=utf-8"
+			writeArrivalsCSV(&body, arrivals)
+		case "text":
+			contentType = "text/plain; charset=utf-8"
+			writeArrivalsText(&body, arrivals)
+		default:
+			if arrivals == nil {
+				arrivals = []feeds.Arrival{}
+			}
+			contentType = "application/json"
+			json.NewEncoder(&body).Encode(ArrivalsResponse{
+				Arrivals:      arrivals,
+				Stale:         stale,
+				DataAvailable: available,
+				UnknownStops:  unknown,
+				UpdatedAt:     updatedAt,
+			})
+		}
+		responses.put(etag, contentType, body.Bytes())
+
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body.Bytes())
+	})
+
+	// Answers several queries from one cache snapshot, in request order
+	handlePOST(mux, "/arrivals/batch", func(w http.ResponseWriter, r *http.Request) {
+		var queries []BatchQuery
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&queries); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid batch body: "+err.Error())
+			return
+		}
+		if len(queries) > maxBatchQueries {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("batch has %d queries, max is %d", len(queries), maxBatchQueries))
+			return
+		}
 
-		if stopsParam != "" {
-			stopIDs := make(map[string]bool)
-			for _, s := range strings.Split(stopsParam, ",") {
-				s = strings.TrimSpace(s)
-				if s != "" {
-					stopIDs[s] = true
+		db := stationDB.Load()
+		updatedAt := cache.UpdatedAt()
+		snap := cache.Snapshot()
+		results := make([]ArrivalsResponse, len(queries))
+		for i, q := range queries {
+			stopIDs := parseStops(strings.Join(q.Stops, ","))
+			if tooManyStops(w, r, len(stopIDs), cfg.Server.MaxStops) {
+				return
+			}
+			if q.Limit < 0 {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("query %d: invalid limit %d", i, q.Limit))
+				return
+			}
+
+			var arrivals []feeds.Arrival
+			if len(stopIDs) > 0 {
+				arrivals = snap.ForStops(stopIDs)
+			} else {
+				arrivals = snap.All()
+			}
+			filters := arrivalFilters{
+				direction:    strings.ToUpper(q.Direction),
+				minMinutes:   -1,
+				perDirection: cfg.Polling.ArrivalsPerDirection,
+			}
+			if len(q.Lines) > 0 {
+				filters.lines = make(map[string]bool, len(q.Lines))
+				for _, l := range q.Lines {
+					filters.lines[strings.ToUpper(strings.TrimSpace(l))] = true
 				}
 			}
+			arrivals = filters.apply(arrivals, cfg.Server.Lookahead, cfg.Server.MinPerDirection)
+
+			limit := cfg.Server.MaxArrivals
+			if q.Limit > 0 && (limit == 0 || q.Limit < limit) {
+				limit = q.Limit
+			}
+			if limit > 0 && len(arrivals) > limit {
+				arrivals = arrivals[:limit]
+			}
+			if arrivals == nil {
+				arrivals = []feeds.Arrival{}
+			}
+
+			results[i] = ArrivalsResponse{
+				Arrivals:      arrivals,
+				Stale:         cache.IsStaleFor(stopIDs),
+				DataAvailable: dataAvailable(stopIDs),
+				UnknownStops:  db.UnknownStops(stopIDs),
+				UpdatedAt:     updatedAt,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// Stations as GeoJSON points carrying their next arrivals; every station
+	// when stops is empty
+	handleGET(mux, "/arrivals/geojson", func(w http.ResponseWriter, r *http.Request) {
+		stopIDs := parseStops(r.URL.Query().Get("stops"))
+		if tooManyStops(w, r, len(stopIDs), cfg.Server.MaxStops) {
+			return
+		}
+
+		db := stationDB.Load()
+		var list []stations.StationInfo
+		if len(stopIDs) > 0 {
+			for _, id := range sortedStops(stopIDs) {
+				if s, ok := db.GetStation(id); ok {
+					list = append(list, s)
+				}
+			}
+		} else {
+			list = db.GetAllStations()
+		}
+
+		snap := cache.Snapshot()
+		fc := newFeatureCollection()
+		seen := make(map[string]bool, len(list))
+		for _, s := range list {
+			if seen[s.StopID] {
+				continue
+			}
+			seen[s.StopID] = true
+			f, ok := stationFeature(s)
+			if !ok {
+				continue
+			}
+			arrivals := trimPerDirection(snap.ForStops(map[string]bool{s.StopID: true}), cfg.Polling.ArrivalsPerDirection)
+			fc.Features = append(fc.Features, annotateArrivals(f, arrivals))
+		}
+
+		w.Header().Set("Content-Type", "application/geo+json")
+		json.NewEncoder(w).Encode(fc)
+	})
+
+	handleGET(mux, "/arrivals/count", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		within := -1
+		if v := r.URL.Query().Get("within"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				writeError(w, r, http.StatusBadRequest, "invalid within duration")
+				return
+			}
+			within = int(d.Minutes())
+		}
+
+		stopIDs := parseStops(r.URL.Query().Get("stops"))
+		if tooManyStops(w, r, len(stopIDs), cfg.Server.MaxStops) {
+			return
+		}
+		filters, err := parseArrivalFilters(r.URL.Query(), cfg.Polling.ArrivalsPerDirection, cfg.Server.MaxPerDirection)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		var arrivals []feeds.Arrival
+		if len(stopIDs) > 0 {
+			arrivals = cache.GetForStops(stopIDs)
+		} else {
+			arrivals = cache.GetAll()
+		}
+		// Counted after the same filtering /arrivals lists, so the counts
+		// match it for the same query (before its overall limit)
+		arrivals = filters.apply(arrivals, cfg.Server.Lookahead, cfg.Server.MinPerDirection)
+
+		// stop ID -> direction code -> count
+		counts := make(map[string]map[string]int)
+		for stopID := range stopIDs {
+			counts[stopID] = map[string]int{}
+		}
+		for _, a := range arrivals {
+			if within >= 0 && a.Minutes > within {
+				continue
+			}
+			if counts[a.StopID] == nil {
+				counts[a.StopID] = map[string]int{}
+			}
+			counts[a.StopID][a.DirectionCode]++
+		}
+
+		json.NewEncoder(w).Encode(counts)
+	})
+
+	handleGET(mux, "/arrivals/stop/{id}", func(w http.ResponseWriter, r *http.Request) {
+		station, ok := stationDB.Load().GetStation(r.PathValue("id"))
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "unknown stop")
+			return
+		}
+
+		updatedAt := cache.UpdatedAt()
+		arrivals := cache.GetForStops(map[string]bool{station.StopID: true})
+		arrivals = trimPerDirection(arrivals, cfg.Polling.ArrivalsPerDirection)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(StopArrivalsResponse{
+			StopID:        station.StopID,
+			Station:       station.Name,
+			Directions:    byDirection(station, arrivals),
+			Stale:         cache.IsStaleFor(map[string]bool{station.StopID: true}),
+			DataAvailable: dataAvailable(map[string]bool{station.StopID: true}),
+			UpdatedAt:     updatedAt,
+		})
+	})
+
+	handleGET(mux, "/arrivals/poll", func(w http.ResponseWriter, r *http.Request) {
+		stopIDs := parseStops(r.URL.Query().Get("stops"))
+		if tooManyStops(w, r, len(stopIDs), cfg.Server.MaxStops) {
+			return
+		}
+		wait := defaultPollWait
+		if v := r.URL.Query().Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				writeError(w, r, http.StatusBadRequest, "invalid wait duration")
+				return
+			}
+			wait = min(d, maxPollWait)
+		}
+
+		// Blocks until the next cache update or the wait runs out; either
+		// way the client gets the current arrivals and polls again
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-hub.Updated():
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+
+		var arrivals []feeds.Arrival
+		updatedAt := cache.UpdatedAt()
+		if len(stopIDs) > 0 {
 			arrivals = cache.GetForStops(stopIDs)
 		} else {
 			arrivals = cache.GetAll()
 		}
+		arrivals = trimPerDirection(arrivals, cfg.Polling.ArrivalsPerDirection)
+		if arrivals == nil {
+			arrivals = []feeds.Arrival{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ArrivalsResponse{
+			Arrivals:      arrivals,
+			Stale:         cache.IsStaleFor(stopIDs),
+			DataAvailable: dataAvailable(stopIDs),
+			UpdatedAt:     updatedAt,
+		})
+	})
 
+	handleGET(mux, "/arrivals/bbox", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var bounds [4]float64
+		for i, name := range []string{"minLat", "minLon", "maxLat", "maxLon"} {
+			v, err := strconv.ParseFloat(q.Get(name), 64)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid "+name)
+				return
+			}
+			bounds[i] = v
+		}
+		if bounds[0] > bounds[2] || bounds[1] > bounds[3] {
+			writeError(w, r, http.StatusBadRequest, "min bounds must not exceed max bounds")
+			return
+		}
+
+		stopIDs := stationDB.Load().StopsInBox(bounds[0], bounds[1], bounds[2], bounds[3])
+		if len(stopIDs) > maxBBoxStations {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("box covers %d stations, max is %d", len(stopIDs), maxBBoxStations))
+			return
+		}
+
+		updatedAt := cache.UpdatedAt()
+		arrivals := cache.GetForStops(stopIDs)
+		arrivals = trimPerDirection(arrivals, cfg.Polling.ArrivalsPerDirection)
 		if arrivals == nil {
 			arrivals = []feeds.Arrival{}
 		}
 
+		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(ArrivalsResponse{
-			Arrivals: arrivals,
-			Stale:    cache.IsStale(),
+			Arrivals:      arrivals,
+			Stale:         cache.IsStaleFor(stopIDs),
+			DataAvailable: dataAvailable(stopIDs),
+			UpdatedAt:     updatedAt,
 		})
 	})
 
-	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+	handleGET(mux, "/arrivals/history", func(w http.ResponseWriter, r *http.Request) {
+		if !cache.HistoryEnabled() {
+			writeError(w, r, http.StatusNotFound, "arrivals history is not enabled")
+			return
+		}
+		stopID := stations.NormalizeStopID(r.URL.Query().Get("stop"))
+		if stopID == "" {
+			writeError(w, r, http.StatusBadRequest, "stop is required")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cache.History(stopID))
+	})
+
+	handleGET(mux, "/trips/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		stops, ok := cache.GetTrip(id)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "unknown trip")
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(db.GetAllStations())
+		json.NewEncoder(w).Encode(TripResponse{
+			TripID: id,
+			Line:   stops[0].Line,
+			Stops:  stops,
+		})
 	})
 
-	mux.HandleFunc("/stations/search", func(w http.ResponseWriter, r *http.Request) {
+	handleGET(mux, "/analytics/frequency", func(w http.ResponseWriter, r *http.Request) {
+		max := cache.FrequencyWindow()
+		if max == 0 {
+			writeError(w, r, http.StatusNotFound, "frequency analytics are not enabled")
+			return
+		}
+		line := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("line")))
+		if line == "" {
+			writeError(w, r, http.StatusBadRequest, "line is required")
+			return
+		}
+		window := max
+		if v := r.URL.Query().Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				writeError(w, r, http.StatusBadRequest, "invalid window duration")
+				return
+			}
+			window = min(d, max)
+		}
+		stopID := stations.NormalizeStopID(r.URL.Query().Get("stop"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(FrequencyResponse{
+			Line:    line,
+			StopID:  stopID,
+			Bucket:  feeds.FrequencyBucket.String(),
+			Buckets: cache.Frequency(line, stopID, window),
+		})
+	})
+
+	handleGET(mux, "/stations", func(w http.ResponseWriter, r *http.Request) {
+		all := stationDB.Load().GetAllStations()
+		if r.URL.Query().Get("format") == "geojson" {
+			fc := newFeatureCollection()
+			for _, s := range all {
+				if f, ok := stationFeature(s); ok {
+					fc.Features = append(fc.Features, f)
+				}
+			}
+			w.Header().Set("Content-Type", "application/geo+json")
+			json.NewEncoder(w).Encode(fc)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(all)
+	})
+
+	handleGET(mux, "/stations/search", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
 		if q == "" {
 			json.NewEncoder(w).Encode([]stations.StationInfo{})
 			return
 		}
-		json.NewEncoder(w).Encode(db.Search(q))
+		json.NewEncoder(w).Encode(stationDB.Load().Search(q))
 	})
 
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`{"status":"ok"}`))
+	handleGET(mux, "/stations/{id}/transfers", func(w http.ResponseWriter, r *http.Request) {
+		db := stationDB.Load()
+		id := r.PathValue("id")
+		if _, ok := db.GetStation(id); !ok {
+			writeError(w, r, http.StatusNotFound, "unknown station")
+			return
+		}
+		transfers := db.GetTransfers(id)
+		if transfers == nil {
+			transfers = []stations.Transfer{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(transfers)
 	})
 
-	return &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: withCORS(mux),
+	handleGET(mux, "/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		stopIDs := parseStops(r.URL.Query().Get("stops"))
+		if len(stopIDs) == 0 {
+			writeError(w, r, http.StatusBadRequest, "stops is required")
+			return
+		}
+		if tooManyStops(w, r, len(stopIDs), cfg.Server.MaxStops) {
+			return
+		}
+
+		db := stationDB.Load()
+		resp := SnapshotResponse{
+			Stations:     []stations.StationInfo{},
+			Alerts:       []json.RawMessage{},
+			Stale:        cache.IsStaleFor(stopIDs),
+			UnknownStops: db.UnknownStops(stopIDs),
+			UpdatedAt:    cache.UpdatedAt(),
+		}
+		for _, id := range sortedStops(stopIDs) {
+			if s, ok := db.GetStation(id); ok {
+				resp.Stations = append(resp.Stations, s)
+			}
+		}
+		resp.Arrivals = trimPerDirection(cache.GetForStops(stopIDs), cfg.Polling.ArrivalsPerDirection)
+		if resp.Arrivals == nil {
+			resp.Arrivals = []feeds.Arrival{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	handleGET(mux, "/lines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(static.Lines())
+	})
+
+	handleGET(mux, "/lines/{line}/arrivals", func(w http.ResponseWriter, r *http.Request) {
+		line := strings.ToUpper(strings.TrimSpace(r.PathValue("line")))
+		db := stationDB.Load()
+		stopIDs := db.GetStopsForLines([]string{line})
+		if len(stopIDs) == 0 {
+			writeError(w, r, http.StatusNotFound, "unknown line")
+			return
+		}
+
+		updatedAt := cache.UpdatedAt()
+		snap := cache.Snapshot()
+		resp := LineArrivalsResponse{
+			Line:      line,
+			Stations:  make([]LineStation, 0, len(stopIDs)),
+			UpdatedAt: updatedAt,
+		}
+		wanted := map[string]bool{line: true}
+		served := make(map[string]bool, len(stopIDs))
+		for _, id := range stopIDs {
+			if served[id] {
+				continue
+			}
+			served[id] = true
+			station, _ := db.GetStation(id)
+
+			arrivals := onlyLines(snap.ForStops(map[string]bool{id: true}), wanted)
+			arrivals = trimPerDirection(arrivals, cfg.Polling.ArrivalsPerDirection)
+			resp.Stations = append(resp.Stations, LineStation{
+				StopID:     id,
+				Station:    station.Name,
+				Directions: byDirection(station, arrivals),
+			})
+		}
+		resp.Stale = cache.IsStaleFor(served)
+		resp.DataAvailable = dataAvailable(served)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	handleGET(ops, "/feeds/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fetcher.Status())
+	})
+
+	handleGET(ops, "/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		reset := r.URL.Query().Get("reset") == "true"
+		hubStats := hub.Stats()
+		if reset {
+			hubStats = hub.ResetStats()
+		}
+
+		stops, total := cache.Size()
+		json.NewEncoder(w).Encode(StatsResponse{
+			Uptime:        time.Since(started).Round(time.Second).String(),
+			Feeds:         fetcher.FetchStats(reset),
+			CachedStops:   stops,
+			TotalArrivals: total,
+			Hub:           hubStats,
+		})
+	})
+
+	arrivalsSchema := jsonSchema(reflect.TypeOf(ArrivalsResponse{}))
+	arrivalsSchema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	arrivalsSchema["title"] = "ArrivalsResponse"
+	handleGET(mux, "/schema/arrivals", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/schema+json")
+		json.NewEncoder(w).Encode(arrivalsSchema)
+	})
+
+	handleGET(mux, "/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	})
+
+	if cfg.Server.Admin.Enabled && cfg.Server.Admin.Token != "" {
+		handlePOST(ops, "/admin/refresh", func(w http.ResponseWriter, r *http.Request) {
+			res, err := fetcher.Refresh(r.Context())
+			if err != nil {
+				writeError(w, r, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(res)
+		})
+
+		setFeedEnabled := func(enabled bool) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if err := fetcher.SetEnabled(r.PathValue("name"), enabled); err != nil {
+					writeError(w, r, http.StatusNotFound, err.Error())
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+		handlePOST(ops, "/admin/feeds/{name}/enable", setFeedEnabled(true))
+		handlePOST(ops, "/admin/feeds/{name}/disable", setFeedEnabled(false))
+	}
+
+	if cfg.Server.Pprof {
+		handleGET(ops, "/debug/pprof/", pprof.Index)
+		handleGET(ops, "/debug/pprof/cmdline", pprof.Cmdline)
+		handleGET(ops, "/debug/pprof/profile", pprof.Profile)
+		handleGET(ops, "/debug/pprof/symbol", pprof.Symbol)
+		handleGET(ops, "/debug/pprof/trace", pprof.Trace)
+	}
+
+	handleGET(ops, "/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("verbose") != "true" {
+			w.Write([]byte(`{"status":"ok"}`))
+			return
+		}
+
+		stops, total := cache.Size()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(HealthDetail{
+			Status:        "ok",
+			Uptime:        time.Since(started).Round(time.Second).String(),
+			CachedStops:   stops,
+			TotalArrivals: total,
+			Clients:       hub.ClientCount(),
+			LastUpdate:    cache.UpdatedAt(),
+		})
+	})
+
+	public := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler: withRequestID(withCORS(withAdminAuth(cfg.Server.Admin, withReadyGate(cfg.Server, fetcher.Ready(), mux)))),
+	}
+	if ops == mux {
+		return public, nil
+	}
+	return public, &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Server.AdminPort),
+		Handler: withRequestID(withAdminAuth(cfg.Server.Admin, ops)),
+	}
+}
+
+// byDirection groups one station's arrivals by direction code. North and
+// south are always present so clients can render both columns; east/west
+// only show up when a feed uses them.
+func byDirection(station stations.StationInfo, arrivals []feeds.Arrival) map[string]DirectionArrivals {
+	directions := map[string]DirectionArrivals{
+		"N": {Label: station.NorthLabel, Arrivals: []feeds.Arrival{}},
+		"S": {Label: station.SouthLabel, Arrivals: []feeds.Arrival{}},
+	}
+	for _, a := range arrivals {
+		d, ok := directions[a.DirectionCode]
+		if !ok {
+			d = DirectionArrivals{Label: a.Direction, Arrivals: []feeds.Arrival{}}
+		}
+		d.Arrivals = append(d.Arrivals, a)
+		directions[a.DirectionCode] = d
+	}
+	return directions
+}
+
+// parseStops splits a comma-separated stops query value into a set.
+func parseStops(param string) map[string]bool {
+	stopIDs := make(map[string]bool)
+	for _, s := range strings.Split(param, ",") {
+		s = stations.NormalizeStopID(s)
+		if s != "" {
+			stopIDs[s] = true
+		}
+	}
+	return stopIDs
+}
+
+// tooManyStops answers 400 when a request names more than max stops (0 or
+// less is unlimited), bounding what one request or subscription can cost.
+func tooManyStops(w http.ResponseWriter, r *http.Request, n, max int) bool {
+	if max > 0 && n > max {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("%d stops requested, max is %d", n, max))
+		return true
+	}
+	return false
+}
+
+func sortedStops(stopIDs map[string]bool) []string {
+	ids := make([]string, 0, len(stopIDs))
+	for id := range stopIDs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// arrivalsETag also keys the response cache. It covers everything a body
+// depends on: cache contents, station data (names, unknown stops), stops,
+// filters, format, staleness and data_available, which a feed toggle or
+// the frozen-feed check can flip without a cache update.
+func arrivalsETag(updatedAt time.Time, stationGen uint64, stopIDs map[string]bool, query url.Values, format string, stale, available bool) string {
+	ids := sortedStops(stopIDs)
+
+	// Other query params filter the payload, so they're part of the key too
+	filters := url.Values{}
+	for k, v := range query {
+		if k != "stops" {
+			filters[k] = v
+		}
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|%d|%s|%s|%s|%t|%t", updatedAt.UnixNano(), stationGen, strings.Join(ids, ","), filters.Encode(), format, stale, available)
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// withAdminAuth requires "Authorization: Bearer <token>" on the configured
+// admin paths. With no token configured those paths are always refused.
+func withAdminAuth(cfg config.AdminConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Browsers send preflights without credentials; the OPTIONS
+		// handlers only describe the route
+		if r.Method == http.MethodOptions || !isAdminPath(cfg.Paths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || cfg.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withReadyGate answers data endpoints with 503 until ready closes or the
+// configured timeout passes, whichever is first. Health, docs and admin
+// routes are always served.
+func withReadyGate(cfg config.ServerConfig, ready <-chan struct{}, next http.Handler) http.Handler {
+	if !cfg.ReadyGate {
+		return next
+	}
+
+	open := make(chan struct{})
+	go func() {
+		select {
+		case <-ready:
+		case <-time.After(cfg.ReadyTimeout):
+			fmt.Printf("Ready gate timed out after %s; serving without initial data\n", cfg.ReadyTimeout)
+		}
+		close(open)
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-open:
+		default:
+			// Preflights carry no data, so they aren't held back
+			if r.Method != http.MethodOptions && isGatedPath(r.URL.Path) {
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusServiceUnavailable, "waiting for initial feed data")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isGatedPath(path string) bool {
+	for _, p := range []string{"/arrivals", "/stream", "/snapshot", "/trips/", "/lines/"} {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func isAdminPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGET registers a GET route and answers OPTIONS on the same path, so
+// preflights and 405s both carry Allow: GET, HEAD, OPTIONS. The lists are
+// in the mux's own (sorted) order so the two always agree.
+func handleGET(mux *http.ServeMux, path string, h func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc("GET "+path, h)
+	mux.HandleFunc("OPTIONS "+path, allowOptions("GET, HEAD, OPTIONS"))
+}
+
+// handlePOST is handleGET for POST-only routes.
+func handlePOST(mux *http.ServeMux, path string, h func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc("POST "+path, h)
+	mux.HandleFunc("OPTIONS "+path, allowOptions("OPTIONS, POST"))
+}
+
+func allowOptions(allow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusOK)
 	}
 }
 
 func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, ETag, X-Cache")
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+		// Methods are left to the mux: its patterns carry the method, so a
+		// mismatch is a 405 with the route's own Allow header, preflights
+		// reach the route's OPTIONS handler, and HEAD and unknown paths
+		// behave as usual
 
 		next.ServeHTTP(w, r)
 	})
@@ -0,0 +1,926 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"feed/internal/feeds"
+	"feed/internal/stations"
+)
+
+func TestArrivalsETagNotModified(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	fillCache(e.cache, 4)
+
+	first := e.get("/arrivals?stops=L08")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first poll: status %d, ETag %q", first.Code, etag)
+	}
+
+	req := httptest.NewRequest("GET", "/arrivals?stops=L08", nil)
+	req.Header.Set("If-None-Match", etag)
+	if rec := e.do(req); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("unchanged poll: status %d, %d body bytes; want 304 and no body", rec.Code, rec.Body.Len())
+	}
+
+	// A cache update changes the tag even when the stop set doesn't
+	fillCache(e.cache, 4)
+	req = httptest.NewRequest("GET", "/arrivals?stops=L08", nil)
+	req.Header.Set("If-None-Match", etag)
+	if rec := e.do(req); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("after update: status %d, ETag %q; want 200 and a new tag", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestArrivalsETagTracksDataAvailable(t *testing.T) {
+	fixtures := serveFixtures(t)
+	e := newTestEnv(t, `
+server:
+  response_cache_ttl: 1m
+feeds:
+  L: `+fixtures.URL+`/l_trip_updates.pb
+`)
+	e.fetcher.FetchOnce(context.Background())
+
+	first := e.get("/arrivals?stops=L08")
+	etag := first.Header().Get("ETag")
+	var resp ArrivalsResponse
+	if err := json.Unmarshal(first.Body.Bytes(), &resp); err != nil || !resp.DataAvailable {
+		t.Fatalf("first poll: data_available %t, %v", resp.DataAvailable, err)
+	}
+
+	// Disabling the feed leaves the cache as it was, but not the answer
+	if err := e.fetcher.SetEnabled("L", false); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/arrivals?stops=L08", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec := e.do(req)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag || rec.Header().Get("X-Cache") != "" {
+		t.Fatalf("after disabling: status %d, ETag %q, X-Cache %q; want a fresh 200", rec.Code, rec.Header().Get("ETag"), rec.Header().Get("X-Cache"))
+	}
+	resp = ArrivalsResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.DataAvailable {
+		t.Errorf("after disabling: data_available %t, %v", resp.DataAvailable, err)
+	}
+
+	// Re-enabling brings the first tag back
+	e.fetcher.SetEnabled("L", true)
+	req = httptest.NewRequest("GET", "/arrivals?stops=L08", nil)
+	req.Header.Set("If-None-Match", etag)
+	if rec := e.do(req); rec.Code != http.StatusNotModified {
+		t.Errorf("after re-enabling: status %d, want 304", rec.Code)
+	}
+}
+
+func TestArrivalsValidatesBeforeETag(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	fillCache(e.cache, 4)
+
+	for _, query := range []string{"min_minutes=-1", "per_direction=abc", "limit=-5", "sort=bogus"} {
+		req := httptest.NewRequest("GET", "/arrivals?stops=L08&"+query, nil)
+		// The tag this exact request would carry if it were valid
+		etag := arrivalsETag(e.cache.UpdatedAt(), e.stationDB.Generation(), map[string]bool{"L08": true}, req.URL.Query(), "json", false, false)
+		req.Header.Set("If-None-Match", etag)
+		if rec := e.do(req); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	e := newTestEnv(t, `
+server:
+  admin:
+    enabled: true
+    token: secret
+`)
+	fillCache(e.cache, 2)
+
+	routes := []struct {
+		method, path, allow string
+	}{
+		{"POST", "/stream", "GET, HEAD, OPTIONS"},
+		{"POST", "/arrivals", "GET, HEAD, OPTIONS"},
+		{"DELETE", "/arrivals", "GET, HEAD, OPTIONS"},
+		{"GET", "/arrivals/batch", "OPTIONS, POST"},
+		{"PUT", "/arrivals/geojson", "GET, HEAD, OPTIONS"},
+		{"POST", "/arrivals/count", "GET, HEAD, OPTIONS"},
+		{"POST", "/arrivals/stop/L08", "GET, HEAD, OPTIONS"},
+		{"POST", "/arrivals/poll", "GET, HEAD, OPTIONS"},
+		{"POST", "/arrivals/bbox", "GET, HEAD, OPTIONS"},
+		{"POST", "/arrivals/history", "GET, HEAD, OPTIONS"},
+		{"POST", "/trips/L-1", "GET, HEAD, OPTIONS"},
+		{"POST", "/analytics/frequency", "GET, HEAD, OPTIONS"},
+		{"POST", "/stations", "GET, HEAD, OPTIONS"},
+		{"POST", "/stations/search", "GET, HEAD, OPTIONS"},
+		{"POST", "/stations/L08/transfers", "GET, HEAD, OPTIONS"},
+		{"POST", "/snapshot", "GET, HEAD, OPTIONS"},
+		{"POST", "/lines", "GET, HEAD, OPTIONS"},
+		{"POST", "/lines/L/arrivals", "GET, HEAD, OPTIONS"},
+		{"POST", "/feeds/status", "GET, HEAD, OPTIONS"},
+		{"POST", "/stats", "GET, HEAD, OPTIONS"},
+		{"POST", "/schema/arrivals", "GET, HEAD, OPTIONS"},
+		{"POST", "/openapi.json", "GET, HEAD, OPTIONS"},
+		{"POST", "/health", "GET, HEAD, OPTIONS"},
+		{"GET", "/admin/refresh", "OPTIONS, POST"},
+		{"GET", "/admin/feeds/L/enable", "OPTIONS, POST"},
+		{"GET", "/admin/feeds/L/disable", "OPTIONS, POST"},
+	}
+	for _, rt := range routes {
+		req := httptest.NewRequest(rt.method, rt.path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := e.do(req)
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: status %d, want 405", rt.method, rt.path, rec.Code)
+			continue
+		}
+		if got := rec.Header().Get("Allow"); got != rt.allow {
+			t.Errorf("%s %s: Allow %q, want %q", rt.method, rt.path, got, rt.allow)
+		}
+
+		// Preflights are answered with the same list, without credentials
+		rec = e.do(httptest.NewRequest("OPTIONS", rt.path, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Allow") != rt.allow {
+			t.Errorf("OPTIONS %s: status %d, Allow %q; want 200 and %q", rt.path, rec.Code, rec.Header().Get("Allow"), rt.allow)
+		}
+	}
+
+	// HEAD follows GET, unknown paths are 404s
+	if rec := e.do(httptest.NewRequest("HEAD", "/arrivals?stops=L08", nil)); rec.Code != http.StatusOK {
+		t.Errorf("HEAD /arrivals: status %d, want 200", rec.Code)
+	}
+	if rec := e.do(httptest.NewRequest("POST", "/nope", nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("POST /nope: status %d, want 404", rec.Code)
+	}
+}
+
+func TestLinesUseStaticRoutes(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	static, err := stations.LoadStaticGTFS("../stations/testdata/gtfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := NewServer(e.cfg, e.hub, e.stationDB, static, e.cache, e.fetcher)
+
+	rec := httptest.NewRecorder()
+	public.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/lines", nil))
+	var lines []stations.LineInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &lines); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range lines {
+		if l.Line == "L" && l.Name != "14 St-Canarsie Local" {
+			t.Errorf("L name = %q, want the routes.txt long name", l.Name)
+		}
+	}
+}
+
+func TestPprofOnlyWhenEnabled(t *testing.T) {
+	authed := func(h http.Handler, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	const admin = `
+  admin:
+    enabled: true
+    token: secret
+`
+
+	off := newTestEnv(t, "server:"+admin)
+	if code := authed(off.public.Handler, "/debug/pprof/"); code != http.StatusNotFound {
+		t.Errorf("pprof off: status %d, want 404", code)
+	}
+
+	on := newTestEnv(t, "server:\n  pprof: true"+admin)
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/symbol"} {
+		if code := authed(on.public.Handler, path); code != http.StatusOK {
+			t.Errorf("pprof on: %s status %d, want 200", path, code)
+		}
+	}
+	// The default admin paths cover /debug/, so the token is required
+	if rec := on.get("/debug/pprof/"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("pprof on, no token: status %d, want 401", rec.Code)
+	}
+
+	// With an admin listener they move there, off the public port
+	split := newTestEnv(t, "server:\n  pprof: true\n  port: 8080\n  admin_port: 8081"+admin)
+	if code := authed(split.public.Handler, "/debug/pprof/"); code != http.StatusNotFound {
+		t.Errorf("admin_port set: public pprof status %d, want 404", code)
+	}
+	if code := authed(split.admin.Handler, "/debug/pprof/"); code != http.StatusOK {
+		t.Errorf("admin_port set: admin pprof status %d, want 200", code)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	const yaml = `
+server:
+  admin:
+    enabled: true
+    token: s3cret
+feeds:
+  L: http://127.0.0.1:1/l
+`
+	send := func(e *testEnv, method, path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return e.do(req)
+	}
+
+	e := newTestEnv(t, yaml)
+	tests := []struct {
+		name, method, path, auth string
+		want                     int
+	}{
+		{"no header", "POST", "/admin/feeds/L/disable", "", http.StatusUnauthorized},
+		{"wrong token", "POST", "/admin/feeds/L/disable", "Bearer nope", http.StatusUnauthorized},
+		{"token prefix", "POST", "/admin/feeds/L/disable", "Bearer s3cre", http.StatusUnauthorized},
+		{"basic scheme", "POST", "/admin/feeds/L/disable", "Basic s3cret", http.StatusUnauthorized},
+		{"authorized", "POST", "/admin/feeds/L/disable", "Bearer s3cret", http.StatusNoContent},
+		{"authorized, unknown feed", "POST", "/admin/feeds/Q/enable", "Bearer s3cret", http.StatusNotFound},
+		{"debug path", "GET", "/debug/vars", "", http.StatusUnauthorized},
+		{"public data", "GET", "/arrivals?stops=L08", "", http.StatusOK},
+		{"public health", "GET", "/health", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := send(e, tt.method, tt.path, tt.auth)
+			if rec.Code != tt.want {
+				t.Fatalf("%s %s: status %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("401 without WWW-Authenticate: Bearer")
+			}
+		})
+	}
+
+	t.Run("ADMIN_TOKEN overrides config", func(t *testing.T) {
+		t.Setenv("ADMIN_TOKEN", "from-env")
+		e := newTestEnv(t, yaml)
+		if rec := send(e, "POST", "/admin/feeds/L/disable", "Bearer s3cret"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("config token: status %d, want 401", rec.Code)
+		}
+		if rec := send(e, "POST", "/admin/feeds/L/disable", "Bearer from-env"); rec.Code != http.StatusNoContent {
+			t.Errorf("env token: status %d, want 204", rec.Code)
+		}
+	})
+
+	t.Run("no token configured", func(t *testing.T) {
+		e := newTestEnv(t, "server:\n  admin:\n    enabled: true\n")
+		if rec := send(e, "POST", "/admin/refresh", "Bearer "); rec.Code != http.StatusUnauthorized {
+			t.Errorf("empty token: status %d, want 401", rec.Code)
+		}
+	})
+}
+
+func TestStationTransfers(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	if err := e.stationDB.Load().LoadTransfers("../stations/testdata/gtfs/transfers.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := e.get("/stations/127/transfers")
+	var transfers []stations.Transfer
+	if err := json.Unmarshal(rec.Body.Bytes(), &transfers); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if len(transfers) != 3 || transfers[0].ToStopID != "725" || transfers[0].MinTransferTime != 180 {
+		t.Errorf("/stations/127/transfers = %+v", transfers)
+	}
+
+	if rec := e.get("/stations/L08/transfers"); rec.Code != http.StatusOK || rec.Body.String() != "[]\n" {
+		t.Errorf("station without transfers: %d %q, want 200 []", rec.Code, rec.Body)
+	}
+	if rec := e.get("/stations/ZZ9/transfers"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown station: status %d, want 404", rec.Code)
+	}
+}
+
+func TestLongPollUnblocksOnUpdate(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{"L08": {{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 5, TripID: "old"}}})
+
+	start := time.Now()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- e.get("/arrivals/poll?stops=L08&wait=20s") }()
+
+	// Let the request start waiting, then land a fetch cycle
+	time.Sleep(50 * time.Millisecond)
+	e.cache.Update(map[string][]feeds.Arrival{"L08": {{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 4, TripID: "new"}}})
+	e.notifier.Notify()
+
+	select {
+	case rec := <-done:
+		var resp ArrivalsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("status %d: %v", rec.Code, err)
+		}
+		if ids := tripIDs(resp.Arrivals); len(ids) != 1 || ids[0] != "new" {
+			t.Errorf("poll returned %v, want the updated arrivals", ids)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("poll took %s, want it to return on the update", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll still blocked after an update")
+	}
+}
+
+func TestLongPollWaitElapses(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{"L08": {{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 5, TripID: "t1"}}})
+
+	start := time.Now()
+	resp := arrivalsFor(t, e, "/arrivals/poll?stops=L08&wait=100ms")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("returned after %s, before the wait ran out", elapsed)
+	}
+	if ids := tripIDs(resp.Arrivals); len(ids) != 1 {
+		t.Errorf("no update, but the current arrivals were not returned: %v", ids)
+	}
+
+	for _, bad := range []string{"soon", "-1s"} {
+		if rec := e.get("/arrivals/poll?stops=L08&wait=" + bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("wait=%s: status %d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+func TestLongPollClientGone(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/arrivals/poll?stops=L08&wait=20s", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		e.do(req)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("poll kept waiting after the client went away")
+	}
+}
+
+func TestStopArrivalsByDirection(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  arrivals_per_direction: 2\n")
+	arrival := func(dir string, minutes int, trip string) feeds.Arrival {
+		return feeds.Arrival{StopID: "L08", Line: "L", DirectionCode: dir, Minutes: minutes, TripID: trip}
+	}
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {
+			arrival("N", 1, "n1"), arrival("S", 2, "s1"), arrival("N", 4, "n2"),
+			arrival("S", 6, "s2"), arrival("N", 8, "n3"), arrival("S", 9, "s3"),
+		},
+		"L06": {{StopID: "L06", Line: "L", DirectionCode: "N", Minutes: 0, TripID: "elsewhere"}},
+	})
+
+	rec := e.get("/arrivals/stop/L08")
+	var resp StopArrivalsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if resp.StopID != "L08" || resp.Station != "Bedford Av" {
+		t.Errorf("stop %q station %q", resp.StopID, resp.Station)
+	}
+	want := map[string]DirectionArrivals{
+		"N": {Label: "Manhattan", Arrivals: []feeds.Arrival{arrival("N", 1, "n1"), arrival("N", 4, "n2")}},
+		"S": {Label: "Canarsie - Rockaway Parkway", Arrivals: []feeds.Arrival{arrival("S", 2, "s1"), arrival("S", 6, "s2")}},
+	}
+	for code, w := range want {
+		got := resp.Directions[code]
+		if got.Label != w.Label || !slices.Equal(tripIDs(got.Arrivals), tripIDs(w.Arrivals)) {
+			t.Errorf("direction %s = %q %v, want %q %v", code, got.Label, tripIDs(got.Arrivals), w.Label, tripIDs(w.Arrivals))
+		}
+	}
+	if len(resp.Directions) != 2 {
+		t.Errorf("directions %v, want just N and S", resp.Directions)
+	}
+
+	// Both columns are present even with nothing to show
+	rec = e.get("/arrivals/stop/G29")
+	if !strings.Contains(rec.Body.String(), `"N":{"label":"Queens","arrivals":[]}`) {
+		t.Errorf("empty station: %s", rec.Body)
+	}
+	if rec := e.get("/arrivals/stop/ZZ9"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown stop: status %d, want 404", rec.Code)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 3, TripID: "l1"}},
+		"127": {{StopID: "127", Line: "1", DirectionCode: "S", Minutes: 1, TripID: "one"}},
+		"L06": {{StopID: "L06", Line: "L", DirectionCode: "N", Minutes: 0, TripID: "elsewhere"}},
+	})
+
+	rec := e.get("/snapshot?stops=L08,127,ZZ9")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"stations", "arrivals", "alerts", "stale", "unknown_stops", "updated_at"} {
+		if _, ok := raw[key]; !ok {
+			t.Errorf("snapshot has no %q: %s", key, rec.Body)
+		}
+	}
+	if string(raw["alerts"]) != "[]" {
+		t.Errorf("alerts = %s, want []", raw["alerts"])
+	}
+
+	var resp SnapshotResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range resp.Stations {
+		names = append(names, s.StopID+" "+s.Name)
+	}
+	if want := []string{"127 Times Sq-42 St", "L08 Bedford Av"}; !slices.Equal(names, want) {
+		t.Errorf("stations = %q, want %q", names, want)
+	}
+	got := tripIDs(resp.Arrivals)
+	slices.Sort(got)
+	if want := []string{"l1", "one"}; !slices.Equal(got, want) {
+		t.Errorf("arrivals = %v, want %v", got, want)
+	}
+	if !slices.Equal(resp.UnknownStops, []string{"ZZ9"}) {
+		t.Errorf("unknown_stops = %v, want [ZZ9]", resp.UnknownStops)
+	}
+	if resp.Stale || !resp.UpdatedAt.Equal(e.cache.UpdatedAt()) {
+		t.Errorf("stale=%t updated_at=%v, want fresh at %v", resp.Stale, resp.UpdatedAt, e.cache.UpdatedAt())
+	}
+
+	if rec := e.get("/snapshot"); rec.Code != http.StatusBadRequest {
+		t.Errorf("without stops: status %d, want 400", rec.Code)
+	}
+}
+
+func TestTripTimeline(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	now := time.Now()
+	call := func(stop string, m int) feeds.Arrival {
+		return feeds.Arrival{StopID: stop, Line: "L", Minutes: m, TripID: "L-1", ArrivalTime: now.Add(time.Duration(m) * time.Minute).Unix()}
+	}
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {call("L08", 7)},
+		"L03": {call("L03", 2)},
+		"L06": {call("L06", 5)},
+	})
+
+	rec := e.get("/trips/L-1")
+	var resp TripResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	var order []string
+	for _, a := range resp.Stops {
+		order = append(order, a.StopID)
+	}
+	if resp.TripID != "L-1" || resp.Line != "L" || !slices.Equal(order, []string{"L03", "L06", "L08"}) {
+		t.Errorf("trip %q line %q stops %v", resp.TripID, resp.Line, order)
+	}
+	if rec := e.get("/trips/L-9"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown trip: status %d, want 404", rec.Code)
+	}
+}
+
+func TestReadyGate(t *testing.T) {
+	release := make(chan struct{})
+	fixtures := serveFixtures(t)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.Redirect(w, r, fixtures.URL+"/l_trip_updates.pb", http.StatusFound)
+	}))
+	defer slow.Close()
+	e := newTestEnv(t, "server:\n  ready_gate: true\n  ready_timeout: 1m\nfeeds:\n  L: "+slow.URL+"\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.fetcher.Start(ctx)
+
+	for _, path := range []string{"/arrivals?stops=L08", "/arrivals/stop/L08", "/snapshot?stops=L08", "/stream?stops=L08"} {
+		rec := e.get(path)
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s before the first fetch: status %d, Retry-After %q", path, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+	for _, path := range []string{"/health", "/stations", "/openapi.json"} {
+		if rec := e.get(path); rec.Code != http.StatusOK {
+			t.Errorf("%s behind the gate: status %d, want 200", path, rec.Code)
+		}
+	}
+	if rec := e.do(httptest.NewRequest("OPTIONS", "/arrivals", nil)); rec.Code != http.StatusOK {
+		t.Errorf("preflight behind the gate: status %d, want 200", rec.Code)
+	}
+
+	close(release)
+	select {
+	case <-e.fetcher.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("first fetch did not finish")
+	}
+	// The gate opens just after Ready
+	deadline := time.Now().Add(time.Second)
+	for e.get("/arrivals?stops=L08").Code == http.StatusServiceUnavailable && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rec := e.get("/arrivals?stops=L08"); rec.Code != http.StatusOK {
+		t.Errorf("after the first fetch: status %d, want 200", rec.Code)
+	}
+}
+
+func TestReadyGateTimeout(t *testing.T) {
+	e := newTestEnv(t, "server:\n  ready_gate: true\n  ready_timeout: 50ms\n")
+	if rec := e.get("/arrivals?stops=L08"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("before the timeout: status %d, want 503", rec.Code)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if rec := e.get("/arrivals?stops=L08"); rec.Code != http.StatusOK {
+		t.Errorf("after the timeout, with no fetch: status %d, want 200", rec.Code)
+	}
+}
+
+func TestReadyGateOff(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	if rec := e.get("/arrivals?stops=L08"); rec.Code != http.StatusOK {
+		t.Errorf("gate off, no fetch yet: status %d, want 200", rec.Code)
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	e := newTestEnv(t, `
+server:
+  port: 8080
+  admin_port: 8081
+  admin:
+    enabled: true
+    token: s3cret
+`)
+	if e.admin == nil {
+		t.Fatal("no admin server with admin_port set")
+	}
+	if e.public.Addr != ":8080" || e.admin.Addr != ":8081" {
+		t.Errorf("addrs %q and %q, want :8080 and :8081", e.public.Addr, e.admin.Addr)
+	}
+
+	// Serve both for real, as main does, on free ports
+	serve := func(srv *http.Server) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(ln)
+		return "http://" + ln.Addr().String()
+	}
+	public, admin := serve(e.public), serve(e.admin)
+
+	send := func(method, url string) int {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	tests := []struct {
+		method, base, path string
+		want               int
+	}{
+		{"GET", public, "/arrivals?stops=L08", http.StatusOK},
+		{"GET", public, "/stations", http.StatusOK},
+		{"GET", public, "/openapi.json", http.StatusOK},
+		{"GET", public, "/health", http.StatusNotFound},
+		{"GET", public, "/stats", http.StatusNotFound},
+		{"GET", public, "/feeds/status", http.StatusNotFound},
+		{"POST", public, "/admin/refresh", http.StatusNotFound},
+
+		{"GET", admin, "/health", http.StatusOK},
+		{"GET", admin, "/stats", http.StatusOK},
+		{"GET", admin, "/feeds/status", http.StatusOK},
+		{"POST", admin, "/admin/feeds/L/disable", http.StatusNotFound}, // no feed L configured
+		{"GET", admin, "/arrivals?stops=L08", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := send(tt.method, tt.base+tt.path); got != tt.want {
+			t.Errorf("%s %s%s: status %d, want %d", tt.method, tt.base, tt.path, got, tt.want)
+		}
+	}
+
+	// Both shut down cleanly
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range []*http.Server{e.public, e.admin} {
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown %s: %v", srv.Addr, err)
+		}
+	}
+	if _, err := http.Get(public + "/stations"); err == nil {
+		t.Error("public listener still accepting after shutdown")
+	}
+}
+
+func TestNoAdminListenerByDefault(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	if e.admin != nil {
+		t.Fatal("admin server built without admin_port")
+	}
+	for _, path := range []string{"/health", "/stats", "/feeds/status", "/arrivals?stops=L08"} {
+		if rec := e.get(path); rec.Code != http.StatusOK {
+			t.Errorf("%s on the single listener: status %d, want 200", path, rec.Code)
+		}
+	}
+}
+
+func TestUpdatedAtAdvances(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	paths := []string{"/arrivals?stops=L08", "/arrivals/stop/L08", "/lines/L/arrivals", "/snapshot?stops=L08"}
+	updatedAt := func(path string) time.Time {
+		t.Helper()
+		rec := e.get(path)
+		var resp struct {
+			UpdatedAt *time.Time `json:"updated_at"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.UpdatedAt == nil {
+			t.Fatalf("%s: status %d, no updated_at (%v): %s", path, rec.Code, err, rec.Body)
+		}
+		return *resp.UpdatedAt
+	}
+
+	for _, path := range paths {
+		if got := updatedAt(path); !got.IsZero() {
+			t.Errorf("%s before any update: %v, want zero", path, got)
+		}
+	}
+
+	arrivals := map[string][]feeds.Arrival{"L08": {{StopID: "L08", Line: "L", DirectionCode: "N", Minutes: 2, TripID: "t1"}}}
+	before := time.Now()
+	e.cache.Update(arrivals)
+	first := map[string]time.Time{}
+	for _, path := range paths {
+		got := updatedAt(path)
+		if got.Before(before) || time.Since(got) > time.Minute {
+			t.Errorf("%s: updated_at %v, want just after %v", path, got, before)
+		}
+		first[path] = got
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	e.cache.Update(arrivals)
+	for _, path := range paths {
+		if got := updatedAt(path); !got.After(first[path]) {
+			t.Errorf("%s: updated_at %v didn't advance past %v", path, got, first[path])
+		}
+	}
+}
+
+func TestArrivalsBatch(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  arrivals_per_direction: 10\n")
+	arrival := func(stop, line, dir string, minutes int) feeds.Arrival {
+		return feeds.Arrival{StopID: stop, Line: line, DirectionCode: dir, Minutes: minutes, TripID: fmt.Sprintf("%s-%s%s%d", stop, line, dir, minutes)}
+	}
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {arrival("L08", "L", "N", 1), arrival("L08", "L", "S", 3), arrival("L08", "L", "S", 7)},
+		"L06": {arrival("L06", "L", "N", 2)},
+		"127": {arrival("127", "1", "N", 4), arrival("127", "2", "S", 5), arrival("127", "2", "N", 6)},
+	})
+
+	body := `[
+		{"stops": ["L08"], "direction": "s"},
+		{"stops": ["127"], "lines": ["2"]},
+		{"stops": ["L08", "L06"], "limit": 2},
+		{"stops": ["ZZ9"]},
+		{}
+	]`
+	rec := e.do(httptest.NewRequest("POST", "/arrivals/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var results []ArrivalsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	// One result per spec, in request order
+	want := [][]string{
+		{"L08-LS3", "L08-LS7"},
+		{"127-2S5", "127-2N6"},
+		{"L08-LN1", "L06-LN2"},
+		{},
+		{"L08-LN1", "L06-LN2", "L08-LS3", "127-1N4", "127-2S5", "127-2N6", "L08-LS7"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("%d results for %d queries", len(results), len(want))
+	}
+	for i, w := range want {
+		if got := tripIDs(results[i].Arrivals); !slices.Equal(got, w) {
+			t.Errorf("query %d: %v, want %v", i, got, w)
+		}
+	}
+	if !slices.Equal(results[3].UnknownStops, []string{"ZZ9"}) || results[3].Arrivals == nil {
+		t.Errorf("unknown stop query: %+v", results[3])
+	}
+
+	many := "[" + strings.Repeat(`{"stops":["L08"]},`, 20) + `{"stops":["L08"]}]`
+	for name, bad := range map[string]string{
+		"not JSON":       `{"stops":`,
+		"not an array":   `{"stops":["L08"]}`,
+		"negative limit": `[{"stops":["L08"],"limit":-1}]`,
+		"21 queries":     many,
+	} {
+		if rec := e.do(httptest.NewRequest("POST", "/arrivals/batch", strings.NewReader(bad))); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, rec.Code)
+		}
+	}
+}
+
+func TestEmptyResultsAreLists(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  history_size: 10\n  frequency_window: 1h\n")
+
+	// next_minutes is a scalar, null when nothing is due
+	nullField := regexp.MustCompile(`"(\w+)":null`)
+	check := func(path string, rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", path, rec.Code, rec.Body)
+			return
+		}
+		body := strings.TrimSpace(rec.Body.String())
+		if body == "null" {
+			t.Errorf("%s = null", path)
+		}
+		for _, m := range nullField.FindAllStringSubmatch(body, -1) {
+			if m[1] != "next_minutes" {
+				t.Errorf("%s: %s is null: %s", path, m[1], body)
+			}
+		}
+	}
+
+	for _, path := range []string{
+		"/arrivals?stops=L08",
+		"/arrivals",
+		"/arrivals/stop/L08",
+		"/arrivals/poll?stops=L08&wait=0s",
+		"/arrivals/bbox?minLat=40.71&minLon=-73.96&maxLat=40.72&maxLon=-73.95",
+		"/arrivals/geojson?stops=L08",
+		"/arrivals/count?stops=L08",
+		"/arrivals/history?stop=L08",
+		"/analytics/frequency?line=L&stop=L08",
+		"/stations/search?q=zzzz",
+		"/stations/L08/transfers",
+		"/snapshot?stops=L08",
+		"/lines/L/arrivals",
+	} {
+		check(path, e.get(path))
+	}
+	check("/arrivals/batch", e.do(httptest.NewRequest("POST", "/arrivals/batch", strings.NewReader(`[{"stops": ["L08"]}, {}]`))))
+
+	if frame := firstFrame(t, e, "stops=L08"); len(frame) != 2 || frame[1] != "data: []" {
+		t.Errorf("/stream first frame = %q, want an empty list", frame)
+	}
+
+	// A station with no lines lists them as [] rather than null
+	db, err := stations.LoadStationDB("../stations/testdata/messy_stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = newTestEnvDB(t, "{}", db)
+	for _, path := range []string{"/stations", "/stations/search?q=court", "/snapshot?stops=G22"} {
+		rec := e.get(path)
+		check(path, rec)
+		if !strings.Contains(rec.Body.String(), `"lines":[]`) {
+			t.Errorf("%s: G22 lines not []: %s", path, rec.Body)
+		}
+	}
+}
+
+func TestLineBoard(t *testing.T) {
+	e := newTestEnv(t, "polling:\n  arrivals_per_direction: 10\n")
+	arrival := func(stop, line, dir string, minutes int) feeds.Arrival {
+		return feeds.Arrival{StopID: stop, Line: line, DirectionCode: dir, Minutes: minutes, TripID: fmt.Sprintf("%s-%s%s%d", stop, line, dir, minutes)}
+	}
+	e.cache.Update(map[string][]feeds.Arrival{
+		"L08": {arrival("L08", "L", "N", 1), arrival("L08", "L", "S", 3), arrival("L08", "L", "S", 7)},
+		"L06": {arrival("L06", "L", "N", 2)},
+		// Another line's train at an L stop stays off the board
+		"L03": {arrival("L03", "M", "N", 4), arrival("L03", "L", "S", 5)},
+		"127": {arrival("127", "1", "N", 4)},
+	})
+
+	rec := e.get("/lines/l/arrivals")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp LineArrivalsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Line != "L" {
+		t.Errorf("line %q, want L", resp.Line)
+	}
+
+	// Every L station once, in route order
+	var stops []string
+	for _, s := range resp.Stations {
+		stops = append(stops, s.StopID)
+	}
+	if !slices.Equal(stops, lStops) {
+		t.Fatalf("stations %v\nwant %v", stops, lStops)
+	}
+
+	board := make(map[string]LineStation, len(resp.Stations))
+	for _, s := range resp.Stations {
+		board[s.StopID] = s
+	}
+	want := map[string]map[string][]string{
+		"L08": {"N": {"L08-LN1"}, "S": {"L08-LS3", "L08-LS7"}},
+		"L06": {"N": {"L06-LN2"}, "S": nil},
+		"L03": {"N": nil, "S": {"L03-LS5"}},
+		"L01": {"N": nil, "S": nil},
+	}
+	for stop, dirs := range want {
+		s := board[stop]
+		if s.Station == "" {
+			t.Errorf("%s: no station name", stop)
+		}
+		if len(s.Directions) != len(dirs) {
+			t.Errorf("%s: directions %v", stop, s.Directions)
+		}
+		for dir, trips := range dirs {
+			if got := tripIDs(s.Directions[dir].Arrivals); !slices.Equal(got, trips) {
+				t.Errorf("%s %s: trips %v, want %v", stop, dir, got, trips)
+			}
+		}
+	}
+	if label := board["L08"].Directions["N"].Label; label != "Manhattan" {
+		t.Errorf("L08 north label %q", label)
+	}
+
+	if rec := e.get("/lines/9/arrivals"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown line: status %d", rec.Code)
+	}
+}
+
+func TestTooManyStops(t *testing.T) {
+	e := newTestEnv(t, "server:\n  max_stops: 3\n  stream_all: true\n")
+	fillCache(e.cache, 2)
+
+	over := "L01,L02,L03,L05"
+	for _, path := range []string{
+		"/arrivals?stops=" + over,
+		"/arrivals/geojson?stops=" + over,
+		"/arrivals/poll?wait=0s&stops=" + over,
+		"/snapshot?stops=" + over,
+		"/stream?stops=L01&stops=L02&stops=L03&stops=L05",
+		// ?lines= counts the stops it expands to
+		"/stream?lines=L",
+	} {
+		rec := e.get(path)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "max is 3") {
+			t.Errorf("%s: status %d: %s", path, rec.Code, rec.Body)
+		}
+	}
+	body := `[{"stops": ["L01"]}, {"stops": ["L01", "L02", "L03", "L05"]}]`
+	if rec := e.do(httptest.NewRequest("POST", "/arrivals/batch", strings.NewReader(body))); rec.Code != http.StatusBadRequest {
+		t.Errorf("batch: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// Duplicates collapse before counting, and the limit itself is fine
+	if resp := arrivalsFor(t, e, "/arrivals?stops=L01,L02,L03,l03"); len(resp.Arrivals) != 6 {
+		t.Errorf("3 stops: %d arrivals, want 6", len(resp.Arrivals))
+	}
+	if frame := firstFrame(t, e, "stops=L01&stops=L02&stops=L03"); len(frame) != 2 {
+		t.Errorf("3-stop stream first frame = %q", frame)
+	}
+	// ?all=true has its own cap instead
+	if frame := firstFrame(t, e, "all=true"); len(frame) != 2 {
+		t.Errorf("all-stops stream first frame = %q", frame)
+	}
+
+	if got := newTestEnv(t, "{}").cfg.Server.MaxStops; got != 200 {
+		t.Errorf("default max_stops = %d, want 200", got)
+	}
+}
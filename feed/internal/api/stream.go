@@ -3,68 +3,191 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"feed/internal/feeds"
+	"feed/internal/stations"
 )
 
 type Client struct {
 	stops map[string]bool
+	key   string // canonical stop set, shared by clients with identical subscriptions
+	all   bool   // firehose: every cached arrival, ignoring stops
 	send  chan []byte
 }
 
 type SSEHub struct {
 	cache     *feeds.ArrivalCache
+	stationDB *stations.Holder
 	clients   map[*Client]struct{}
 	mu        sync.RWMutex
-	broadcast chan struct{}
+	notifier  *feeds.Notifier
+	opts      HubOptions
+
+	sent    atomic.Int64
+	dropped atomic.Int64
+}
+
+type HubStats struct {
+	Clients int   `json:"clients"`
+	Sent    int64 `json:"messages_sent"`
+	Dropped int64 `json:"messages_dropped"`
+}
+
+type HubOptions struct {
+	// Minimum gap between pushes to one client; updates arriving sooner are
+	// coalesced and only the latest is sent. Zero pushes every update.
+	MinPushInterval time.Duration
+	// Interval between keepalive comments on idle connections
+	Keepalive time.Duration
+	// Reject subscriptions naming unknown stops with a 400 instead of
+	// sending a warning event
+	StrictStops bool
+	// Allow ?all=true subscriptions to the whole cache, capped at MaxAll
+	// arrivals per frame (0 or less is uncapped)
+	AllowAll bool
+	MaxAll   int
+	// Most stops one subscription may cover, after expanding ?lines=;
+	// 0 or less is unlimited
+	MaxStops int
 }
 
-func NewSSEHub(cache *feeds.ArrivalCache, broadcast chan struct{}) *SSEHub {
+func NewSSEHub(cache *feeds.ArrivalCache, stationDB *stations.Holder, notifier *feeds.Notifier, opts HubOptions) *SSEHub {
+	if opts.Keepalive <= 0 {
+		opts.Keepalive = 15 * time.Second
+	}
 	return &SSEHub{
 		cache:     cache,
+		stationDB: stationDB,
 		clients:   make(map[*Client]struct{}),
-		broadcast: broadcast,
+		notifier:  notifier,
+		opts:      opts,
 	}
 }
 
+// Updated returns a channel that is closed on the next cache update.
+func (h *SSEHub) Updated() <-chan struct{} {
+	return h.notifier.Next()
+}
+
 func (h *SSEHub) Run() {
-	for range h.broadcast {
-		h.mu.RLock()
-		for client := range h.clients {
-			// Check if we have data for this client
-			// Optimization: Only build JSON once if stops match?
-			// Since every client has different stops, we probably need per-client logic
-
-			arrivals := h.cache.GetForStops(client.stops)
-			data, err := json.Marshal(arrivals)
+	updates, cancel := h.notifier.Subscribe()
+	defer cancel()
+
+	for range updates {
+		h.broadcast()
+	}
+}
+
+// broadcast pushes the current cache to every client. It reads the cache
+// once, and marshals once per distinct stop set however many clients
+// share it.
+func (h *SSEHub) broadcast() {
+	snap := h.cache.Snapshot()
+	payloads := make(map[string][]byte)
+
+	// Copy the client list so marshaling doesn't hold up register and
+	// unregister
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		data, ok := payloads[client.key]
+		if !ok {
+			arrivals := snap.ForStops(client.stops)
+			if client.all {
+				arrivals = h.capAll(snap.All())
+			}
+			var err error
+			data, err = json.Marshal(arrivals)
 			if err != nil {
 				continue
 			}
+			payloads[client.key] = data
+		}
 
-			select {
-			case client.send <- data:
-			default:
-				// Skip if blocked
-			}
+		select {
+		case client.send <- data:
+			h.sent.Add(1)
+		default:
+			// Skip if blocked
+			h.dropped.Add(1)
 		}
-		h.mu.RUnlock()
 	}
 }
 
 func (h *SSEHub) HandleStream(w http.ResponseWriter, r *http.Request) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+	if _, ok := w.(http.Flusher); !ok {
+		writeError(w, r, http.StatusInternalServerError, "Streaming unsupported!")
 		return
 	}
+	// Unlike Flusher, the controller reports write failures, so a client
+	// that has gone away is dropped on the next frame rather than when its
+	// context is eventually cancelled
+	rc := http.NewResponseController(w)
+	send := func(event string, data []byte) error {
+		if err := writeEvent(w, event, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
 
 	stopsParam := r.URL.Query()["stops"]
 	stops := make(map[string]bool)
 	for _, s := range stopsParam {
-		stops[s] = true
+		if s = stations.NormalizeStopID(s); s != "" {
+			stops[s] = true
+		}
+	}
+
+	// ?lines=L,G subscribes to every stop those lines serve, in addition
+	// to any explicit stops
+	var lines []string
+	for _, param := range r.URL.Query()["lines"] {
+		for _, l := range strings.Split(param, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+	}
+	all := r.URL.Query().Get("all") == "true"
+	if all && !h.opts.AllowAll {
+		writeError(w, r, http.StatusForbidden, "all-stops streaming is disabled")
+		return
+	}
+
+	db := h.stationDB.Load()
+	if len(lines) > 0 {
+		for _, s := range db.GetStopsForLines(lines) {
+			stops[s] = true
+		}
+	}
+
+	if !all && tooManyStops(w, r, len(stops), h.opts.MaxStops) {
+		return
+	}
+
+	unknown := db.UnknownStops(stops)
+	if len(unknown) > 0 && h.opts.StrictStops {
+		writeError(w, r, http.StatusBadRequest, "unknown stops: "+strings.Join(unknown, ","))
+		return
+	}
+
+	// Frames are named so EventSource clients can addEventListener per
+	// kind; ?legacy=true keeps the old unnamed "message" events.
+	event := eventArrivals
+	if r.URL.Query().Get("legacy") == "true" {
+		event = ""
 	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -74,21 +197,54 @@ func (h *SSEHub) HandleStream(w http.ResponseWriter, r *http.Request) {
 
 	client := &Client{
 		stops: stops,
+		key:   stopSetKey(stops),
+		all:   all,
 		send:  make(chan []byte, 10),
 	}
+	if all {
+		client.key = allStopsKey
+	}
 
 	h.register(client)
 	defer h.unregister(client)
 
-	// Initial send
-	initialArrivals := h.cache.GetForStops(stops)
-	if initialData, err := json.Marshal(initialArrivals); err == nil {
-		fmt.Fprintf(w, "data: %s\n\n", initialData)
-		flusher.Flush()
+	// Let the client know up front that part of its subscription will
+	// never match anything
+	if len(unknown) > 0 {
+		if warning, err := json.Marshal(map[string][]string{"unknown_stops": unknown}); err == nil {
+			if send(eventWarning, warning) != nil {
+				return
+			}
+		}
+	}
+
+	// Initial send; ?initial=false skips it for reconnecting clients that
+	// still hold recent state, so the first frame is the next update
+	var lastPush time.Time
+	if r.URL.Query().Get("initial") != "false" {
+		initialArrivals := h.cache.GetForStops(stops)
+		if all {
+			initialArrivals = h.capAll(h.cache.GetAll())
+		}
+		if initialData, err := json.Marshal(initialArrivals); err == nil {
+			if writeEvent(w, event, initialData) != nil {
+				return
+			}
+		}
+		lastPush = time.Now()
+	}
+	// Also gets the headers out when nothing has been written yet
+	if rc.Flush() != nil {
+		return
 	}
 
+	var (
+		pending []byte
+		flush   <-chan time.Time
+	)
+
 	// KeepAlive ticker to prevent timeout
-	ticker := time.NewTicker(15 * time.Second)
+	ticker := time.NewTicker(h.opts.Keepalive)
 	defer ticker.Stop()
 
 	for {
@@ -96,13 +252,91 @@ func (h *SSEHub) HandleStream(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			return
 		case data := <-client.send:
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
+			if wait := h.opts.MinPushInterval - time.Since(lastPush); wait > 0 {
+				if pending == nil {
+					flush = time.After(wait)
+				}
+				pending = data
+				continue
+			}
+			if send(event, data) != nil {
+				return
+			}
+			lastPush = time.Now()
+		case <-flush:
+			if send(event, pending) != nil {
+				return
+			}
+			lastPush = time.Now()
+			pending, flush = nil, nil
 		case <-ticker.C:
-			fmt.Fprintf(w, ": keepalive\n\n")
-			flusher.Flush()
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// SSE event names sent on /stream
+const (
+	eventArrivals = "arrivals"
+	eventWarning  = "warning"
+)
+
+func writeEvent(w io.Writer, event string, data []byte) error {
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
 		}
 	}
+	_, err := fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+// Payload key for ?all=true clients; can't collide with a stop list
+const allStopsKey = "*"
+
+// capAll keeps the soonest arrivals of a firehose frame.
+func (h *SSEHub) capAll(arrivals []feeds.Arrival) []feeds.Arrival {
+	if h.opts.MaxAll > 0 && len(arrivals) > h.opts.MaxAll {
+		return arrivals[:h.opts.MaxAll]
+	}
+	return arrivals
+}
+
+func stopSetKey(stops map[string]bool) string {
+	ids := make([]string, 0, len(stops))
+	for id := range stops {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func (h *SSEHub) ClientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+func (h *SSEHub) Stats() HubStats {
+	return HubStats{
+		Clients: h.ClientCount(),
+		Sent:    h.sent.Load(),
+		Dropped: h.dropped.Load(),
+	}
+}
+
+// ResetStats returns the current stats and zeroes the message counters.
+func (h *SSEHub) ResetStats() HubStats {
+	return HubStats{
+		Clients: h.ClientCount(),
+		Sent:    h.sent.Swap(0),
+		Dropped: h.dropped.Swap(0),
+	}
 }
 
 func (h *SSEHub) register(c *Client) {
@@ -115,5 +349,7 @@ func (h *SSEHub) unregister(c *Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	delete(h.clients, c)
-	close(c.send)
+	// c.send is deliberately left open: Run may still hold c from its copy
+	// of the client list, and a send on a closed channel would panic. The
+	// buffered channel is simply dropped with the client.
 }
@@ -0,0 +1,503 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"feed/internal/feeds"
+)
+
+var lStops = []string{"L01", "L02", "L03", "L05", "L06", "L08", "L10", "L11", "L12", "L13", "L14", "L15", "L16", "L17", "L19", "L20", "L21", "L22", "L24", "L25", "L26", "L27", "L28", "L29"}
+
+// fillCache gives every L stop perStop arrivals, alternating direction.
+func fillCache(cache *feeds.ArrivalCache, perStop int) {
+	update := make(map[string][]feeds.Arrival)
+	for _, stop := range lStops {
+		for i := 0; i < perStop; i++ {
+			update[stop] = append(update[stop], feeds.Arrival{
+				StopID:        stop,
+				Line:          "L",
+				DirectionCode: []string{"N", "S"}[i%2],
+				Minutes:       i * 3,
+				TripID:        fmt.Sprintf("%s-%d", stop, i),
+			})
+		}
+	}
+	cache.Update(update)
+}
+
+// addClients registers n clients over a window of overlapping stops; the
+// windows repeat every sets clients (at most 20), as for many dashboards
+// in a few areas.
+func addClients(h *SSEHub, n, sets int) []*Client {
+	clients := make([]*Client, n)
+	for i := range clients {
+		start := i % sets
+		stops := map[string]bool{}
+		for _, s := range lStops[start : start+5] {
+			stops[s] = true
+		}
+		clients[i] = &Client{stops: stops, key: stopSetKey(stops), send: make(chan []byte, 1)}
+		h.register(clients[i])
+	}
+	return clients
+}
+
+func drain(clients []*Client) {
+	for _, c := range clients {
+		select {
+		case <-c.send:
+		default:
+		}
+	}
+}
+
+func TestBroadcastSharesPayloadPerStopSet(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	fillCache(e.cache, 6)
+	clients := addClients(e.hub, 4, 2)
+
+	e.hub.broadcast()
+
+	frames := make([][]byte, len(clients))
+	for i, c := range clients {
+		select {
+		case frames[i] = <-c.send:
+		default:
+			t.Fatalf("client %d got no frame", i)
+		}
+	}
+	// Clients 0 and 2 share a stop set, so they share one marshaled frame
+	if &frames[0][0] != &frames[2][0] {
+		t.Error("identical subscriptions were marshaled separately")
+	}
+	if string(frames[0]) == string(frames[1]) {
+		t.Error("different subscriptions got the same frame")
+	}
+
+	var got []feeds.Arrival
+	if err := json.Unmarshal(frames[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	want := e.cache.GetForStops(clients[0].stops)
+	if len(got) != len(want) {
+		t.Errorf("frame has %d arrivals, GetForStops %d", len(got), len(want))
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) {
+			e := newTestEnv(b, "{}")
+			fillCache(e.cache, 20)
+			clients := addClients(e.hub, n, 10)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e.hub.broadcast()
+				drain(clients)
+			}
+		})
+	}
+}
+
+// BenchmarkBroadcastPerClient is the pre-snapshot baseline: a cache read
+// and a marshal for every client.
+func BenchmarkBroadcastPerClient(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) {
+			e := newTestEnv(b, "{}")
+			fillCache(e.cache, 20)
+			clients := addClients(e.hub, n, 10)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, c := range clients {
+					data, err := json.Marshal(e.cache.GetForStops(c.stops))
+					if err != nil {
+						b.Fatal(err)
+					}
+					c.send <- data
+				}
+				drain(clients)
+			}
+		})
+	}
+}
+
+// firstFrame opens /stream?query and returns the lines of its first frame.
+func firstFrame(t *testing.T, e *testEnv, query string) []string {
+	t.Helper()
+	srv := httptest.NewServer(e.public.Handler)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/stream?"+query, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/stream?%s: status %d", query, resp.StatusCode)
+	}
+
+	var lines []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if sc.Text() == "" {
+			return lines
+		}
+		lines = append(lines, sc.Text())
+	}
+	t.Fatalf("/stream?%s: stream ended before a frame: %v", query, sc.Err())
+	return nil
+}
+
+func TestStreamEventNames(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	fillCache(e.cache, 2)
+
+	frame := firstFrame(t, e, "stops=L08")
+	if len(frame) != 2 || frame[0] != "event: arrivals" || !strings.HasPrefix(frame[1], "data: [") {
+		t.Errorf("named frame = %q", frame)
+	}
+
+	frame = firstFrame(t, e, "stops=L08&legacy=true")
+	if len(frame) != 1 || !strings.HasPrefix(frame[0], "data: [") {
+		t.Errorf("legacy frame = %q, want an unnamed data line", frame)
+	}
+
+	frame = firstFrame(t, e, "stops=L08,XX9")
+	if len(frame) != 2 || frame[0] != "event: warning" || !strings.Contains(frame[1], "XX9") {
+		t.Errorf("warning frame = %q", frame)
+	}
+}
+
+func TestStreamAllStops(t *testing.T) {
+	off := newTestEnv(t, "{}")
+	if rec := off.get("/stream?all=true"); rec.Code != http.StatusForbidden {
+		t.Errorf("all=true while disabled: status %d, want 403", rec.Code)
+	}
+	if off.cfg.Server.StreamAllMax != 500 {
+		t.Errorf("default stream_all_max = %d, want 500", off.cfg.Server.StreamAllMax)
+	}
+
+	e := newTestEnv(t, `
+server:
+  stream_all: true
+  stream_all_max: 5
+`)
+	fillCache(e.cache, 4)
+
+	// The initial frame is the soonest five across every stop, ignoring
+	// any stops named alongside
+	frame := firstFrame(t, e, "all=true&stops=L08")
+	var initial []feeds.Arrival
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(frame[1], "data: ")), &initial); err != nil {
+		t.Fatal(err)
+	}
+	if len(initial) != 5 {
+		t.Fatalf("initial frame has %d arrivals, want 5", len(initial))
+	}
+	for _, a := range initial {
+		if a.Minutes != 0 {
+			t.Errorf("initial frame kept %+v over a sooner arrival", a)
+		}
+	}
+
+	// Broadcasts are capped the same way, and shared by all-stops clients
+	all := []*Client{
+		{all: true, key: allStopsKey, send: make(chan []byte, 1)},
+		{all: true, key: allStopsKey, send: make(chan []byte, 1)},
+	}
+	for _, c := range all {
+		e.hub.register(c)
+	}
+	e.hub.broadcast()
+	a, b := <-all[0].send, <-all[1].send
+	if &a[0] != &b[0] {
+		t.Error("all-stops clients were marshaled separately")
+	}
+	var pushed []feeds.Arrival
+	if err := json.Unmarshal(a, &pushed); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed) != 5 {
+		t.Errorf("broadcast frame has %d arrivals, want 5", len(pushed))
+	}
+}
+
+func TestHubConcurrentClientsAndStats(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	fillCache(e.cache, 2)
+
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				c := &Client{stops: map[string]bool{"L08": true}, key: "L08", send: make(chan []byte, 1)}
+				e.hub.register(c)
+				e.hub.Stats()
+				e.hub.unregister(c)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				e.hub.broadcast()
+				e.hub.ClientCount()
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+
+	before := e.hub.Stats()
+	if before.Clients != 0 {
+		t.Errorf("%d clients left after every one unregistered", before.Clients)
+	}
+
+	// One broadcast to three clients, one of which is full, counts as two
+	// sent and one dropped
+	clients := addClients(e.hub, 3, 1)
+	clients[2].send <- nil
+	e.hub.broadcast()
+	after := e.hub.Stats()
+	if after.Clients != 3 || after.Sent-before.Sent != 2 || after.Dropped-before.Dropped != 1 {
+		t.Errorf("stats went from %+v to %+v", before, after)
+	}
+}
+
+func TestStreamLineSubscription(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	fillCache(e.cache, 2)
+	e.cache.Update(map[string][]feeds.Arrival{
+		"A31": {{StopID: "A31", Line: "A", DirectionCode: "S", Minutes: 1, TripID: "a1"}},
+		"G29": {{StopID: "G29", Line: "G", DirectionCode: "N", Minutes: 1, TripID: "g1"}},
+	})
+
+	frame := firstFrame(t, e, "lines=L&stops=A31")
+	var got []feeds.Arrival
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(frame[1], "data: ")), &got); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, a := range got {
+		seen[a.StopID] = true
+	}
+	// Every L stop plus the explicit stop, and nothing from other lines
+	for _, s := range lStops {
+		if !seen[s] {
+			t.Errorf("lines=L frame is missing %s", s)
+		}
+	}
+	if !seen["A31"] {
+		t.Error("explicit stop A31 dropped when combined with lines=L")
+	}
+	if seen["G29"] {
+		t.Error("lines=L frame includes G29")
+	}
+	if len(seen) != len(lStops)+1 {
+		t.Errorf("frame covers %d stops, want %d", len(seen), len(lStops)+1)
+	}
+}
+
+// BenchmarkBroadcastLockHold times the section of a broadcast that holds
+// the hub lock, during which register and unregister wait. "copy" is what
+// broadcast does now; "locked" marshals every client under the lock, as
+// Run did before copying the client list.
+func BenchmarkBroadcastLockHold(b *testing.B) {
+	for _, mode := range []string{"copy", "locked"} {
+		b.Run(mode, func(b *testing.B) {
+			e := newTestEnv(b, "{}")
+			fillCache(e.cache, 20)
+			addClients(e.hub, 1000, 10)
+			snap := e.cache.Snapshot()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e.hub.mu.RLock()
+				if mode == "locked" {
+					for c := range e.hub.clients {
+						json.Marshal(snap.ForStops(c.stops))
+					}
+				} else {
+					clients := make([]*Client, 0, len(e.hub.clients))
+					for c := range e.hub.clients {
+						clients = append(clients, c)
+					}
+				}
+				e.hub.mu.RUnlock()
+			}
+		})
+	}
+}
+
+// brokenConn is a stream response whose connection drops on cue: writes
+// and flushes fail from then on, but the request context stays live, as
+// it can for a while when a mobile client vanishes.
+type brokenConn struct {
+	*httptest.ResponseRecorder
+	mu     sync.Mutex
+	broken bool
+}
+
+func (c *brokenConn) drop() {
+	c.mu.Lock()
+	c.broken = true
+	c.mu.Unlock()
+}
+
+func (c *brokenConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return 0, errors.New("connection reset by peer")
+	}
+	return c.ResponseRecorder.Write(p)
+}
+
+func (c *brokenConn) FlushError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return errors.New("connection reset by peer")
+	}
+	c.ResponseRecorder.Flush()
+	return nil
+}
+
+func (c *brokenConn) Flush() { c.FlushError() }
+
+func TestStreamDropsBrokenConnection(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	fillCache(e.cache, 2)
+
+	conn := &brokenConn{ResponseRecorder: httptest.NewRecorder()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.hub.HandleStream(conn, httptest.NewRequest("GET", "/stream?stops=L08", nil))
+	}()
+	for e.hub.ClientCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The next push fails, which ends the handler and unregisters the
+	// client without waiting for the context or a keepalive
+	conn.drop()
+	e.hub.broadcast()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still running after a failed write")
+	}
+	if n := e.hub.ClientCount(); n != 0 {
+		t.Errorf("%d clients still registered", n)
+	}
+}
+
+func TestStreamInitialFalse(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	fillCache(e.cache, 2)
+
+	// By default the first frame is the current arrivals
+	frame := firstFrame(t, e, "stops=L08")
+	var arrivals []feeds.Arrival
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(frame[1], "data: ")), &arrivals); err != nil || len(arrivals) != 2 {
+		t.Fatalf("default first frame = %q", frame)
+	}
+
+	srv := httptest.NewServer(e.public.Handler)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/stream?stops=L08&initial=false", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for e.hub.ClientCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Nothing until the next update, which is then the first frame
+	fillCache(e.cache, 3)
+	e.hub.broadcast()
+	sc := bufio.NewScanner(resp.Body)
+	var lines []string
+	for sc.Scan() && sc.Text() != "" {
+		lines = append(lines, sc.Text())
+	}
+	if len(lines) != 2 || lines[0] != "event: arrivals" {
+		t.Fatalf("first frame = %q", lines)
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &arrivals); err != nil {
+		t.Fatal(err)
+	}
+	if len(arrivals) != 3 {
+		t.Errorf("first frame has %d arrivals, want the update's 3", len(arrivals))
+	}
+}
+
+func TestStreamKeepaliveCadence(t *testing.T) {
+	e := newTestEnv(t, "server:\n  sse_keepalive: 100ms\n")
+	srv := httptest.NewServer(e.public.Handler)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 550*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/stream?stops=L08&initial=false", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+	var at []time.Duration
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if sc.Text() == ": keepalive" {
+			at = append(at, time.Since(start))
+		}
+	}
+
+	// Nothing else is sent, so the comments alone keep the connection up:
+	// about one per 100ms, never bunched together
+	if len(at) < 3 || len(at) > 6 {
+		t.Fatalf("%d keepalives in 550ms at 100ms, want about 5: %v", len(at), at)
+	}
+	for i := 1; i < len(at); i++ {
+		if gap := at[i] - at[i-1]; gap < 50*time.Millisecond {
+			t.Errorf("keepalives %d and %d only %s apart", i-1, i, gap)
+		}
+	}
+}
+
+func TestStreamKeepaliveDefault(t *testing.T) {
+	e := newTestEnv(t, "{}")
+	if got := e.hub.opts.Keepalive; got != 15*time.Second {
+		t.Errorf("default keepalive %s, want 15s", got)
+	}
+}
@@ -1,25 +1,256 @@
 package config
 
 import (
+    "bytes"
+    "fmt"
+    "io"
+    "net/url"
     "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
     "time"
 
+    "github.com/BurntSushi/toml"
     "gopkg.in/yaml.v3"
 )
 
 type Config struct {
-    Server  ServerConfig  `yaml:"server"`
-    Polling PollingConfig `yaml:"polling"`
-    Feeds   map[string]string `yaml:"feeds"`
+    Server  ServerConfig        `yaml:"server"`
+    Polling PollingConfig       `yaml:"polling"`
+    Feeds   map[string]FeedURLs `yaml:"feeds"`
+
+    // stop ID -> direction code ("N"/"S") -> label, overriding the CSV labels
+    DirectionOverrides map[string]map[string]string `yaml:"direction_overrides"`
+
+    // Directory with optional static GTFS files (routes.txt, trips.txt, transfers.txt)
+    GTFSStaticDir string `yaml:"gtfs_static_dir"`
+
+    // Optional CSV or JSON of local corrections merged onto
+    // data/stations.csv by stop ID
+    StationsOverrides string `yaml:"stations_overrides"`
+
+    // How arrivals get their direction: "suffix" (NYC stop IDs like L08N,
+    // the default), "trip" (trip descriptor direction) or "none"
+    DirectionStrategy string `yaml:"direction_strategy"`
+
+    // How a feed stop ID maps to a station key: "suffix" (strip N/S/E/W),
+    // "prefix:N" or "identity"; empty follows direction_strategy
+    StopKey string `yaml:"stop_key"`
+
+    // line -> feed name, replacing the built-in NYC mapping (for other
+    // agencies' feeds); feed names must match the feeds section
+    LineFeeds map[string]string `yaml:"line_feeds"`
+
+    // Search score added per line beyond the first at a station's complex,
+    // so hubs lead ambiguous queries; 0 uses the default, negative disables
+    SearchLineWeight float64 `yaml:"search_line_weight"`
+
+    // Start with an empty station DB when data/stations.csv is missing,
+    // e.g. to exercise the API without station data
+    AllowMissingStations bool `yaml:"allow_missing_stations"`
+
+    Status StatusConfig `yaml:"status"`
+
+    // IANA zone used for human-facing clock times
+    Timezone string         `yaml:"timezone"`
+    Location *time.Location `yaml:"-"`
+}
+
+// FeedURLs is a feed's primary URL followed by fallbacks, tried in order
+// each cycle. In YAML it's either a single string or a list.
+type FeedURLs []string
+
+func (u *FeedURLs) UnmarshalYAML(node *yaml.Node) error {
+    if node.Kind == yaml.ScalarNode {
+        *u = FeedURLs{node.Value}
+        return nil
+    }
+    var list []string
+    if err := node.Decode(&list); err != nil {
+        return err
+    }
+    *u = list
+    return nil
 }
 
 type ServerConfig struct {
     Port int `yaml:"port"`
+
+    // Minimum interval between SSE pushes per client; 0 disables coalescing
+    SSEMinInterval time.Duration `yaml:"sse_min_interval"`
+    // Comment frame interval that keeps idle SSE connections open
+    SSEKeepalive time.Duration `yaml:"sse_keepalive"`
+    // Reject /stream subscriptions containing unknown stop IDs with a 400
+    StrictStops bool `yaml:"strict_stops"`
+    // Allow /stream?all=true, which pushes the whole cache (capped at
+    // StreamAllMax) to the client on every update
+    StreamAll bool `yaml:"stream_all"`
+    // Soonest arrivals kept in each all-stops frame. Defaults to 500,
+    // negative is uncapped
+    StreamAllMax int `yaml:"stream_all_max"`
+
+    // Most stops one /arrivals-style request or /stream subscription may
+    // name (lines expanded); more is a 400. Defaults to 200, negative is
+    // unlimited
+    MaxStops int `yaml:"max_stops"`
+
+    // Upper bound on arrivals in one /arrivals response; 0 is unbounded
+    MaxArrivals int `yaml:"max_arrivals"`
+    // Hide arrivals further out than Lookahead (0 shows all), but always keep
+    // the soonest MinPerDirection at each stop and direction so a quiet stop
+    // never looks empty while a train is coming
+    Lookahead       time.Duration `yaml:"lookahead"`
+    MinPerDirection int           `yaml:"min_per_direction"`
+
+    // Reuse rendered /arrivals bodies for identical queries within this
+    // long, until the next cache update; 0 (the default) disables it
+    ResponseCacheTTL time.Duration `yaml:"response_cache_ttl"`
+
+    // Upper bound on ?per_direction= overrides of arrivals_per_direction
+    MaxPerDirection int `yaml:"max_per_direction"`
+
+    // Answer data endpoints with 503 until the first fetch cycle finishes,
+    // or ReadyTimeout passes, so early clients don't get an empty snapshot
+    ReadyGate    bool          `yaml:"ready_gate"`
+    ReadyTimeout time.Duration `yaml:"ready_timeout"`
+
+    // Serve /health, /stats, /feeds/status, admin and pprof routes on this
+    // port (plain HTTP) instead of Port; 0 keeps everything on Port
+    AdminPort int `yaml:"admin_port"`
+
+    // Mount net/http/pprof under /debug/pprof/; off by default since the
+    // profiles expose internals and can be expensive to collect
+    Pprof bool `yaml:"pprof"`
+
+    TLS TLSConfig `yaml:"tls"`
+
+    Admin AdminConfig `yaml:"admin"`
+}
+
+// AdminConfig gates operational endpoints such as /admin/refresh. They are
+// only mounted when enabled and a token is set.
+type AdminConfig struct {
+    Enabled bool   `yaml:"enabled"`
+    Token   string `yaml:"token"`
+    // Paths requiring the bearer token; entries ending in "/" match as prefixes
+    Paths []string `yaml:"paths"`
+}
+
+// covers reports whether path needs the admin token, matching Paths the
+// way the API's auth middleware does.
+func (a AdminConfig) covers(path string) bool {
+    for _, p := range a.Paths {
+        if p == path || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+            return true
+        }
+    }
+    return false
+}
+
+// TLSConfig enables HTTPS when both files are set. Certs are read once at
+// startup; reloading them requires a restart.
+type TLSConfig struct {
+    CertFile string `yaml:"cert_file"`
+    KeyFile  string `yaml:"key_file"`
+}
+
+func (t TLSConfig) Enabled() bool {
+    return t.CertFile != "" && t.KeyFile != ""
+}
+
+// StatusConfig sets the time-to-arrival thresholds behind Arrival.Status.
+// Unset thresholds take their defaults; enabled: false leaves Status off
+// every arrival instead.
+type StatusConfig struct {
+    Enabled     *bool         `yaml:"enabled"`
+    Arriving    time.Duration `yaml:"arriving"`
+    Approaching time.Duration `yaml:"approaching"`
 }
 
 type PollingConfig struct {
     Interval             time.Duration `yaml:"interval"`
     ArrivalsPerDirection int           `yaml:"arrivals_per_direction"`
+    UserAgent            string        `yaml:"user_agent"`
+    // Drop cached stops not refreshed within this long; 0 keeps them forever
+    CacheTTL time.Duration `yaml:"cache_ttl"`
+
+    // Skip a feed for BreakerCooldown after BreakerThreshold consecutive failures
+    BreakerThreshold int           `yaml:"breaker_threshold"`
+    BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+
+    QuietHours QuietHoursConfig `yaml:"quiet_hours"`
+
+    // Snapshots kept per stop for /arrivals/history; 0 disables it
+    HistorySize int `yaml:"history_size"`
+
+    // Trailing window of per-line arrival counts kept for
+    // /analytics/frequency; 0 disables it
+    FrequencyWindow time.Duration `yaml:"frequency_window"`
+
+    // Largest feed body read, after decompression; larger ones fail the fetch
+    MaxFeedBytes int64 `yaml:"max_feed_bytes"`
+
+    // Mark a feed (and its stops) stale when its header timestamp is older
+    // than this, even though fetches succeed; 0 disables the check
+    MaxFeedAge time.Duration `yaml:"max_feed_age"`
+
+    // Count minutes from each feed's header timestamp rather than the local
+    // clock, for providers known to publish late
+    UseFeedClock bool `yaml:"use_feed_clock"`
+
+    // Drop a feed's cached stops when it's disabled at runtime, instead of
+    // serving its last data until cache_ttl evicts it
+    ClearDisabledFeeds bool `yaml:"clear_disabled_feeds"`
+}
+
+// QuietHoursConfig polls at a slower interval during a daily local-time
+// window, e.g. overnight. Start may be after End to wrap past midnight.
+type QuietHoursConfig struct {
+    Start    string        `yaml:"start"` // "HH:MM"
+    End      string        `yaml:"end"`
+    Interval time.Duration `yaml:"interval"`
+
+    start, end int // minutes after midnight
+}
+
+func (q QuietHoursConfig) Enabled() bool {
+    return q.Interval > 0 && q.Start != "" && q.End != ""
+}
+
+// Contains reports whether t, already in the configured zone, falls in the
+// quiet window.
+func (q QuietHoursConfig) Contains(t time.Time) bool {
+    if !q.Enabled() {
+        return false
+    }
+    m := t.Hour()*60 + t.Minute()
+    if q.start <= q.end {
+        return m >= q.start && m < q.end
+    }
+    return m >= q.start || m < q.end
+}
+
+func validateStopKey(spec string) error {
+    switch spec {
+    case "", "suffix", "identity":
+        return nil
+    }
+    if v, ok := strings.CutPrefix(spec, "prefix:"); ok {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 {
+            return nil
+        }
+    }
+    return fmt.Errorf("stop_key %q: must be suffix, prefix:N or identity", spec)
+}
+
+func parseClock(s string) (int, error) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, err
+    }
+    return t.Hour()*60 + t.Minute(), nil
 }
 
 func Load(path string) (*Config, error) {
@@ -29,11 +260,173 @@ func Load(path string) (*Config, error) {
     }
     defer f.Close()
 
+    // JSON is a subset of YAML, so the YAML decoder reads .json files with
+    // the same keys and duration strings. TOML is converted to YAML first
+    // for the same reason: one set of struct tags and decoding rules.
+    var r io.Reader = f
+    if strings.EqualFold(filepath.Ext(path), ".toml") {
+        converted, err := tomlToYAML(f)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", path, err)
+        }
+        r = bytes.NewReader(converted)
+    }
+
     var cfg Config
-    decoder := yaml.NewDecoder(f)
+    decoder := yaml.NewDecoder(r)
     if err := decoder.Decode(&cfg); err != nil {
         return nil, err
     }
 
+    if ua := os.Getenv("FEED_USER_AGENT"); ua != "" {
+        cfg.Polling.UserAgent = ua
+    }
+    if cfg.Polling.UserAgent == "" {
+        cfg.Polling.UserAgent = "glance-mta/1.0"
+    }
+
+    if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+        cfg.Server.Admin.Token = token
+    }
+    if len(cfg.Server.Admin.Paths) == 0 {
+        cfg.Server.Admin.Paths = []string{"/admin/", "/debug/"}
+    }
+
+    if cfg.Server.SSEKeepalive == 0 {
+        cfg.Server.SSEKeepalive = 15 * time.Second
+    }
+
+    if cfg.Server.ReadyTimeout == 0 {
+        cfg.Server.ReadyTimeout = 30 * time.Second
+    }
+
+    if cfg.Server.MaxStops == 0 {
+        cfg.Server.MaxStops = 200
+    }
+
+    if cfg.Server.StreamAllMax == 0 {
+        cfg.Server.StreamAllMax = 500
+    }
+
+    if cfg.Server.MaxPerDirection == 0 {
+        cfg.Server.MaxPerDirection = 10
+    }
+
+    if cfg.Polling.MaxFeedBytes == 0 {
+        cfg.Polling.MaxFeedBytes = 10 << 20
+    }
+
+    if cfg.Polling.BreakerThreshold == 0 {
+        cfg.Polling.BreakerThreshold = 5
+    }
+    if cfg.Polling.BreakerCooldown == 0 {
+        cfg.Polling.BreakerCooldown = 2 * time.Minute
+    }
+
+    if q := &cfg.Polling.QuietHours; q.Enabled() {
+        if q.start, err = parseClock(q.Start); err != nil {
+            return nil, fmt.Errorf("quiet_hours.start: %w", err)
+        }
+        if q.end, err = parseClock(q.End); err != nil {
+            return nil, fmt.Errorf("quiet_hours.end: %w", err)
+        }
+    }
+
+    // Zero thresholds are how the parser knows status is off
+    if cfg.Status.Enabled != nil && !*cfg.Status.Enabled {
+        cfg.Status.Arriving, cfg.Status.Approaching = 0, 0
+    } else {
+        if cfg.Status.Arriving == 0 {
+            cfg.Status.Arriving = 30 * time.Second
+        }
+        if cfg.Status.Approaching == 0 {
+            cfg.Status.Approaching = 2 * time.Minute
+        }
+    }
+
+    if cfg.Timezone == "" {
+        cfg.Timezone = "America/New_York"
+    }
+    loc, err := time.LoadLocation(cfg.Timezone)
+    if err != nil {
+        return nil, fmt.Errorf("timezone %q: %w", cfg.Timezone, err)
+    }
+    cfg.Location = loc
+
+    if err := cfg.Validate(); err != nil {
+        return nil, err
+    }
+
     return &cfg, nil
 }
+
+// tomlToYAML re-encodes a TOML document as YAML. Durations are written as
+// strings ("30s") in either format; a TOML datetime has no use in Config.
+func tomlToYAML(r io.Reader) ([]byte, error) {
+    var doc map[string]any
+    if _, err := toml.NewDecoder(r).Decode(&doc); err != nil {
+        return nil, err
+    }
+    return yaml.Marshal(doc)
+}
+
+// Validate checks values Load can't default, normalizing where it can;
+// feed URLs are trimmed in place.
+func (c *Config) Validate() error {
+    names := make([]string, 0, len(c.Feeds))
+    for name := range c.Feeds {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+        urls := c.Feeds[name]
+        if len(urls) == 0 {
+            return fmt.Errorf("feed %s: no URL", name)
+        }
+        for i, raw := range urls {
+            raw = strings.TrimSpace(raw)
+            u, err := url.Parse(raw)
+            if err != nil {
+                return fmt.Errorf("feed %s: %w", name, err)
+            }
+            switch u.Scheme {
+            case "http", "https":
+                if u.Host == "" {
+                    return fmt.Errorf("feed %s: %q has no host", name, raw)
+                }
+            case "file": // saved feed replay; the path is checked on fetch
+            default:
+                return fmt.Errorf("feed %s: %q must be an http, https or file URL", name, raw)
+            }
+            urls[i] = raw
+        }
+    }
+
+    if c.Server.AdminPort != 0 && c.Server.AdminPort == c.Server.Port {
+        return fmt.Errorf("server.admin_port %d: must differ from server.port", c.Server.AdminPort)
+    }
+
+    // Profiles expose internals, so on the public port they must sit
+    // behind the admin token
+    if c.Server.Pprof && c.Server.AdminPort == 0 && !c.Server.Admin.covers("/debug/pprof/") {
+        return fmt.Errorf("server.pprof: /debug/pprof/ is public; add /debug/ to server.admin.paths or set server.admin_port")
+    }
+
+    switch c.DirectionStrategy {
+    case "", "suffix", "trip", "none":
+    default:
+        return fmt.Errorf("direction_strategy %q: must be suffix, trip or none", c.DirectionStrategy)
+    }
+
+    if err := validateStopKey(c.StopKey); err != nil {
+        return err
+    }
+
+    for line, feed := range c.LineFeeds {
+        if _, ok := c.Feeds[feed]; !ok {
+            return fmt.Errorf("line_feeds: line %s maps to unknown feed %q", line, feed)
+        }
+    }
+    return nil
+}
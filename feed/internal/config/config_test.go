@@ -0,0 +1,186 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadFormatsAgree(t *testing.T) {
+	want, err := Load("testdata/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spot-check the YAML baseline so agreement means something
+	if want.Server.Port != 9090 || want.Polling.Interval != 30*time.Second ||
+		want.Polling.BreakerCooldown != 90*time.Second || want.Polling.QuietHours.start != 60 ||
+		len(want.Feeds["ACE"]) != 2 || want.DirectionOverrides["L08"]["N"] != "To Manhattan" ||
+		want.Location.String() != "America/Chicago" {
+		t.Fatalf("YAML config = %+v", want)
+	}
+
+	for _, path := range []string{"testdata/config.json", "testdata/config.toml"} {
+		got, err := Load(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s differs from the YAML config:\n got %+v\nwant %+v", path, got, want)
+		}
+	}
+}
+
+func TestLoadTOMLErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"syntax.toml":   "[server\nport = 1\n",
+		"duration.toml": "[polling]\ninterval = \"often\"\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("%s: loaded without error", name)
+		} else if name == "syntax.toml" && !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: error %q doesn't name the file", name, err)
+		}
+	}
+}
+
+func TestPprofMustBeProtected(t *testing.T) {
+	dir := t.TempDir()
+	load := func(yaml string) error {
+		path := filepath.Join(dir, "config.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(path)
+		return err
+	}
+
+	if err := load("server:\n  pprof: true\n"); err != nil {
+		t.Errorf("pprof with the default admin paths: %v", err)
+	}
+	if err := load("server:\n  pprof: true\n  admin:\n    paths: [/debug/pprof/]\n"); err != nil {
+		t.Errorf("pprof with /debug/pprof/ covered: %v", err)
+	}
+	if err := load("server:\n  pprof: true\n  admin_port: 8081\n  admin:\n    paths: [/admin/]\n"); err != nil {
+		t.Errorf("pprof on the admin listener: %v", err)
+	}
+	if err := load("server:\n  pprof: true\n  admin:\n    paths: [/admin/]\n"); err == nil {
+		t.Error("public, unprotected pprof was accepted")
+	}
+	if err := load("server:\n  admin:\n    paths: [/admin/]\n"); err != nil {
+		t.Errorf("pprof off: %v", err)
+	}
+}
+
+func TestFeedURLValidation(t *testing.T) {
+	dir := t.TempDir()
+	load := func(yaml string) (*Config, error) {
+		path := filepath.Join(dir, "config.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return Load(path)
+	}
+
+	bad := map[string]string{
+		"scheme":     "feeds:\n  ace: ftp://example.com/ace\n",
+		"no host":    "feeds:\n  ace: \"http://\"\n",
+		"no scheme":  "feeds:\n  ace: example.com/ace\n",
+		"unparsable": "feeds:\n  ace: \"http://[::1\"\n",
+		"no URL":     "feeds:\n  ace: []\n",
+		"fallback":   "feeds:\n  ace: [https://example.com/ace, \"mailto:x@example.com\"]\n",
+	}
+	for name, yaml := range bad {
+		_, err := load(yaml)
+		if err == nil {
+			t.Errorf("%s: accepted", name)
+		} else if !strings.Contains(err.Error(), "feed ace") {
+			t.Errorf("%s: error %q doesn't name the feed", name, err)
+		}
+	}
+
+	cfg, err := load("feeds:\n  ace: [\"  https://example.com/ace  \", \"file:///tmp/ace.pb\"]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FeedURLs{"https://example.com/ace", "file:///tmp/ace.pb"}
+	if got := cfg.Feeds["ace"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("ace = %q, want %q", got, want)
+	}
+}
+
+func TestLineFeedsMustNameFeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(yaml string) {
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("feeds:\n  canarsie: https://example.com/l\nline_feeds:\n  L: canarsie\n")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.LineFeeds, map[string]string{"L": "canarsie"}) {
+		t.Errorf("line_feeds = %v", cfg.LineFeeds)
+	}
+
+	write("feeds:\n  canarsie: https://example.com/l\nline_feeds:\n  L: canarsie\n  G: crosstown\n")
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), `"crosstown"`) {
+		t.Errorf("mapping to a missing feed: %v", err)
+	}
+}
+
+func TestStopKeyValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	for spec, ok := range map[string]bool{
+		"suffix": true, "identity": true, "prefix:3": true,
+		"prefix:0": false, "prefix:": false, "prefix:abc": false, "strip": false,
+	} {
+		if err := os.WriteFile(path, []byte("stop_key: \""+spec+"\"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(path)
+		if ok && err != nil {
+			t.Errorf("stop_key %q: %v", spec, err)
+		} else if !ok && err == nil {
+			t.Errorf("stop_key %q was accepted", spec)
+		}
+	}
+}
+
+func TestStatusThresholds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	tests := []struct {
+		yaml                  string
+		arriving, approaching time.Duration
+	}{
+		{"{}", 30 * time.Second, 2 * time.Minute},
+		{"status:\n  arriving: 45s\n", 45 * time.Second, 2 * time.Minute},
+		{"status:\n  enabled: true\n  approaching: 5m\n", 30 * time.Second, 5 * time.Minute},
+		// Off means no thresholds, even ones that were set
+		{"status:\n  enabled: false\n  arriving: 45s\n", 0, 0},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.yaml, err)
+		}
+		if cfg.Status.Arriving != tt.arriving || cfg.Status.Approaching != tt.approaching {
+			t.Errorf("%q: thresholds %s/%s, want %s/%s", tt.yaml, cfg.Status.Arriving, cfg.Status.Approaching, tt.arriving, tt.approaching)
+		}
+	}
+}
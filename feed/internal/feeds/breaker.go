@@ -0,0 +1,68 @@
+package feeds
+
+import "time"
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// circuitBreaker stops a feed from being fetched for a cooldown after
+// repeated failures, then lets a single probe through (half-open). The
+// fetcher serializes access under its own mutex.
+type circuitBreaker struct {
+	threshold int // consecutive failures before opening; <= 0 disables
+	cooldown  time.Duration
+
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+	}
+}
+
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b.state != BreakerOpen {
+		return true
+	}
+	if now.Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.state = BreakerHalfOpen
+	return true
+}
+
+// abandon undoes allow for a probe that never finished, e.g. because the
+// cycle was cancelled: the breaker goes back to open with its original
+// cooldown, so the next cycle probes again, and no failure is counted.
+func (b *circuitBreaker) abandon() {
+	if b.state == BreakerHalfOpen {
+		b.state = BreakerOpen
+	}
+}
+
+func (b *circuitBreaker) success() {
+	b.state = BreakerClosed
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure(now time.Time) {
+	b.failures++
+	if b.threshold <= 0 {
+		return
+	}
+	// A failed probe re-opens immediately
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = now
+	}
+}
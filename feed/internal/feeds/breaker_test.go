@@ -0,0 +1,167 @@
+package feeds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(3, time.Minute)
+
+	// Closed until the threshold of consecutive failures
+	for i := 0; i < 2; i++ {
+		b.failure(now)
+		if b.state != BreakerClosed || !b.allow(now) {
+			t.Fatalf("after %d failures: state %s", i+1, b.state)
+		}
+	}
+	b.failure(now)
+	if b.state != BreakerOpen {
+		t.Fatalf("after 3 failures: state %s, want open", b.state)
+	}
+
+	// Open refuses fetches until the cooldown passes
+	if b.allow(now.Add(59 * time.Second)) {
+		t.Error("open breaker allowed a fetch inside the cooldown")
+	}
+
+	// Then one probe goes through; its failure re-opens straight away
+	if !b.allow(now.Add(time.Minute)) || b.state != BreakerHalfOpen {
+		t.Fatalf("after cooldown: state %s, want half-open", b.state)
+	}
+	probeAt := now.Add(time.Minute)
+	b.failure(probeAt)
+	if b.state != BreakerOpen || b.allow(probeAt.Add(30*time.Second)) {
+		t.Fatalf("failed probe: state %s, want open for a fresh cooldown", b.state)
+	}
+
+	// A successful probe closes it and resets the count
+	if !b.allow(probeAt.Add(time.Minute)) {
+		t.Fatal("second probe refused")
+	}
+	b.success()
+	if b.state != BreakerClosed || b.failures != 0 {
+		t.Errorf("after success: state %s, failures %d", b.state, b.failures)
+	}
+	b.failure(now)
+	if b.state != BreakerClosed {
+		t.Errorf("one failure after reset opened the breaker")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		b.failure(now)
+	}
+	if b.state != BreakerClosed || !b.allow(now) {
+		t.Errorf("threshold 0: state %s, want always closed", b.state)
+	}
+}
+
+func TestFetcherSkipsFeedWhileBreakerOpen(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, `
+polling:
+  breaker_threshold: 2
+  breaker_cooldown: 1h
+feeds:
+  L: `+srv.URL+`
+`)
+	f, _ := newTestFetcher(t, cfg)
+
+	f.FetchOnce(context.Background())
+	f.FetchOnce(context.Background())
+	res := f.FetchOnce(context.Background())
+	if res.Feeds["L"] != "skipped" {
+		t.Errorf("third cycle: feed L %q, want skipped", res.Feeds["L"])
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("upstream hit %d times, want 2", n)
+	}
+	if st := f.Status()[0]; st.Breaker != BreakerOpen {
+		t.Errorf("status breaker %q, want open", st.Breaker)
+	}
+}
+
+func TestCircuitBreakerAbandonedProbe(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(1, time.Minute)
+	b.failure(now)
+	if !b.allow(now.Add(time.Minute)) || b.state != BreakerHalfOpen {
+		t.Fatalf("after cooldown: state %s, want half-open", b.state)
+	}
+
+	// No outcome: open again as before, the probe not counted as a failure
+	b.abandon()
+	if b.state != BreakerOpen || b.failures != 1 {
+		t.Fatalf("abandoned probe: state %s, failures %d; want open, 1", b.state, b.failures)
+	}
+	if !b.allow(now.Add(time.Minute)) {
+		t.Error("abandoned probe restarted the cooldown")
+	}
+
+	// Closed breakers aren't touched
+	b.success()
+	b.abandon()
+	if b.state != BreakerClosed {
+		t.Errorf("abandon on a closed breaker: state %s", b.state)
+	}
+}
+
+func TestFetcherCancelledProbe(t *testing.T) {
+	good := buildFeed(t, time.Now(), []testTrip{{id: "t1", route: "L", stops: []string{"L08N"}, in: []time.Duration{2 * time.Minute}}})
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch hits.Add(1) {
+		case 1:
+			http.Error(w, "boom", http.StatusInternalServerError)
+		case 2:
+			// The probe: hangs until the cycle is cancelled
+			<-r.Context().Done()
+		default:
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.Write(good)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, `
+polling:
+  breaker_threshold: 1
+  breaker_cooldown: 10ms
+feeds:
+  L: `+srv.URL+`
+`)
+	f, _ := newTestFetcher(t, cfg)
+	f.FetchOnce(context.Background())
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	f.FetchOnce(ctx)
+	st := f.Status()[0]
+	if st.Breaker != BreakerOpen || st.ConsecutiveFailures != 1 {
+		t.Fatalf("after a cancelled probe: breaker %s, %d failures; want open, 1", st.Breaker, st.ConsecutiveFailures)
+	}
+
+	// The next cycle probes again, and closes it
+	if res := f.FetchOnce(context.Background()); res.Feeds["L"] != "ok" {
+		t.Fatalf("next cycle: feed L %q, want ok", res.Feeds["L"])
+	}
+	if st := f.Status()[0]; st.Breaker != BreakerClosed {
+		t.Errorf("after a good probe: breaker %s, want closed", st.Breaker)
+	}
+}
@@ -1,6 +1,7 @@
 package feeds
 
 import (
+    "container/heap"
     "sort"
     "sync"
     "time"
@@ -8,22 +9,49 @@ import (
 
 type Arrival struct {
     StopID        string `json:"stop_id"`
+    Platform      string `json:"platform,omitempty"`      // feed stop ID before grouping, e.g. "L08N"
     Station       string `json:"station"`
     Line          string `json:"line"`
     Direction     string `json:"direction"`       // "Manhattan", "Brooklyn", etc.
-    DirectionCode string `json:"direction_code"`  // "N" or "S"
+    DirectionCode string `json:"direction_code"`  // "N", "S", "E" or "W"
     Minutes       int    `json:"minutes"`
+    Status        string `json:"status,omitempty"`        // "arriving", "approaching" or "scheduled"
+    ArrivalClock  string `json:"arrival_clock,omitempty"` // local "HH:MM"
+    Origin        bool   `json:"origin,omitempty"`        // departing from the trip's first stop
+    Assigned      bool   `json:"assigned"`                // NYCT: a physical train is on the trip
+    Headsign      string `json:"headsign,omitempty"`      // destination, e.g. "Canarsie-Rockaway Pkwy"
+    TripID        string `json:"trip_id,omitempty"`
+    ComplexID     string `json:"complex_id,omitempty"`    // station complex, shared by transfer platforms
+
+    // Raw values from the stop time update
+    Delay         int    `json:"delay,omitempty"`          // seconds late (negative = early)
+    ArrivalTime   int64  `json:"arrival_time,omitempty"`   // Unix seconds
+    DepartureTime int64  `json:"departure_time,omitempty"` // Unix seconds
 }
 
 type ArrivalCache struct {
     mu        sync.RWMutex
     arrivals  map[string][]Arrival // stop_id -> arrivals
+    stopTimes map[string]time.Time // stop_id -> last time its list was replaced
     updatedAt time.Time
+    // trip ID -> its upcoming calls in time order, rebuilt on every change
+    trips map[string][]Arrival
+    // Stops served by a feed whose header timestamp has stopped advancing
+    staleStops map[string]bool
+
+    // Optional per-stop snapshot rings; nil when history is disabled
+    history     map[string]*historyRing
+    historySize int
+
+    // Optional per-line arrival counts; nil when disabled
+    frequency *frequencyLog
 }
 
 func NewArrivalCache() *ArrivalCache {
     return &ArrivalCache{
-        arrivals: make(map[string][]Arrival),
+        arrivals:  make(map[string][]Arrival),
+        stopTimes: make(map[string]time.Time),
+        trips:     make(map[string][]Arrival),
     }
 }
 
@@ -42,39 +70,108 @@ func (c *ArrivalCache) Update(newArrivals map[string][]Arrival) {
     // We should probably just merge them into the main map.
     // If a StopID is in the update, we replace its list.
     
+    now := time.Now()
     for stopID, list := range newArrivals {
+        // Stored lists are never nil, so every read marshals as []
+        if list == nil {
+            list = []Arrival{}
+        }
         // Sort by minutes
         sort.Slice(list, func(i, j int) bool {
             return list[i].Minutes < list[j].Minutes
         })
         c.arrivals[stopID] = list
+        c.stopTimes[stopID] = now
+        c.recordHistory(stopID, now, list)
+        c.recordFrequency(list)
+    }
+    c.pruneFrequency(now)
+    c.rebuildTrips()
+    c.updatedAt = now
+}
+
+// Evict drops stops whose arrivals haven't been refreshed within ttl, e.g.
+// stops that fell out of the feeds after a reroute. Returns how many went.
+func (c *ArrivalCache) Evict(ttl time.Duration) int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    evicted := 0
+    cutoff := time.Now().Add(-ttl)
+    for stopID, at := range c.stopTimes {
+        if at.Before(cutoff) {
+            delete(c.arrivals, stopID)
+            delete(c.stopTimes, stopID)
+            // Per-stop side tables go too, or they'd outlive the stop
+            delete(c.history, stopID)
+            delete(c.staleStops, stopID)
+            evicted++
+        }
+    }
+    if evicted > 0 {
+        c.rebuildTrips()
     }
-    c.updatedAt = time.Now()
+    return evicted
 }
 
 func (c *ArrivalCache) GetForStops(stopIDs map[string]bool) []Arrival {
     c.mu.RLock()
     defer c.mu.RUnlock()
 
-    var result []Arrival
+    lists := make([][]Arrival, 0, len(stopIDs))
     for stopID := range stopIDs {
         if list, ok := c.arrivals[stopID]; ok {
-            result = append(result, list...)
+            lists = append(lists, list)
+        }
+    }
+
+    return dedupeComplexTrips(mergeByMinutes(lists))
+}
+
+// Snapshot is a point-in-time view of the cache. The per-stop lists are
+// never mutated once stored, so a snapshot can be read without the lock.
+type Snapshot map[string][]Arrival
+
+func (c *ArrivalCache) Snapshot() Snapshot {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    snap := make(Snapshot, len(c.arrivals))
+    for stopID, list := range c.arrivals {
+        snap[stopID] = list
+    }
+    return snap
+}
+
+func (s Snapshot) ForStops(stopIDs map[string]bool) []Arrival {
+    lists := make([][]Arrival, 0, len(stopIDs))
+    for stopID := range stopIDs {
+        if list, ok := s[stopID]; ok {
+            lists = append(lists, list)
         }
     }
 
+    return dedupeComplexTrips(mergeByMinutes(lists))
+}
+
+func (s Snapshot) All() []Arrival {
+    result := []Arrival{}
+    for _, list := range s {
+        result = append(result, list...)
+    }
+
     sort.Slice(result, func(i, j int) bool {
         return result[i].Minutes < result[j].Minutes
     })
 
-    return result
+    return dedupeComplexTrips(result)
 }
 
 func (c *ArrivalCache) GetAll() []Arrival {
     c.mu.RLock()
     defer c.mu.RUnlock()
 
-    var result []Arrival
+    result := []Arrival{}
     for _, list := range c.arrivals {
         result = append(result, list...)
     }
@@ -83,7 +180,59 @@ func (c *ArrivalCache) GetAll() []Arrival {
         return result[i].Minutes < result[j].Minutes
     })
 
-    return result
+    return dedupeComplexTrips(result)
+}
+
+// GetTrip returns a trip's upcoming stops in the order it reaches them.
+func (c *ArrivalCache) GetTrip(tripID string) ([]Arrival, bool) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    stops, ok := c.trips[tripID]
+    return stops, ok
+}
+
+// rebuildTrips regroups the cached arrivals by trip. Must be called with
+// c.mu held.
+func (c *ArrivalCache) rebuildTrips() {
+    trips := make(map[string][]Arrival)
+    for _, list := range c.arrivals {
+        for _, a := range list {
+            if a.TripID != "" {
+                trips[a.TripID] = append(trips[a.TripID], a)
+            }
+        }
+    }
+    for _, stops := range trips {
+        sort.SliceStable(stops, func(i, j int) bool {
+            return callTime(stops[i]) < callTime(stops[j])
+        })
+    }
+    c.trips = trips
+}
+
+// callTime is when a train reaches a stop, falling back to departure for
+// origin stops that only carry one.
+func callTime(a Arrival) int64 {
+    if a.ArrivalTime != 0 {
+        return a.ArrivalTime
+    }
+    return a.DepartureTime
+}
+
+// Size returns the number of cached stops and the arrivals across them.
+func (c *ArrivalCache) Size() (stops int, arrivals int) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    for _, list := range c.arrivals {
+        arrivals += len(list)
+    }
+    return len(c.arrivals), arrivals
+}
+
+func (c *ArrivalCache) UpdatedAt() time.Time {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.updatedAt
 }
 
 func (c *ArrivalCache) IsStale() bool {
@@ -91,3 +240,105 @@ func (c *ArrivalCache) IsStale() bool {
     defer c.mu.RUnlock()
     return time.Since(c.updatedAt) > 60*time.Second
 }
+
+// SetStaleStops replaces the set of stops whose feed is up but frozen.
+func (c *ArrivalCache) SetStaleStops(stopIDs map[string]bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.staleStops = stopIDs
+}
+
+// IsStaleFor reports whether the cache as a whole is stale, or any of the
+// given stops comes from a frozen feed. No stops means any stop at all.
+func (c *ArrivalCache) IsStaleFor(stopIDs map[string]bool) bool {
+    if c.IsStale() {
+        return true
+    }
+
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    if len(stopIDs) == 0 {
+        return len(c.staleStops) > 0
+    }
+    for stopID := range stopIDs {
+        if c.staleStops[stopID] {
+            return true
+        }
+    }
+    return false
+}
+
+// mergeByMinutes combines per-stop lists, each already sorted by minutes
+// in Update, with a k-way merge rather than re-sorting the concatenation.
+// The result is a new, non-nil slice, so callers may filter it in place.
+func mergeByMinutes(lists [][]Arrival) []Arrival {
+    total := 0
+    for _, list := range lists {
+        total += len(list)
+    }
+    result := make([]Arrival, 0, total)
+    if total == 0 {
+        return result
+    }
+    if len(lists) == 1 {
+        return append(result, lists[0]...)
+    }
+
+    h := make(mergeHeap, 0, len(lists))
+    for _, list := range lists {
+        if len(list) > 0 {
+            h = append(h, list)
+        }
+    }
+    heap.Init(&h)
+    for h.Len() > 0 {
+        head := h[0]
+        result = append(result, head[0])
+        // Drop exhausted lists without heap.Pop, which would box the slice
+        if len(head) == 1 {
+            h[0] = h[len(h)-1]
+            h = h[:len(h)-1]
+        } else {
+            h[0] = head[1:]
+        }
+        if len(h) > 0 {
+            heap.Fix(&h, 0)
+        }
+    }
+    return result
+}
+
+// mergeHeap orders the remaining tails of sorted lists by their head.
+type mergeHeap [][]Arrival
+
+func (h mergeHeap) Len() int           { return len(h) }
+func (h mergeHeap) Less(i, j int) bool { return h[i][0].Minutes < h[j][0].Minutes }
+func (h mergeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)        { *h = append(*h, x.([]Arrival)) }
+func (h *mergeHeap) Pop() any {
+    old := *h
+    x := old[len(old)-1]
+    *h = old[:len(old)-1]
+    return x
+}
+
+// dedupeComplexTrips keeps only the soonest report of a trip within one
+// station complex, so a train seen under sibling platform stop IDs is
+// listed once. Input must already be sorted by minutes.
+func dedupeComplexTrips(sorted []Arrival) []Arrival {
+    type key struct{ complexID, tripID string }
+
+    seen := make(map[key]bool)
+    result := sorted[:0]
+    for _, a := range sorted {
+        if a.TripID != "" && a.ComplexID != "" {
+            k := key{a.ComplexID, a.TripID}
+            if seen[k] {
+                continue
+            }
+            seen[k] = true
+        }
+        result = append(result, a)
+    }
+    return result
+}
@@ -0,0 +1,236 @@
+package feeds
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// cacheWithStops fills a cache with stops S00..S<n>, each holding perStop
+// arrivals at random minutes, the way a 50-stop subscription sees it.
+func cacheWithStops(tb testing.TB, stops, perStop int) (*ArrivalCache, map[string]bool) {
+	tb.Helper()
+	rng := rand.New(rand.NewSource(1))
+	update := make(map[string][]Arrival, stops)
+	subscribed := make(map[string]bool, stops)
+	for s := 0; s < stops; s++ {
+		stopID := fmt.Sprintf("S%02d", s)
+		subscribed[stopID] = true
+		for i := 0; i < perStop; i++ {
+			update[stopID] = append(update[stopID], Arrival{
+				StopID:        stopID,
+				Line:          "L",
+				DirectionCode: []string{"N", "S"}[i%2],
+				Minutes:       rng.Intn(60),
+				TripID:        fmt.Sprintf("%s-%d", stopID, i),
+			})
+		}
+	}
+	c := NewArrivalCache()
+	c.Update(update)
+	return c, subscribed
+}
+
+// sortedConcat is what GetForStops did before the k-way merge.
+func sortedConcat(c *ArrivalCache, stopIDs map[string]bool) []Arrival {
+	var result []Arrival
+	for stopID := range stopIDs {
+		result = append(result, c.arrivals[stopID]...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Minutes < result[j].Minutes
+	})
+	return result
+}
+
+func TestGetForStopsMatchesSortedConcat(t *testing.T) {
+	c, stops := cacheWithStops(t, 50, 20)
+	got := c.GetForStops(stops)
+	want := sortedConcat(c, stops)
+	if len(got) != len(want) {
+		t.Fatalf("got %d arrivals, want %d", len(got), len(want))
+	}
+
+	// Ties may come out in either order, so compare per-minute trip sets
+	bucket := func(list []Arrival) map[int]map[string]bool {
+		m := make(map[int]map[string]bool)
+		for _, a := range list {
+			if m[a.Minutes] == nil {
+				m[a.Minutes] = make(map[string]bool)
+			}
+			m[a.Minutes][a.TripID] = true
+		}
+		return m
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].Minutes < got[i-1].Minutes {
+			t.Fatalf("out of order at %d: %d after %d", i, got[i].Minutes, got[i-1].Minutes)
+		}
+	}
+	gotBuckets, wantBuckets := bucket(got), bucket(want)
+	for m, trips := range wantBuckets {
+		if len(gotBuckets[m]) != len(trips) {
+			t.Errorf("minute %d: got %d trips, want %d", m, len(gotBuckets[m]), len(trips))
+		}
+	}
+}
+
+func BenchmarkGetForStops(b *testing.B) {
+	for _, stops := range []int{1, 10, 50} {
+		c, subscribed := cacheWithStops(b, stops, 20)
+		b.Run(fmt.Sprintf("stops=%d", stops), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.GetForStops(subscribed)
+			}
+		})
+	}
+}
+
+// BenchmarkGetForStopsSortedConcat is the pre-merge baseline for comparison.
+func BenchmarkGetForStopsSortedConcat(b *testing.B) {
+	c, subscribed := cacheWithStops(b, 50, 20)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.mu.RLock()
+		sortedConcat(c, subscribed)
+		c.mu.RUnlock()
+	}
+}
+
+func BenchmarkMergeByMinutes(b *testing.B) {
+	c, subscribed := cacheWithStops(b, 50, 20)
+	lists := make([][]Arrival, 0, len(subscribed))
+	for stopID := range subscribed {
+		lists = append(lists, c.arrivals[stopID])
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		mergeByMinutes(lists)
+	}
+}
+
+func TestEvictDropsUnrefreshedStops(t *testing.T) {
+	c := NewArrivalCache()
+	c.EnableHistory(3)
+	c.Update(map[string][]Arrival{
+		"L08": {{StopID: "L08", Minutes: 2, TripID: "a"}},
+		"L06": {{StopID: "L06", Minutes: 4, TripID: "b"}},
+	})
+	c.SetStaleStops(map[string]bool{"L08": true})
+
+	// L08 went quiet an hour ago; L06 was just refreshed
+	c.stopTimes["L08"] = time.Now().Add(-time.Hour)
+
+	if n := c.Evict(10 * time.Minute); n != 1 {
+		t.Fatalf("Evict = %d, want 1", n)
+	}
+	if got := c.GetForStops(map[string]bool{"L08": true}); len(got) != 0 {
+		t.Errorf("evicted stop still served: %v", got)
+	}
+	if _, ok := c.GetTrip("a"); ok {
+		t.Error("evicted stop's trip still indexed")
+	}
+	if h := c.History("L08"); len(h) != 0 {
+		t.Errorf("evicted stop kept %d history snapshots", len(h))
+	}
+	if c.IsStaleFor(map[string]bool{"L08": true}) {
+		t.Error("evicted stop still marked stale")
+	}
+	if got := c.GetForStops(map[string]bool{"L06": true}); len(got) != 1 {
+		t.Errorf("fresh stop L06 has %d arrivals, want 1", len(got))
+	}
+	if n := c.Evict(10 * time.Minute); n != 0 {
+		t.Errorf("second Evict = %d, want 0", n)
+	}
+}
+
+func TestComplexSiblingsDedupeTrips(t *testing.T) {
+	c := NewArrivalCache()
+	c.Update(map[string][]Arrival{
+		// Times Sq: the same train reported under two platform stop IDs
+		"127": {
+			{StopID: "127", ComplexID: "611", Line: "1", Minutes: 4, TripID: "shared"},
+			{StopID: "127", ComplexID: "611", Line: "1", Minutes: 6},
+		},
+		"725": {
+			{StopID: "725", ComplexID: "611", Line: "1", Minutes: 3, TripID: "shared"},
+			{StopID: "725", ComplexID: "611", Line: "7", Minutes: 5, TripID: "own"},
+			{StopID: "725", ComplexID: "611", Line: "7", Minutes: 6},
+		},
+		// The same trip at another complex is a different call
+		"L08": {{StopID: "L08", ComplexID: "120", Line: "1", Minutes: 9, TripID: "shared"}},
+	})
+	stops := map[string]bool{"127": true, "725": true, "L08": true}
+
+	describe := func(arrivals []Arrival) []string {
+		var out []string
+		for _, a := range arrivals {
+			out = append(out, fmt.Sprintf("%s/%s@%d", a.StopID, a.TripID, a.Minutes))
+		}
+		return out
+	}
+	want := []string{"725/shared@3", "725/own@5", "127/@6", "725/@6", "L08/shared@9"}
+
+	for name, got := range map[string][]Arrival{
+		"GetForStops":      c.GetForStops(stops),
+		"Snapshot.ForStop": c.Snapshot().ForStops(stops),
+		"GetAll":           c.GetAll(),
+		"Snapshot.All":     c.Snapshot().All(),
+	} {
+		d := describe(got)
+		if len(d) == len(want) {
+			// The two trip-less arrivals at 6 minutes may come in either order
+			sort.Strings(d[2:4])
+		}
+		if !reflect.DeepEqual(d, want) {
+			t.Errorf("%s = %v, want %v", name, d, want)
+		}
+	}
+}
+
+func TestGetTripStopOrder(t *testing.T) {
+	c := NewArrivalCache()
+	at := func(m int) int64 { return time.Now().Add(time.Duration(m) * time.Minute).Unix() }
+	call := func(stop string, m int) Arrival {
+		return Arrival{StopID: stop, Line: "L", Minutes: m, TripID: "L-1", ArrivalTime: at(m)}
+	}
+	// The trip's calls arrive scattered across stops and feed updates
+	c.Update(map[string][]Arrival{
+		"L06": {call("L06", 6)},
+		"L01": {{StopID: "L01", Line: "L", TripID: "L-1", DepartureTime: at(0)}}, // origin: departure only
+		"L08": {call("L08", 9), {StopID: "L08", Line: "L", Minutes: 1, TripID: "L-2", ArrivalTime: at(1)}},
+	})
+	c.Update(map[string][]Arrival{
+		"L03": {call("L03", 3)},
+		"L10": {call("L10", 12)},
+	})
+
+	stops, ok := c.GetTrip("L-1")
+	if !ok {
+		t.Fatal("trip L-1 not indexed")
+	}
+	var order []string
+	for _, a := range stops {
+		order = append(order, a.StopID)
+	}
+	if want := []string{"L01", "L03", "L06", "L08", "L10"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("L-1 stops = %v, want %v", order, want)
+	}
+	if other, _ := c.GetTrip("L-2"); len(other) != 1 || other[0].StopID != "L08" {
+		t.Errorf("L-2 = %v, want just L08", other)
+	}
+
+	// Once the train has left L01 the next cycle drops it from the trip
+	c.Update(map[string][]Arrival{"L01": {}})
+	stops, _ = c.GetTrip("L-1")
+	if len(stops) != 4 || stops[0].StopID != "L03" {
+		t.Errorf("after L01 cleared: %v", stops)
+	}
+	if _, ok := c.GetTrip("nope"); ok {
+		t.Error("unknown trip found")
+	}
+}
@@ -0,0 +1,89 @@
+package feeds
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+)
+
+// Direction strategies, chosen by ParseOptions.DirectionStrategy
+const (
+	// NYC convention: a platform suffix on the stop ID ("L08N"), falling
+	// back to the NYCT trip direction when there isn't one. The default.
+	DirectionSuffix = "suffix"
+	// Stop IDs are used as-is; the direction comes from the NYCT extension
+	// or, failing that, GTFS direction_id (0 is reported as N, 1 as S so
+	// the station's north/south labels apply)
+	DirectionTrip = "trip"
+	// Stop IDs are used as-is and arrivals carry no direction
+	DirectionNone = "none"
+)
+
+// stopDirection splits a normalized feed stop ID into the base stop ID
+// arrivals are grouped by and a compass direction code, which may be "".
+// ok is false for IDs the strategy can't use.
+func stopDirection(strategy, stopIDFull string, td *gtfs.TripDescriptor, nyct nyctTripDescriptor) (base, dirCode string, ok bool) {
+	switch strategy {
+	case DirectionTrip:
+		if stopIDFull == "" {
+			return "", "", false
+		}
+		dirCode = nyctDirectionCode(nyct.Direction)
+		if dirCode == "" && td.DirectionId != nil {
+			dirCode = "N"
+			if td.GetDirectionId() == 1 {
+				dirCode = "S"
+			}
+		}
+		return stopIDFull, dirCode, true
+	case DirectionNone:
+		return stopIDFull, "", stopIDFull != ""
+	}
+
+	if len(stopIDFull) < 3 {
+		return "", "", false
+	}
+	base, dirCode = splitStopID(stopIDFull)
+	if dirCode == "" {
+		// No platform suffix; fall back to the NYCT trip direction
+		dirCode = nyctDirectionCode(nyct.Direction)
+	}
+	return base, dirCode, true
+}
+
+// StopKeyFunc maps a feed stop ID to its station DB key, overriding the
+// direction strategy's own base ID:
+//
+//	"suffix"   strips a trailing N/S/E/W platform suffix
+//	"prefix:N" keeps the first N characters
+//	"identity" uses the ID unchanged
+//
+// It returns nil for "" (and for anything config validation would reject),
+// leaving the strategy's base ID in place.
+func StopKeyFunc(spec string) func(string) string {
+	switch spec {
+	case "suffix":
+		return func(id string) string {
+			if id == "" {
+				return id
+			}
+			base, _ := splitStopID(id)
+			return base
+		}
+	case "identity":
+		return func(id string) string { return id }
+	}
+
+	if v, ok := strings.CutPrefix(spec, "prefix:"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return func(id string) string {
+				if len(id) > n {
+					return id[:n]
+				}
+				return id
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package feeds
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStopDirection(t *testing.T) {
+	plain := &gtfs.TripDescriptor{}
+	dir0 := &gtfs.TripDescriptor{DirectionId: proto.Uint32(0)}
+	dir1 := &gtfs.TripDescriptor{DirectionId: proto.Uint32(1)}
+	south := nyctTripDescriptor{Direction: 3}
+
+	tests := []struct {
+		strategy, stopID string
+		td               *gtfs.TripDescriptor
+		nyct             nyctTripDescriptor
+		base, dir        string
+		ok               bool
+	}{
+		// The default is the NYC suffix convention
+		{"", "L08N", plain, nyctTripDescriptor{}, "L08", "N", true},
+		{DirectionSuffix, "725W", plain, nyctTripDescriptor{}, "725", "W", true},
+		{DirectionSuffix, "L08", plain, south, "L08", "S", true}, // no suffix: NYCT direction
+		{DirectionSuffix, "L08", dir1, nyctTripDescriptor{}, "L08", "", true},
+		{DirectionSuffix, "AB", plain, nyctTripDescriptor{}, "", "", false},
+
+		// IDs as-is; NYCT direction first, then direction_id
+		{DirectionTrip, "L08N", plain, south, "L08N", "S", true},
+		{DirectionTrip, "stop-42", dir0, nyctTripDescriptor{}, "stop-42", "N", true},
+		{DirectionTrip, "stop-42", dir1, nyctTripDescriptor{}, "stop-42", "S", true},
+		{DirectionTrip, "stop-42", dir1, nyctTripDescriptor{Direction: 2}, "stop-42", "E", true},
+		{DirectionTrip, "stop-42", plain, nyctTripDescriptor{}, "stop-42", "", true},
+		{DirectionTrip, "", dir0, nyctTripDescriptor{}, "", "", false},
+
+		{DirectionNone, "L08N", dir0, south, "L08N", "", true},
+		{DirectionNone, "", plain, nyctTripDescriptor{}, "", "", false},
+	}
+	for _, tt := range tests {
+		base, dir, ok := stopDirection(tt.strategy, tt.stopID, tt.td, tt.nyct)
+		if base != tt.base || dir != tt.dir || ok != tt.ok {
+			t.Errorf("%q %q: got %q %q %t, want %q %q %t", tt.strategy, tt.stopID, base, dir, ok, tt.base, tt.dir, tt.ok)
+		}
+	}
+}
+
+func TestParseFeedDirectionStrategies(t *testing.T) {
+	db := testStationDB(t)
+	now := time.Now()
+	trip := func(id string, directionID uint32, stop string) *gtfs.FeedEntity {
+		e := tripEntity(id, "L", nil, stopUpdate(stop, now.Add(3*time.Minute).Unix(), 0))
+		e.TripUpdate.Trip.DirectionId = proto.Uint32(directionID)
+		return e
+	}
+	// An agency using bare station IDs and direction_id
+	data := marshalFeed(t, now, trip("north", 0, "L08"), trip("south", 1, "L08"))
+
+	tests := []struct {
+		strategy string
+		want     map[string]string // trip -> direction code and label
+	}{
+		{DirectionSuffix, map[string]string{"north": " ", "south": " "}},
+		{DirectionTrip, map[string]string{"north": "N Manhattan", "south": "S Canarsie - Rockaway Parkway"}},
+		{DirectionNone, map[string]string{"north": " ", "south": " "}},
+	}
+	for _, tt := range tests {
+		arrivals, err := ParseFeed(data, db, ParseOptions{DirectionStrategy: tt.strategy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, a := range arrivals["L08"] {
+			got[a.TripID] = a.DirectionCode + " " + a.Direction
+		}
+		for trip, want := range tt.want {
+			if got[trip] != want {
+				t.Errorf("%s: %s = %q, want %q", tt.strategy, trip, got[trip], want)
+			}
+		}
+	}
+}
+
+func TestStopKeyFunc(t *testing.T) {
+	tests := []struct {
+		spec string
+		in   map[string]string // feed stop ID -> station key
+	}{
+		{"suffix", map[string]string{"L08N": "L08", "725W": "725", "L08": "L08", "": ""}},
+		{"prefix:3", map[string]string{"L08N-P2": "L08", "L08": "L08", "L0": "L0"}},
+		{"identity", map[string]string{"L08N": "L08N", "stop-42": "stop-42"}},
+	}
+	for _, tt := range tests {
+		key := StopKeyFunc(tt.spec)
+		if key == nil {
+			t.Errorf("%s: nil func", tt.spec)
+			continue
+		}
+		for in, want := range tt.in {
+			if got := key(in); got != want {
+				t.Errorf("%s(%q) = %q, want %q", tt.spec, in, got, want)
+			}
+		}
+	}
+
+	for _, spec := range []string{"", "prefix:0", "prefix:x", "bogus"} {
+		if StopKeyFunc(spec) != nil {
+			t.Errorf("StopKeyFunc(%q) is not nil", spec)
+		}
+	}
+}
+
+func TestParseFeedStopKey(t *testing.T) {
+	db := testStationDB(t)
+	now := time.Now()
+	// Platform-level IDs the suffix convention can't split
+	data := marshalFeed(t, now,
+		tripEntity("t1", "L", nil, stopUpdate("L08-P1", now.Add(2*time.Minute).Unix(), 0)),
+		tripEntity("t2", "L", nil, stopUpdate("L06-P2", now.Add(4*time.Minute).Unix(), 0)),
+	)
+
+	arrivals, err := ParseFeed(data, db, ParseOptions{DirectionStrategy: DirectionNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arrivals) != 0 {
+		t.Errorf("without a stop key: %v, want nothing matched", arrivals)
+	}
+
+	arrivals, err = ParseFeed(data, db, ParseOptions{DirectionStrategy: DirectionNone, StopKey: StopKeyFunc("prefix:3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stop, trip := range map[string]string{"L08": "t1", "L06": "t2"} {
+		if list := arrivals[stop]; len(list) != 1 || list[0].TripID != trip || list[0].StopID != stop {
+			t.Errorf("prefix:3 at %s: %+v, want %s", stop, list, trip)
+		}
+	}
+
+	// A stop key overrides the suffix strategy's base ID but keeps its
+	// direction
+	data = marshalFeed(t, now, tripEntity("t3", "L", nil, stopUpdate("L08N", now.Add(2*time.Minute).Unix(), 0)))
+	arrivals, err = ParseFeed(data, db, ParseOptions{StopKey: StopKeyFunc("identity")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arrivals) != 0 {
+		t.Errorf("identity key: %v, want L08N unmatched", arrivals)
+	}
+	arrivals, err = ParseFeed(data, db, ParseOptions{StopKey: StopKeyFunc("suffix")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := arrivals["L08"]; len(list) != 1 || list[0].DirectionCode != "N" {
+		t.Errorf("suffix key: %+v, want t3 northbound at L08", list)
+	}
+}
@@ -0,0 +1,88 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fetch failure categories, as counted in FetchStats.Errors
+const (
+	ErrCategoryDNS         = "dns"
+	ErrCategoryConnection  = "connection"
+	ErrCategoryTimeout     = "timeout"
+	ErrCategoryHTTPStatus  = "http_status"
+	ErrCategoryTooLarge    = "too_large"
+	ErrCategoryNonProtobuf = "non_protobuf"
+	ErrCategoryParse       = "parse"
+	ErrCategoryOther       = "other"
+)
+
+// StatusError is a non-200 response from a feed. RetryAfter is set from
+// a 429 or 503 Retry-After header, when present.
+type StatusError struct {
+	Code       int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code %d", e.Code)
+}
+
+// Longest Retry-After honored. A misconfigured or hostile upstream could
+// otherwise park a feed for days with one header; past this the breaker
+// and normal polling take over again.
+const maxRetryAfter = 5 * time.Minute
+
+// parseRetryAfter reads a Retry-After value, either delay seconds or an
+// HTTP date, clamped to maxRetryAfter. Zero means absent or unparseable.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(min(secs, int(maxRetryAfter/time.Second))) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+	return min(max(d, 0), maxRetryAfter)
+}
+
+// ErrorCategory buckets a fetch error for metrics; nil maps to "".
+func ErrorCategory(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var (
+		statusErr *StatusError
+		parseErr  *ParseError
+		dnsErr    *net.DNSError
+		netErr    net.Error
+		opErr     *net.OpError
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		return ErrCategoryHTTPStatus
+	case errors.Is(err, ErrFeedTooLarge):
+		return ErrCategoryTooLarge
+	case errors.Is(err, ErrNonProtobuf):
+		return ErrCategoryNonProtobuf
+	case errors.As(err, &parseErr):
+		return ErrCategoryParse
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrCategoryTimeout
+	case errors.As(err, &dnsErr):
+		return ErrCategoryDNS
+	case errors.As(err, &opErr):
+		return ErrCategoryConnection
+	}
+	return ErrCategoryOther
+}
@@ -0,0 +1,158 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"garbage", 0},
+		{"-5", 0},
+		{"30", 30 * time.Second},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		// Clamped
+		{"86400", maxRetryAfter},
+		{"99999999999999999", maxRetryAfter},
+		{now.Add(72 * time.Hour).Format(http.TimeFormat), maxRetryAfter},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.in, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFetcherHonorsRetryAfter(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(buildFeed(t, time.Now(), []testTrip{{id: "t1", route: "L", stops: []string{"L08N"}, in: []time.Duration{3 * time.Minute}}}))
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, "feeds:\n  L: "+srv.URL+"\n")
+	f, cache := newTestFetcher(t, cfg)
+	ctx := context.Background()
+
+	res := f.FetchOnce(ctx)
+	if res.Feeds["L"] != "status code 429" {
+		t.Fatalf("first cycle: feed L %q, want status code 429", res.Feeds["L"])
+	}
+	if st := f.Status()[0]; st.LastErrorCategory != ErrCategoryHTTPStatus {
+		t.Errorf("429 categorized as %q", st.LastErrorCategory)
+	}
+
+	// Within the delay the feed isn't contacted at all
+	if res := f.FetchOnce(ctx); res.Feeds["L"] != "throttled" {
+		t.Errorf("inside Retry-After: feed L %q, want throttled", res.Feeds["L"])
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream hit %d times inside Retry-After, want 1", n)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if res := f.FetchOnce(ctx); res.Feeds["L"] != "ok" {
+		t.Fatalf("after Retry-After: feed L %q, want ok", res.Feeds["L"])
+	}
+	if got := cache.GetForStops(map[string]bool{"L08": true}); len(got) != 1 {
+		t.Errorf("retried fetch cached %d arrivals at L08, want 1", len(got))
+	}
+}
+
+func TestErrorCategoriesFromInducedFailures(t *testing.T) {
+	handler := func(fn http.HandlerFunc) string {
+		srv := httptest.NewServer(fn)
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	release := make(chan struct{})
+	defer close(release)
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"refused", closed.URL, ErrCategoryConnection},
+		{"dns", "http://feed.invalid/", ErrCategoryDNS},
+		{"timeout", handler(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}), ErrCategoryTimeout},
+		{"503", handler(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}), ErrCategoryHTTPStatus},
+		{"garbage", handler(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.Write([]byte{0xff, 0xff, 0xff, 0xff})
+		}), ErrCategoryParse},
+		{"html", handler(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		}), ErrCategoryNonProtobuf},
+	}
+
+	f, _ := newTestFetcher(t, loadTestConfig(t, "{}"))
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, _, err := f.fetchURL(ctx, tt.url)
+		cancel()
+		if got := ErrorCategory(err); got != tt.want {
+			t.Errorf("%s: category %q (%v), want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	if got := ErrorCategory(nil); got != "" {
+		t.Errorf("nil error categorized %q", got)
+	}
+	if got := ErrorCategory(errors.New("boom")); got != ErrCategoryOther {
+		t.Errorf("plain error categorized %q, want %q", got, ErrCategoryOther)
+	}
+}
+
+func TestFetchStatsCountsPerCategory(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= 2 {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	}))
+	defer srv.Close()
+
+	f, _ := newTestFetcher(t, loadTestConfig(t, "feeds:\n  L: "+srv.URL+"\n"))
+	for i := 0; i < 3; i++ {
+		f.FetchOnce(context.Background())
+	}
+	want := map[string]int64{ErrCategoryHTTPStatus: 2, ErrCategoryParse: 1}
+	if got := f.FetchStats(false)["L"].Errors; !maps.Equal(got, want) {
+		t.Errorf("errors = %v, want %v", got, want)
+	}
+	if st := f.Status()[0]; st.LastErrorCategory != ErrCategoryParse {
+		t.Errorf("last error category %q, want %q", st.LastErrorCategory, ErrCategoryParse)
+	}
+}
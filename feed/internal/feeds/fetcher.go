@@ -1,10 +1,14 @@
 package feeds
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,97 +17,365 @@ import (
 )
 
 type FeedFetcher struct {
-	feeds      map[string]string // feed name -> URL
-	interval   time.Duration
-	cache      *ArrivalCache
-	stationDB  *stations.StationDB
-	httpClient *http.Client
-	broadcast  chan struct{}
+	feeds         map[string]config.FeedURLs // feed name -> URL and fallbacks
+	interval      time.Duration
+	quiet         config.QuietHoursConfig
+	location      *time.Location
+	cacheTTL      time.Duration
+	userAgent     string
+	maxBytes      int64
+	maxFeedAge    time.Duration
+	cache         *ArrivalCache
+	stationDB     *stations.Holder
+	httpClient    *http.Client
+	notifier      *Notifier
+	parseOpts     ParseOptions
+	clearDisabled bool
+
+	mu           sync.Mutex
+	lastArrivals map[string]map[string][]Arrival // feed name -> last successful parse
+	status       map[string]*FeedStatus
+	breakers     map[string]*circuitBreaker
+	counters     map[string]*fetchCounters
+	disabled     map[string]bool      // toggled at runtime via SetEnabled
+	retryAt      map[string]time.Time // Retry-After from a throttled feed
+
+	refresh chan chan RefreshResult
+	ready   chan struct{} // closed once the initial fetch is in the cache
+}
+
+// RefreshResult summarizes one fetch cycle: each feed maps to "ok",
+// "skipped" (circuit open), "disabled", "throttled" (waiting out a
+// Retry-After) or its error.
+type RefreshResult struct {
+	Duration string            `json:"duration"`
+	Feeds    map[string]string `json:"feeds"`
+	Stops    int               `json:"stops"`
 }
 
-func NewFeedFetcher(cfg *config.Config, cache *ArrivalCache, db *stations.StationDB, broadcast chan struct{}) *FeedFetcher {
-	return &FeedFetcher{
+func NewFeedFetcher(cfg *config.Config, cache *ArrivalCache, stationDB *stations.Holder, static *stations.StaticGTFS, notifier *Notifier) *FeedFetcher {
+	f := &FeedFetcher{
 		feeds:      cfg.Feeds,
 		interval:   cfg.Polling.Interval,
+		quiet:      cfg.Polling.QuietHours,
+		location:   cfg.Location,
+		cacheTTL:   cfg.Polling.CacheTTL,
+		userAgent:  cfg.Polling.UserAgent,
+		maxBytes:   cfg.Polling.MaxFeedBytes,
+		maxFeedAge: cfg.Polling.MaxFeedAge,
 		cache:      cache,
-		stationDB:  db,
-		httpClient: &http.Client{Timeout: 10 * time.Second},
-		broadcast:  broadcast,
+		stationDB:  stationDB,
+		httpClient: newHTTPClient(),
+		notifier:   notifier,
+		parseOpts: ParseOptions{
+			DirectionOverrides: cfg.DirectionOverrides,
+			Location:           cfg.Location,
+			Static:             static,
+			ArrivingWithin:     cfg.Status.Arriving,
+			ApproachingWithin:  cfg.Status.Approaching,
+			UseFeedClock:       cfg.Polling.UseFeedClock,
+			DirectionStrategy:  cfg.DirectionStrategy,
+			StopKey:            StopKeyFunc(cfg.StopKey),
+		},
+		lastArrivals:  make(map[string]map[string][]Arrival),
+		status:        make(map[string]*FeedStatus),
+		breakers:      make(map[string]*circuitBreaker),
+		counters:      make(map[string]*fetchCounters),
+		disabled:      make(map[string]bool),
+		retryAt:       make(map[string]time.Time),
+		clearDisabled: cfg.Polling.ClearDisabledFeeds,
+		refresh:       make(chan chan RefreshResult),
+		ready:         make(chan struct{}),
+	}
+	for name := range cfg.Feeds {
+		f.breakers[name] = newCircuitBreaker(cfg.Polling.BreakerThreshold, cfg.Polling.BreakerCooldown)
 	}
+	return f
+}
+
+// newHTTPClient also serves file:// feed URLs, for replaying saved feeds.
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
 }
 
 func (f *FeedFetcher) Start(ctx context.Context) {
 	// Initial fetch
-	f.fetchAll()
+	f.fetchAll(ctx)
+	close(f.ready)
+
+	timer := time.NewTimer(f.intervalAt(time.Now()))
+	defer timer.Stop()
 
-	ticker := time.NewTicker(f.interval)
-	defer ticker.Stop()
+	// Eviction only runs when a TTL is configured; a nil channel never fires
+	var evict <-chan time.Time
+	if f.cacheTTL > 0 {
+		evictTicker := time.NewTicker(f.interval)
+		defer evictTicker.Stop()
+		evict = evictTicker.C
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			f.fetchAll()
+		case <-timer.C:
+			f.fetchAll(ctx)
+			timer.Reset(f.intervalAt(time.Now()))
+		case reply := <-f.refresh:
+			reply <- f.fetchAll(ctx)
+			timer.Reset(f.intervalAt(time.Now()))
+		case <-evict:
+			if n := f.cache.Evict(f.cacheTTL); n > 0 {
+				fmt.Printf("Evicted %d stale stops from cache\n", n)
+			}
 		}
 	}
 }
 
-func (f *FeedFetcher) fetchAll() {
-	var wg sync.WaitGroup
+// Ready is closed once the initial fetch cycle has filled the cache.
+func (f *FeedFetcher) Ready() <-chan struct{} {
+	return f.ready
+}
 
-	// Temporary map to collect all results before updating cache
-	// Actually, cache.Update takes a map, so we can build one big map
-	// or update incrementally.
-	// Since threads are disjoint, we can produce local maps and then merge.
+// intervalAt is the polling interval in effect at t: the quiet-hours
+// interval inside the configured window, the regular one otherwise. The
+// cache keeps serving its last data either way.
+func (f *FeedFetcher) intervalAt(t time.Time) time.Duration {
+	loc := f.location
+	if loc == nil {
+		loc = time.Local
+	}
+	if f.quiet.Contains(t.In(loc)) {
+		return f.quiet.Interval
+	}
+	return f.interval
+}
+
+// Refresh runs a fetch cycle immediately on the Start loop and returns its
+// summary; the regular interval restarts from this fetch.
+func (f *FeedFetcher) Refresh(ctx context.Context) (RefreshResult, error) {
+	reply := make(chan RefreshResult, 1)
+	select {
+	case f.refresh <- reply:
+	case <-ctx.Done():
+		return RefreshResult{}, ctx.Err()
+	}
 
-	// Safer: Mutex protected map or channel.
+	select {
+	case res := <-reply:
+		return res, nil
+	case <-ctx.Done():
+		return RefreshResult{}, ctx.Err()
+	}
+}
+
+// frozen reports whether a feed's last good parse carried a header
+// timestamp older than the configured max age. Must be called with f.mu held.
+func (f *FeedFetcher) frozen(name string, now time.Time) bool {
+	st, ok := f.status[name]
+	if !ok || f.maxFeedAge <= 0 || st.Stats.FeedTimestamp == 0 {
+		return false
+	}
+	return now.Sub(time.Unix(st.Stats.FeedTimestamp, 0)) > f.maxFeedAge
+}
+
+// frozenStops collects the stops served by frozen feeds. Must be called
+// with f.mu held.
+func (f *FeedFetcher) frozenStops(now time.Time) map[string]bool {
+	stops := make(map[string]bool)
+	for name := range f.feeds {
+		if !f.frozen(name, now) {
+			continue
+		}
+		for stopID := range f.lastArrivals[name] {
+			stops[stopID] = true
+		}
+	}
+	return stops
+}
+
+// FetchOnce runs a single fetch cycle outside the Start loop, e.g. for
+// -validate. It must not be called while Start is running.
+func (f *FeedFetcher) FetchOnce(ctx context.Context) RefreshResult {
+	return f.fetchAll(ctx)
+}
+
+// fetchAll runs one fetch cycle. If ctx is cancelled mid-cycle it returns
+// immediately without touching the cache or the breakers; in-flight
+// requests are cancelled with it and their results land in the buffered
+// channel and are dropped.
+func (f *FeedFetcher) fetchAll(ctx context.Context) RefreshResult {
+	// Since threads are disjoint, we can produce local maps and then merge.
 	// Let's use a channel to collect results.
 
 	type result struct {
+		name     string
+		url      string
 		arrivals map[string][]Arrival
+		stats    ParseStats
+		latency  time.Duration
 		err      error
 	}
 
+	// Buffered for every feed so senders never block, even after an early
+	// return stops reading
 	results := make(chan result, len(f.feeds))
 
-	for name, url := range f.feeds {
-		wg.Add(1)
-		go func(n, u string) {
-			defer wg.Done()
-			arrs, err := f.fetchOne(u)
-			results <- result{arrivals: arrs, err: err}
-		}(name, url)
+	summary := RefreshResult{Feeds: make(map[string]string, len(f.feeds))}
+
+	f.mu.Lock()
+	start := time.Now()
+	active := make(map[string]config.FeedURLs, len(f.feeds))
+	for name, urls := range f.feeds {
+		if f.disabled[name] {
+			summary.Feeds[name] = "disabled"
+		} else if start.Before(f.retryAt[name]) {
+			summary.Feeds[name] = "throttled"
+		} else if f.breakers[name].allow(start) {
+			active[name] = urls
+		} else {
+			summary.Feeds[name] = "skipped"
+		}
+	}
+	f.mu.Unlock()
+
+	for name, urls := range active {
+		go func(n string, urls []string) {
+			began := time.Now()
+			arrs, stats, url, err := f.fetchOne(ctx, urls)
+			results <- result{name: n, url: url, arrivals: arrs, stats: stats, latency: time.Since(began), err: err}
+		}(name, urls)
+	}
+
+	collected := make([]result, 0, len(active))
+	for range active {
+		select {
+		case res := <-results:
+			collected = append(collected, res)
+		case <-ctx.Done():
+			f.abandonProbes(active)
+			return summary
+		}
+	}
+	// Results that arrived as ctx was cancelled are its errors, not the
+	// feeds'
+	if ctx.Err() != nil {
+		f.abandonProbes(active)
+		return summary
 	}
 
-	wg.Wait()
-	close(results)
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
 	// Merge results
+	now := time.Now()
 	allArrivals := make(map[string][]Arrival)
-	for res := range results {
+	var retained []string // feeds whose body didn't parse this cycle
+	for _, res := range collected {
+		f.recordStatus(res.name, now, res.url, res.stats, res.err)
+		f.recordFetch(res.name, res.latency, res.err)
+		summary.Feeds[res.name] = "ok"
 		if res.err != nil {
-			fmt.Printf("Error fetching feed: %v\n", res.err)
+			summary.Feeds[res.name] = res.err.Error()
+			f.breakers[res.name].failure(now)
+			// Upstream asked us to back off; skip this feed until then
+			// (other feeds keep the normal interval)
+			var statusErr *StatusError
+			if errors.As(res.err, &statusErr) && statusErr.RetryAfter > 0 {
+				f.retryAt[res.name] = now.Add(statusErr.RetryAfter)
+				fmt.Printf("Feed %s throttled, skipping it until %s (%s)\n", res.name,
+					f.retryAt[res.name].Format(time.TimeOnly), statusErr.RetryAfter)
+			}
+			var parseErr *ParseError
+			if !errors.As(res.err, &parseErr) {
+				fmt.Printf("Error fetching feed %s [%s]: %v\n", res.name, ErrorCategory(res.err), res.err)
+				continue
+			}
+			fmt.Printf("Error parsing feed %s, keeping previous data: %v\n", res.name, res.err)
+			retained = append(retained, res.name)
 			continue
 		}
+		f.breakers[res.name].success()
+		f.lastArrivals[res.name] = res.arrivals
 		for stopID, list := range res.arrivals {
 			allArrivals[stopID] = append(allArrivals[stopID], list...)
 		}
 	}
 
+	// A truncated or corrupt body shouldn't wipe out a feed's share of
+	// stops that other feeds refreshed. Stops it serves alone are left out
+	// of the update, so they keep their old refresh time and history and
+	// cache_ttl still evicts them; shared stops only carry its last good
+	// arrivals for cache_ttl after that parse.
+	for _, name := range retained {
+		if f.cacheTTL > 0 && now.Sub(f.status[name].LastSuccess) > f.cacheTTL {
+			continue
+		}
+		for stopID, list := range f.lastArrivals[name] {
+			if _, ok := allArrivals[stopID]; ok {
+				allArrivals[stopID] = append(allArrivals[stopID], list...)
+			}
+		}
+	}
+
+	// Disabled feeds' stops are left alone in the cache unless configured
+	// to clear them; that happens once, on the first cycle after disabling
+	if f.clearDisabled {
+		for name := range f.disabled {
+			for stopID := range f.lastArrivals[name] {
+				if _, ok := allArrivals[stopID]; !ok {
+					allArrivals[stopID] = nil
+				}
+			}
+			delete(f.lastArrivals, name)
+		}
+	}
+
+	f.cache.SetStaleStops(f.frozenStops(now))
 	f.cache.Update(allArrivals)
 
-	// Notify hub
-	select {
-	case f.broadcast <- struct{}{}:
-	default:
+	// Wake the SSE hub and any long-poll requests
+	f.notifier.Notify()
+
+	summary.Stops = len(allArrivals)
+	summary.Duration = time.Since(start).Round(time.Millisecond).String()
+	return summary
+}
+
+// abandonProbes resets the breakers of a cancelled cycle's feeds, so a
+// half-open probe with no outcome doesn't leave its breaker stuck.
+func (f *FeedFetcher) abandonProbes(active map[string]config.FeedURLs) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name := range active {
+		f.breakers[name].abandon()
+	}
+}
+
+// fetchOne tries a feed's URLs in order and returns the first success
+// along with the URL that served it, or the last URL's error.
+func (f *FeedFetcher) fetchOne(ctx context.Context, urls []string) (map[string][]Arrival, ParseStats, string, error) {
+	var err error
+	for i, url := range urls {
+		var arrs map[string][]Arrival
+		var stats ParseStats
+		arrs, stats, err = f.fetchURL(ctx, url)
+		if err == nil {
+			return arrs, stats, url, nil
+		}
+		if i < len(urls)-1 {
+			fmt.Printf("Feed URL %s failed, trying fallback: %v\n", url, err)
+		}
 	}
+	return nil, ParseStats{}, "", err
 }
 
-func (f *FeedFetcher) fetchOne(url string) (map[string][]Arrival, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func (f *FeedFetcher) fetchURL(ctx context.Context, url string) (map[string][]Arrival, ParseStats, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, ParseStats{}, err
 	}
 
 	// Headers? Usually required for MTA? API Key?
@@ -112,21 +384,105 @@ func (f *FeedFetcher) fetchOne(url string) (map[string][]Arrival, error) {
 	// but the URLs look like the public proxied ones or the new api.
 	// If they fail, we might need a key.
 	// But let's assume they work as provided in spec.
+	req.Header.Set("User-Agent", f.userAgent)
 
 	resp, err := f.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, ParseStats{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+		statusErr := &StatusError{Code: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			statusErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return nil, ParseStats{}, statusErr
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	// The transport only decompresses transparently when it added
+	// Accept-Encoding itself (and then strips this header), so anything
+	// still marked gzip here needs decoding before protobuf parsing.
+	var body io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, ParseStats{}, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// Read one byte past the limit to tell "exactly at" from "over"
+	data, err := io.ReadAll(io.LimitReader(body, f.maxBytes+1))
 	if err != nil {
-		return nil, err
+		return nil, ParseStats{}, err
+	}
+	if int64(len(data)) > f.maxBytes {
+		return nil, ParseStats{}, fmt.Errorf("%w: over %d bytes", ErrFeedTooLarge, f.maxBytes)
 	}
 
-	return ParseFeed(data, f.stationDB)
+	if err := checkProtobuf(resp.Header.Get("Content-Type"), data); err != nil {
+		return nil, ParseStats{}, err
+	}
+
+	return ParseFeedWithStats(data, f.stationDB.Load(), f.parseOpts)
+}
+
+var ErrUnknownFeed = errors.New("unknown feed")
+
+// SetEnabled turns polling of a configured feed on or off until the next
+// restart. It takes effect from the next fetch cycle.
+func (f *FeedFetcher) SetEnabled(name string, enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.feeds[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownFeed, name)
+	}
+	if enabled {
+		delete(f.disabled, name)
+	} else {
+		f.disabled[name] = true
+	}
+	return nil
+}
+
+var ErrFeedTooLarge = errors.New("feed response too large")
+
+var ErrNonProtobuf = errors.New("feed returned non-protobuf content")
+
+// Body prefixes of error pages and API errors, matched case-insensitively
+// after leading whitespace. They're whole tokens rather than single bytes:
+// a FeedMessage starts with 0x0A ('\n') then the header length, which can
+// happen to be '<' or '{'.
+var markupPrefixes = []string{"<!doctype", "<html", "<?xml", "<head", "<body", `{"`}
+
+// checkProtobuf catches upstream error pages served with a 200, which would
+// otherwise surface as a confusing protobuf decode error.
+func checkProtobuf(contentType string, data []byte) error {
+	ct := strings.ToLower(contentType)
+	textual := strings.HasPrefix(ct, "text/") || strings.Contains(ct, "json") || strings.Contains(ct, "html")
+	if !textual && !looksLikeMarkup(data) {
+		return nil
+	}
+
+	trimmed := bytes.TrimSpace(data)
+
+	snippet := trimmed
+	if len(snippet) > 120 {
+		snippet = snippet[:120]
+	}
+	return fmt.Errorf("%w (content-type %q): %q", ErrNonProtobuf, contentType, snippet)
+}
+
+func looksLikeMarkup(data []byte) bool {
+	head := bytes.TrimLeft(data[:min(len(data), 64)], " \t\r\n")
+	head = bytes.ToLower(head)
+	for _, p := range markupPrefixes {
+		if bytes.HasPrefix(head, []byte(p)) {
+			return true
+		}
+	}
+	return false
 }
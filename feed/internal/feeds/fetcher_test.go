@@ -0,0 +1,641 @@
+package feeds
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFetchRejectsHTMLWith200(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<!DOCTYPE html>\n<html><body>Service Unavailable</body></html>")
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, "feeds:\n  L: "+srv.URL+"\n")
+	f, _ := newTestFetcher(t, cfg)
+
+	_, _, err := f.fetchURL(context.Background(), srv.URL)
+	if !errors.Is(err, ErrNonProtobuf) {
+		t.Fatalf("fetchURL error = %v, want ErrNonProtobuf", err)
+	}
+	if got := ErrorCategory(err); got != ErrCategoryNonProtobuf {
+		t.Errorf("ErrorCategory = %q, want %q", got, ErrCategoryNonProtobuf)
+	}
+
+	f.FetchOnce(context.Background())
+	stats := f.FetchStats(false)["L"]
+	if stats.Errors[ErrCategoryNonProtobuf] != 1 {
+		t.Errorf("FetchStats errors = %v, want one %s", stats.Errors, ErrCategoryNonProtobuf)
+	}
+}
+
+func TestCheckProtobufMarkup(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{"html page", "application/octet-stream", "  <!DOCTYPE html><html></html>", true},
+		{"html by content type", "text/html", "Service Unavailable", true},
+		{"json error", "application/x-protobuf", `{"error":"forbidden"}`, true},
+		{"xml error", "", "\n<?xml version=\"1.0\"?><Error/>", true},
+		{"header length '<'", "application/x-protobuf", "\n<\n\x032.0", false},
+		{"header length '{'", "", "\n{\n\x032.0", false},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkProtobuf(tt.contentType, []byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkProtobuf(%q, %q) = %v, wantErr %v", tt.contentType, tt.body, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// A FeedMessage starts with the header's tag (0x0A, '\n') and length, so a
+// 60- or 123-byte header encodes as "\n<" or "\n{"; the old check trimmed
+// the newline and mistook those feeds for markup.
+func TestCheckProtobufHeaderLengthLooksLikeMarkup(t *testing.T) {
+	for _, headerLen := range []int{60, 123} {
+		// Header = version tag + length byte + version string
+		version := strings.Repeat("2", headerLen-2)
+		msg := &gtfs.FeedMessage{Header: &gtfs.FeedHeader{GtfsRealtimeVersion: proto.String(version)}}
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != '\n' || int(data[1]) != headerLen {
+			t.Fatalf("encoded prefix %q, want header length %d", data[:2], headerLen)
+		}
+		if err := checkProtobuf("application/octet-stream", data); err != nil {
+			t.Errorf("header length %d: checkProtobuf rejected a valid feed: %v", headerLen, err)
+		}
+	}
+}
+
+// feedServer serves whatever body currently holds, as protobuf.
+func feedServer(t *testing.T, body *[]byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(*body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchCorruptFeedKeepsPreviousData(t *testing.T) {
+	// L08 is served by both feeds; L06 only by L
+	good := buildFeed(t, time.Now(), []testTrip{{id: "t1", route: "L", stops: []string{"L08N", "L06N"}, in: []time.Duration{2 * time.Minute, 4 * time.Minute}}})
+	lBody := good
+	other := buildFeed(t, time.Now(), []testTrip{{id: "m1", route: "M", stops: []string{"L08S"}, in: []time.Duration{3 * time.Minute}}})
+	lSrv := feedServer(t, &lBody)
+	otherSrv := feedServer(t, &other)
+
+	cfg := loadTestConfig(t, "polling:\n  cache_ttl: 300ms\nfeeds:\n  L: "+lSrv.URL+"\n  M: "+otherSrv.URL+"\n")
+	f, cache := newTestFetcher(t, cfg)
+	cache.EnableHistory(10)
+	ctx := context.Background()
+	trips := func(stop string) []string {
+		var ids []string
+		for _, a := range cache.GetForStops(map[string]bool{stop: true}) {
+			ids = append(ids, a.TripID)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+
+	if res := f.FetchOnce(ctx); res.Feeds["L"] != "ok" || res.Feeds["M"] != "ok" {
+		t.Fatalf("good feeds: %v", res.Feeds)
+	}
+
+	// Cut mid-message, the way a dropped connection leaves it
+	lBody = good[:len(good)-7]
+	res := f.FetchOnce(ctx)
+	if res.Feeds["L"] == "ok" {
+		t.Fatal("truncated feed parsed cleanly")
+	}
+	for _, st := range f.Status() {
+		if st.Name == "L" && st.LastErrorCategory != ErrCategoryParse {
+			t.Errorf("truncated feed categorized %q, want %q", st.LastErrorCategory, ErrCategoryParse)
+		}
+	}
+	// M's update to the shared stop keeps L's last good arrivals there
+	if got := trips("L08"); !slices.Equal(got, []string{"m1", "t1"}) {
+		t.Errorf("L08 after a corrupt L fetch: %v, want [m1 t1]", got)
+	}
+	// L's own stop is left as it was, not re-recorded as a new snapshot
+	if got := trips("L06"); !slices.Equal(got, []string{"t1"}) {
+		t.Errorf("L06 after a corrupt L fetch: %v, want [t1]", got)
+	}
+	if n := len(cache.History("L06")); n != 1 {
+		t.Errorf("L06 has %d history snapshots, want 1", n)
+	}
+
+	// Past cache_ttl the retained arrivals expire like any others
+	time.Sleep(350 * time.Millisecond)
+	f.FetchOnce(ctx)
+	cache.Evict(cfg.Polling.CacheTTL)
+	if got := trips("L08"); !slices.Equal(got, []string{"m1"}) {
+		t.Errorf("L08 past cache_ttl: %v, want only M's m1", got)
+	}
+	if got := trips("L06"); len(got) != 0 {
+		t.Errorf("L06 past cache_ttl: %v, want it evicted", got)
+	}
+
+	var parseErr *ParseError
+	_, err := ParseFeed([]byte{0x0a, 0xff, 0xff, 0xff}, testStationDB(t), ParseOptions{})
+	if !errors.As(err, &parseErr) {
+		t.Errorf("ParseFeed(garbage) = %v, want a *ParseError", err)
+	}
+}
+
+func TestFetchGzippedFeed(t *testing.T) {
+	data := buildFeed(t, time.Now(), []testTrip{{id: "t1", route: "L", stops: []string{"L08S"}, in: []time.Duration{3 * time.Minute}}})
+	// Always gzipped, asked for or not, as some CDNs do
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(data)
+		gz.Close()
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, "feeds:\n  L: "+srv.URL+"\n")
+	f, _ := newTestFetcher(t, cfg)
+
+	// The default transport asks for gzip and decodes it itself; with
+	// compression disabled the body arrives still marked gzip and the
+	// fetcher decodes it
+	plain := http.DefaultTransport.(*http.Transport).Clone()
+	plain.DisableCompression = true
+	for name, client := range map[string]*http.Client{
+		"transport": f.httpClient,
+		"fetcher":   {Transport: plain},
+	} {
+		f.httpClient = client
+		arrivals, _, err := f.fetchURL(context.Background(), srv.URL)
+		if err != nil {
+			t.Errorf("%s decoding: %v", name, err)
+			continue
+		}
+		if len(arrivals["L08"]) != 1 {
+			t.Errorf("%s decoding: arrivals[L08] = %v, want one arrival", name, arrivals["L08"])
+		}
+	}
+}
+
+func TestFetchSendsUserAgent(t *testing.T) {
+	got := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(buildFeed(t, time.Now(), nil))
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct{ yaml, env, want string }{
+		{"", "", "glance-mta/1.0"},
+		{"polling:\n  user_agent: my-board/2.0 (ops@example.com)\n", "", "my-board/2.0 (ops@example.com)"},
+		{"polling:\n  user_agent: my-board/2.0\n", "from-env/3.0", "from-env/3.0"},
+	} {
+		t.Setenv("FEED_USER_AGENT", tt.env)
+		cfg := loadTestConfig(t, tt.yaml+"feeds:\n  L: "+srv.URL+"\n")
+		f, _ := newTestFetcher(t, cfg)
+		f.FetchOnce(context.Background())
+		if ua := <-got; ua != tt.want {
+			t.Errorf("User-Agent %q, want %q", ua, tt.want)
+		}
+	}
+}
+
+func TestQuietHoursInterval(t *testing.T) {
+	f, cache := newTestFetcher(t, loadTestConfig(t, `
+timezone: America/New_York
+polling:
+  interval: 30s
+  quiet_hours:
+    start: "01:00"
+    end: "05:00"
+    interval: 10m
+`))
+	ny, _ := time.LoadLocation("America/New_York")
+
+	// Walk a fake clock the way Start schedules polls, from just before
+	// the window to just after it
+	clock := time.Date(2026, 3, 2, 0, 58, 0, 0, ny)
+	end := time.Date(2026, 3, 2, 5, 2, 0, 0, ny)
+	var quietPolls int
+	var intoQuiet, outOfQuiet time.Time
+	prev := f.intervalAt(clock)
+	for clock.Before(end) {
+		d := f.intervalAt(clock)
+		switch {
+		case d == 10*time.Minute:
+			quietPolls++
+			if prev != d {
+				intoQuiet = clock
+			}
+		case d == 30*time.Second:
+			if prev != d {
+				outOfQuiet = clock
+			}
+		default:
+			t.Fatalf("interval %s at %s", d, clock.Format(time.TimeOnly))
+		}
+		prev = d
+		// The clock in UTC must give the same answer: the window is local
+		if got := f.intervalAt(clock.UTC()); got != d {
+			t.Fatalf("at %s: %s in NY but %s in UTC", clock.Format(time.TimeOnly), d, got)
+		}
+		clock = clock.Add(d)
+	}
+
+	if !intoQuiet.Equal(time.Date(2026, 3, 2, 1, 0, 0, 0, ny)) {
+		t.Errorf("quiet interval started at %s, want 01:00", intoQuiet.Format(time.TimeOnly))
+	}
+	if !outOfQuiet.Equal(time.Date(2026, 3, 2, 5, 0, 0, 0, ny)) {
+		t.Errorf("regular interval resumed at %s, want 05:00", outOfQuiet.Format(time.TimeOnly))
+	}
+	if quietPolls != 24 {
+		t.Errorf("%d polls in the 4h window, want 24 at 10m", quietPolls)
+	}
+
+	// Cached data is still served while polling slows down
+	cache.Update(map[string][]Arrival{"L08": {{StopID: "L08", Minutes: 3}}})
+	if got := cache.GetForStops(map[string]bool{"L08": true}); len(got) != 1 {
+		t.Errorf("cache during quiet hours: %v", got)
+	}
+}
+
+func TestQuietHoursWrapMidnight(t *testing.T) {
+	f, _ := newTestFetcher(t, loadTestConfig(t, `
+timezone: America/New_York
+polling:
+  interval: 30s
+  quiet_hours:
+    start: "23:30"
+    end: "05:00"
+    interval: 5m
+`))
+	ny, _ := time.LoadLocation("America/New_York")
+	tests := []struct {
+		at   string
+		want time.Duration
+	}{
+		{"23:29", 30 * time.Second},
+		{"23:30", 5 * time.Minute},
+		{"00:00", 5 * time.Minute},
+		{"04:59", 5 * time.Minute},
+		{"05:00", 30 * time.Second},
+		{"12:00", 30 * time.Second},
+	}
+	for _, tt := range tests {
+		clock, _ := time.ParseInLocation("2006-01-02 15:04", "2026-03-02 "+tt.at, ny)
+		if got := f.intervalAt(clock); got != tt.want {
+			t.Errorf("%s: interval %s, want %s", tt.at, got, tt.want)
+		}
+	}
+}
+
+// countingServer serves body and counts requests.
+func countingServer(t *testing.T, body []byte, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSetEnabledSkipsFeed(t *testing.T) {
+	now := time.Now()
+	in := []time.Duration{2 * time.Minute}
+	var lHits, gHits atomic.Int32
+	lSrv := countingServer(t, buildFeed(t, now, []testTrip{{id: "l1", route: "L", stops: []string{"L08N"}, in: in}}), &lHits)
+	gSrv := countingServer(t, buildFeed(t, now, []testTrip{{id: "g1", route: "G", stops: []string{"G29N"}, in: in}}), &gHits)
+	both := map[string]bool{"L08": true, "G29": true}
+
+	for _, clear := range []bool{false, true} {
+		t.Run(fmt.Sprintf("clear_disabled_feeds=%t", clear), func(t *testing.T) {
+			lHits.Store(0)
+			gHits.Store(0)
+			cfg := loadTestConfig(t, fmt.Sprintf("polling:\n  clear_disabled_feeds: %t\nfeeds:\n  L: %s\n  G: %s\n", clear, lSrv.URL, gSrv.URL))
+			f, cache := newTestFetcher(t, cfg)
+			ctx := context.Background()
+
+			f.FetchOnce(ctx)
+			if err := f.SetEnabled("G", false); err != nil {
+				t.Fatal(err)
+			}
+			res := f.FetchOnce(ctx)
+			if res.Feeds["G"] != "disabled" || res.Feeds["L"] != "ok" {
+				t.Errorf("cycle with G disabled: %v", res.Feeds)
+			}
+			if lHits.Load() != 2 || gHits.Load() != 1 {
+				t.Errorf("requests: L %d, G %d; want 2 and 1 (G skipped)", lHits.Load(), gHits.Load())
+			}
+			for _, st := range f.Status() {
+				if st.Enabled != (st.Name == "L") {
+					t.Errorf("status %s enabled=%t", st.Name, st.Enabled)
+				}
+			}
+
+			want := 2
+			if clear {
+				want = 1
+			}
+			if got := cache.GetForStops(both); len(got) != want {
+				t.Errorf("%d arrivals cached after disabling G, want %d", len(got), want)
+			}
+
+			if err := f.SetEnabled("G", true); err != nil {
+				t.Fatal(err)
+			}
+			if res := f.FetchOnce(ctx); res.Feeds["G"] != "ok" || gHits.Load() != 2 {
+				t.Errorf("re-enabled G: %q after %d requests", res.Feeds["G"], gHits.Load())
+			}
+			if got := cache.GetForStops(both); len(got) != 2 {
+				t.Errorf("%d arrivals cached after re-enabling G, want 2", len(got))
+			}
+		})
+	}
+}
+
+func TestSetEnabledUnknownFeed(t *testing.T) {
+	f, _ := newTestFetcher(t, loadTestConfig(t, "feeds:\n  L: http://127.0.0.1:1/l\n"))
+	if err := f.SetEnabled("SIR", false); !errors.Is(err, ErrUnknownFeed) {
+		t.Errorf("SetEnabled(SIR) = %v, want ErrUnknownFeed", err)
+	}
+}
+
+// hangingServer accepts feed requests and never answers them; it reports
+// each request on started and its cancellation on cancelled.
+func hangingServer(t *testing.T) (srv *httptest.Server, started, cancelled chan struct{}) {
+	t.Helper()
+	started, cancelled = make(chan struct{}, 10), make(chan struct{}, 10)
+	release := make(chan struct{})
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-release:
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		srv.Close()
+	})
+	return srv, started, cancelled
+}
+
+func TestFetchAllCancelledMidFetch(t *testing.T) {
+	fast := buildFeed(t, time.Now(), []testTrip{{id: "g1", route: "G", stops: []string{"G29N"}, in: []time.Duration{2 * time.Minute}}})
+	fastSrv := feedServer(t, &fast)
+	slow, started, cancelled := hangingServer(t)
+
+	cfg := loadTestConfig(t, "feeds:\n  L: "+slow.URL+"\n  G: "+fastSrv.URL+"\n")
+	f, cache := newTestFetcher(t, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan RefreshResult)
+	go func() { done <- f.FetchOnce(ctx) }()
+
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fetchAll still waiting on the hung feed after cancel")
+	}
+
+	// The in-flight request is abandoned, not left to the HTTP timeout
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("hung request was not cancelled")
+	}
+	// A cancelled cycle leaves the cache alone, even for feeds that finished
+	if !cache.UpdatedAt().IsZero() {
+		t.Error("cancelled cycle updated the cache")
+	}
+}
+
+func TestStartReturnsWhenCancelledMidFetch(t *testing.T) {
+	slow, started, _ := hangingServer(t)
+	f, _ := newTestFetcher(t, loadTestConfig(t, "feeds:\n  L: "+slow.URL+"\n"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		f.Start(ctx)
+		close(stopped)
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return promptly after cancel")
+	}
+}
+
+func TestFeedStatusReportsUnknownStops(t *testing.T) {
+	body := buildFeed(t, time.Now(), []testTrip{{id: "t1", route: "L", stops: []string{"L08N", "X99N"}, in: []time.Duration{time.Minute, 2 * time.Minute}}})
+	srv := feedServer(t, &body)
+	f, _ := newTestFetcher(t, loadTestConfig(t, "feeds:\n  L: "+srv.URL+"\n"))
+	f.FetchOnce(context.Background())
+
+	st := f.Status()[0]
+	if len(st.Stats.UnknownStops) != 1 || st.Stats.UnknownStops[0] != "X99" || st.Stats.DroppedUnknownStop != 1 {
+		t.Errorf("status stats = %+v, want X99 recorded", st.Stats)
+	}
+}
+
+func TestFeedStatusReportsFeedAge(t *testing.T) {
+	body := buildFeed(t, time.Now().Add(-90*time.Second), []testTrip{{id: "t1", route: "L", stops: []string{"L08N"}, in: []time.Duration{5 * time.Minute}}})
+	srv := feedServer(t, &body)
+	f, _ := newTestFetcher(t, loadTestConfig(t, "feeds:\n  L: "+srv.URL+"\n"))
+	f.FetchOnce(context.Background())
+
+	if age := f.Status()[0].FeedAge; age < 89 || age > 95 {
+		t.Errorf("feed age = %.1fs, want about 90s", age)
+	}
+}
+
+func TestFrozenHeaderMarksFeedStale(t *testing.T) {
+	now := time.Now()
+	frozen := buildFeed(t, now.Add(-10*time.Minute), []testTrip{{id: "l1", route: "L", stops: []string{"L08N"}, in: []time.Duration{15 * time.Minute}}})
+	fresh := buildFeed(t, now, []testTrip{{id: "g1", route: "G", stops: []string{"G29N"}, in: []time.Duration{5 * time.Minute}}})
+	lSrv, gSrv := feedServer(t, &frozen), feedServer(t, &fresh)
+	f, cache := newTestFetcher(t, loadTestConfig(t, "polling:\n  max_feed_age: 2m\nfeeds:\n  L: "+lSrv.URL+"\n  G: "+gSrv.URL+"\n"))
+	f.FetchOnce(context.Background())
+
+	stale := map[string]bool{}
+	for _, st := range f.Status() {
+		if st.LastError != "" {
+			t.Fatalf("feed %s: %s", st.Name, st.LastError)
+		}
+		stale[st.Name] = st.Stale
+	}
+	if !stale["L"] || stale["G"] {
+		t.Errorf("status stale = %v, want just L", stale)
+	}
+	// The fetch itself is fresh, so only the frozen feed's stops are stale
+	if cache.IsStale() {
+		t.Error("cache stale right after a fetch")
+	}
+	if !cache.IsStaleFor(map[string]bool{"L08": true}) {
+		t.Error("L08, served by the frozen feed, not stale")
+	}
+	if cache.IsStaleFor(map[string]bool{"G29": true}) {
+		t.Error("G29, served by a fresh feed, stale")
+	}
+	if !cache.IsStaleFor(nil) {
+		t.Error("no stops given, but a frozen feed didn't mark the cache stale")
+	}
+
+	// The feed catching up clears it
+	frozen = buildFeed(t, time.Now(), []testTrip{{id: "l1", route: "L", stops: []string{"L08N"}, in: []time.Duration{5 * time.Minute}}})
+	f.FetchOnce(context.Background())
+	if cache.IsStaleFor(map[string]bool{"L08": true}) {
+		t.Error("L08 still stale after the header advanced")
+	}
+	for _, st := range f.Status() {
+		if st.Stale {
+			t.Errorf("feed %s still stale", st.Name)
+		}
+	}
+}
+
+func TestFrozenHeaderCheckDisabled(t *testing.T) {
+	body := buildFeed(t, time.Now().Add(-time.Hour), []testTrip{{id: "l1", route: "L", stops: []string{"L08N"}, in: []time.Duration{65 * time.Minute}}})
+	srv := feedServer(t, &body)
+	f, cache := newTestFetcher(t, loadTestConfig(t, "polling:\n  max_feed_age: 0s\nfeeds:\n  L: "+srv.URL+"\n"))
+	f.FetchOnce(context.Background())
+
+	if f.Status()[0].Stale || cache.IsStaleFor(map[string]bool{"L08": true}) {
+		t.Error("an hour-old header was flagged with max_feed_age 0")
+	}
+}
+
+func TestFeedStatusStopsMapped(t *testing.T) {
+	f, _ := newTestFetcher(t, loadTestConfig(t, "feeds:\n  L: https://example.com/l\n  extra: https://example.com/x\n"))
+	mapped := map[string]int{}
+	for _, st := range f.Status() {
+		mapped[st.Name] = st.StopsMapped
+	}
+	if mapped["L"] != 24 || mapped["extra"] != 0 {
+		t.Errorf("stops_mapped = %v, want L 24 and extra 0", mapped)
+	}
+}
+
+func TestFetchFallbackURL(t *testing.T) {
+	var primaryHits atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer primary.Close()
+	body := buildFeed(t, time.Now(), []testTrip{{id: "t1", route: "L", stops: []string{"L08N"}, in: []time.Duration{2 * time.Minute}}})
+	fallback := feedServer(t, &body)
+
+	f, cache := newTestFetcher(t, loadTestConfig(t, "feeds:\n  L: ["+primary.URL+", "+fallback.URL+"]\n"))
+	if res := f.FetchOnce(context.Background()); res.Feeds["L"] != "ok" {
+		t.Fatalf("feed L %q, want ok from the fallback", res.Feeds["L"])
+	}
+	if got := cache.GetForStops(map[string]bool{"L08": true}); len(got) != 1 {
+		t.Errorf("L08 has %d arrivals, want 1", len(got))
+	}
+	st := f.Status()[0]
+	if st.URL != fallback.URL || st.LastError != "" {
+		t.Errorf("status url %q error %q, want %s and none", st.URL, st.LastError, fallback.URL)
+	}
+
+	// The primary is still tried first every cycle, so it's picked up
+	// again once it recovers
+	f.FetchOnce(context.Background())
+	if n := primaryHits.Load(); n != 2 {
+		t.Errorf("primary tried %d times over two cycles, want 2", n)
+	}
+
+	// With every URL failing, the last one's error is reported
+	fallback.Close()
+	if res := f.FetchOnce(context.Background()); res.Feeds["L"] == "ok" {
+		t.Error("feed L ok with every URL down")
+	}
+	if st := f.Status()[0]; st.LastErrorCategory != ErrCategoryConnection {
+		t.Errorf("all URLs down: category %q, want %q from the last URL", st.LastErrorCategory, ErrCategoryConnection)
+	}
+}
+
+func TestFetchBodyLimit(t *testing.T) {
+	feed := buildFeed(t, time.Now(), []testTrip{{id: "t1", route: "L", stops: []string{"L08N"}, in: []time.Duration{2 * time.Minute}}})
+	body := feed
+	srv := feedServer(t, &body)
+	f, cache := newTestFetcher(t, loadTestConfig(t, fmt.Sprintf("polling:\n  max_feed_bytes: %d\nfeeds:\n  L: %s\n", len(feed), srv.URL)))
+	ctx := context.Background()
+
+	// Exactly at the limit is fine
+	if res := f.FetchOnce(ctx); res.Feeds["L"] != "ok" {
+		t.Fatalf("feed at the limit: %q", res.Feeds["L"])
+	}
+
+	body = append(slices.Clone(feed), make([]byte, 1)...)
+	_, _, err := f.fetchURL(ctx, srv.URL)
+	if !errors.Is(err, ErrFeedTooLarge) {
+		t.Fatalf("one byte over: %v, want ErrFeedTooLarge", err)
+	}
+	f.FetchOnce(ctx)
+	if st := f.Status()[0]; st.LastErrorCategory != ErrCategoryTooLarge {
+		t.Errorf("oversized feed categorized %q, want %q", st.LastErrorCategory, ErrCategoryTooLarge)
+	}
+	if got := cache.GetForStops(map[string]bool{"L08": true}); len(got) != 1 {
+		t.Errorf("oversized fetch left %d arrivals, want the previous one", len(got))
+	}
+}
+
+func TestFetchBodyLimitAfterDecompression(t *testing.T) {
+	// 4 MB of zeros gzips to a few KB; the limit applies to what it inflates to
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(make([]byte, 4<<20))
+		gz.Close()
+	}))
+	defer srv.Close()
+
+	f, _ := newTestFetcher(t, loadTestConfig(t, "polling:\n  max_feed_bytes: 65536\nfeeds:\n  L: "+srv.URL+"\n"))
+	plain := http.DefaultTransport.(*http.Transport).Clone()
+	plain.DisableCompression = true
+	for name, client := range map[string]*http.Client{
+		"transport": f.httpClient,
+		"fetcher":   {Transport: plain},
+	} {
+		f.httpClient = client
+		if _, _, err := f.fetchURL(context.Background(), srv.URL); !errors.Is(err, ErrFeedTooLarge) {
+			t.Errorf("%s decoding: %v, want ErrFeedTooLarge", name, err)
+		}
+	}
+}
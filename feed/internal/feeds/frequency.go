@@ -0,0 +1,110 @@
+package feeds
+
+import "time"
+
+// Width of the buckets /analytics/frequency reports
+const FrequencyBucket = 5 * time.Minute
+
+type FrequencyCount struct {
+    Start time.Time `json:"start"`
+    Count int       `json:"count"`
+}
+
+// frequencyKey identifies one train's call at one stop.
+type frequencyKey struct {
+    line, tripID, stopID string
+}
+
+// frequencyLog remembers the latest predicted time of every call seen in
+// the window; once that time has passed, the call counts as an arrival.
+type frequencyLog struct {
+    window time.Duration
+    calls  map[frequencyKey]int64 // Unix seconds
+}
+
+// EnableFrequency makes the cache keep per-line arrival counts over the
+// trailing window. Memory is bounded by the calls scheduled in the window.
+// Call before the fetcher starts.
+func (c *ArrivalCache) EnableFrequency(window time.Duration) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if window <= 0 {
+        c.frequency = nil
+        return
+    }
+    c.frequency = &frequencyLog{window: window, calls: make(map[frequencyKey]int64)}
+}
+
+// FrequencyWindow is the longest window Frequency can report; 0 when
+// disabled.
+func (c *ArrivalCache) FrequencyWindow() time.Duration {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    if c.frequency == nil {
+        return 0
+    }
+    return c.frequency.window
+}
+
+// Frequency counts a line's arrivals, optionally at one stop, in
+// FrequencyBucket buckets covering the last window, oldest first.
+func (c *ArrivalCache) Frequency(line, stopID string, window time.Duration) []FrequencyCount {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    // The last bucket is the current, partial one
+    now := time.Now()
+    n := int((window + FrequencyBucket - 1) / FrequencyBucket)
+    start := now.Truncate(FrequencyBucket).Add(-time.Duration(n-1) * FrequencyBucket)
+
+    buckets := make([]FrequencyCount, n)
+    for i := range buckets {
+        buckets[i].Start = start.Add(time.Duration(i) * FrequencyBucket)
+    }
+    if c.frequency == nil {
+        return buckets
+    }
+
+    for k, at := range c.frequency.calls {
+        if k.line != line || (stopID != "" && k.stopID != stopID) {
+            continue
+        }
+        t := time.Unix(at, 0)
+        if t.After(now) || t.Before(start) {
+            continue
+        }
+        buckets[int(t.Sub(start)/FrequencyBucket)].Count++
+    }
+    return buckets
+}
+
+// recordFrequency must be called with c.mu held.
+func (c *ArrivalCache) recordFrequency(list []Arrival) {
+    if c.frequency == nil {
+        return
+    }
+    for _, a := range list {
+        at := a.ArrivalTime
+        if at == 0 {
+            at = a.DepartureTime
+        }
+        if a.TripID == "" || at == 0 {
+            continue
+        }
+        c.frequency.calls[frequencyKey{a.Line, a.TripID, a.StopID}] = at
+    }
+}
+
+// pruneFrequency drops calls older than the window. Must be called with
+// c.mu held.
+func (c *ArrivalCache) pruneFrequency(now time.Time) {
+    if c.frequency == nil {
+        return
+    }
+    cutoff := now.Add(-c.frequency.window).Unix()
+    for k, at := range c.frequency.calls {
+        if at < cutoff {
+            delete(c.frequency.calls, k)
+        }
+    }
+}
@@ -0,0 +1,110 @@
+package feeds
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFrequencyBuckets(t *testing.T) {
+	c := NewArrivalCache()
+	c.EnableFrequency(time.Hour)
+
+	base := time.Now().Truncate(FrequencyBucket)
+	trips := 0
+	call := func(line, stop string, at time.Time) Arrival {
+		trips++
+		return Arrival{StopID: stop, Line: line, TripID: fmt.Sprintf("%s%d", line, trips), ArrivalTime: at.Unix()}
+	}
+	c.Update(map[string][]Arrival{
+		"L08": {
+			call("L", "L08", base.Add(-20*time.Minute+time.Minute)),
+			call("L", "L08", base.Add(-20*time.Minute+3*time.Minute)),
+			call("L", "L08", base.Add(-10*time.Minute+2*time.Minute)),
+			call("L", "L08", base.Add(10*time.Minute)), // still coming
+			call("L", "L08", base.Add(-2*time.Hour)),   // outside the window
+			call("G", "L08", base.Add(-10*time.Minute+time.Minute)),
+		},
+		"L06": {
+			call("L", "L06", base.Add(-10*time.Minute+4*time.Minute)),
+			// Departure time stands in for a missing arrival time
+			{StopID: "L06", Line: "L", TripID: "dep", DepartureTime: base.Add(-30 * time.Minute).Unix()},
+		},
+	})
+	// A later cycle moving a call's time replaces it rather than adding one
+	c.Update(map[string][]Arrival{
+		"L06": {{StopID: "L06", Line: "L", TripID: "dep", DepartureTime: base.Add(-30*time.Minute + time.Minute).Unix()}},
+	})
+
+	// Keyed by start, so a bucket boundary passing mid-test only shifts
+	// which bucket is current
+	counts := func(line, stop string, window time.Duration) (map[time.Time]int, int) {
+		buckets := c.Frequency(line, stop, window)
+		m := map[time.Time]int{}
+		for i, b := range buckets {
+			if i > 0 && b.Start.Sub(buckets[i-1].Start) != FrequencyBucket {
+				t.Errorf("bucket %d starts %v after the previous one", i, b.Start.Sub(buckets[i-1].Start))
+			}
+			m[b.Start] = b.Count
+		}
+		return m, len(buckets)
+	}
+
+	got, n := counts("L", "", time.Hour)
+	if n != 12 {
+		t.Errorf("%d buckets for an hour, want 12", n)
+	}
+	want := map[time.Duration]int{-20 * time.Minute: 2, -10 * time.Minute: 2, -30 * time.Minute: 1, 0: 0, -5 * time.Minute: 0}
+	for off, w := range want {
+		if got[base.Add(off)] != w {
+			t.Errorf("L bucket at %v = %d, want %d", off, got[base.Add(off)], w)
+		}
+	}
+	total := 0
+	for _, v := range got {
+		total += v
+	}
+	if total != 5 {
+		t.Errorf("L total %d, want 5", total)
+	}
+
+	got, _ = counts("L", "L08", time.Hour)
+	if got[base.Add(-20*time.Minute)] != 2 || got[base.Add(-10*time.Minute)] != 1 {
+		t.Errorf("L at L08: %v", got)
+	}
+	got, _ = counts("G", "", time.Hour)
+	if got[base.Add(-10*time.Minute)] != 1 {
+		t.Errorf("G: %v", got)
+	}
+	if _, n := counts("L", "", 12*time.Minute); n != 3 {
+		t.Errorf("%d buckets for 12m, want 3 (rounded up)", n)
+	}
+}
+
+func TestFrequencyDisabled(t *testing.T) {
+	c := NewArrivalCache()
+	c.Update(map[string][]Arrival{"L08": {{StopID: "L08", Line: "L", TripID: "t", ArrivalTime: time.Now().Add(-time.Minute).Unix()}}})
+	if c.FrequencyWindow() != 0 {
+		t.Errorf("window %v while disabled", c.FrequencyWindow())
+	}
+	for _, b := range c.Frequency("L", "", 15*time.Minute) {
+		if b.Count != 0 {
+			t.Errorf("disabled cache counted %d at %v", b.Count, b.Start)
+		}
+	}
+}
+
+func TestFrequencyPrunesToWindow(t *testing.T) {
+	c := NewArrivalCache()
+	c.EnableFrequency(30 * time.Minute)
+	now := time.Now()
+	c.Update(map[string][]Arrival{"L08": {
+		{StopID: "L08", Line: "L", TripID: "old", ArrivalTime: now.Add(-time.Hour).Unix()},
+		{StopID: "L08", Line: "L", TripID: "recent", ArrivalTime: now.Add(-time.Minute).Unix()},
+	}})
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.frequency.calls) != 1 {
+		t.Errorf("%d calls kept, want only the one inside the window", len(c.frequency.calls))
+	}
+}
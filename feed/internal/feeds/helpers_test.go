@@ -0,0 +1,143 @@
+package feeds
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"feed/internal/config"
+	"feed/internal/stations"
+)
+
+// testTrip is one TripUpdate: stops are feed stop IDs such as "L08N",
+// each arriving in[i] after the feed's timestamp.
+type testTrip struct {
+	id    string
+	route string
+	stops []string
+	in    []time.Duration
+}
+
+func buildFeed(tb testing.TB, now time.Time, trips []testTrip) []byte {
+	tb.Helper()
+	msg := &gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Timestamp:           proto.Uint64(uint64(now.Unix())),
+		},
+	}
+	for _, trip := range trips {
+		tu := &gtfs.TripUpdate{
+			Trip: &gtfs.TripDescriptor{
+				TripId:  proto.String(trip.id),
+				RouteId: proto.String(trip.route),
+			},
+		}
+		for i, stop := range trip.stops {
+			tu.StopTimeUpdate = append(tu.StopTimeUpdate, &gtfs.TripUpdate_StopTimeUpdate{
+				StopId:  proto.String(stop),
+				Arrival: &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(now.Add(trip.in[i]).Unix())},
+			})
+		}
+		msg.Entity = append(msg.Entity, &gtfs.FeedEntity{Id: proto.String(trip.id), TripUpdate: tu})
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func testStationDB(tb testing.TB) *stations.StationDB {
+	tb.Helper()
+	db, err := stations.LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+// loadTestConfig runs yaml through config.Load, so tests get the same
+// defaults as a real deployment.
+func loadTestConfig(tb testing.TB, yaml string) *config.Config {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cfg
+}
+
+func newTestFetcher(tb testing.TB, cfg *config.Config) (*FeedFetcher, *ArrivalCache) {
+	tb.Helper()
+	cache := NewArrivalCache()
+	f := NewFeedFetcher(cfg, cache, stations.NewHolder(testStationDB(tb)), nil, NewNotifier())
+	return f, cache
+}
+
+// For feeds testTrip can't express: departure-only stops, schedule
+// relationships, NYCT extensions.
+
+// stopUpdate is one StopTimeUpdate; a zero time leaves that event out.
+func stopUpdate(stop string, arrival, departure int64) *gtfs.TripUpdate_StopTimeUpdate {
+	stu := &gtfs.TripUpdate_StopTimeUpdate{StopId: proto.String(stop)}
+	if arrival != 0 {
+		stu.Arrival = &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(arrival)}
+	}
+	if departure != 0 {
+		stu.Departure = &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(departure)}
+	}
+	return stu
+}
+
+// tripEntity wraps updates in a TripUpdate; ext, when set, is appended to
+// the TripDescriptor as raw unknown fields (see nyctExtension).
+func tripEntity(id, route string, ext []byte, updates ...*gtfs.TripUpdate_StopTimeUpdate) *gtfs.FeedEntity {
+	td := &gtfs.TripDescriptor{TripId: proto.String(id), RouteId: proto.String(route)}
+	if ext != nil {
+		td.ProtoReflect().SetUnknown(ext)
+	}
+	return &gtfs.FeedEntity{
+		Id:         proto.String(id),
+		TripUpdate: &gtfs.TripUpdate{Trip: td, StopTimeUpdate: updates},
+	}
+}
+
+// nyctExtension encodes a NyctTripDescriptor as extension field 1001.
+func nyctExtension(trainID string, assigned bool, direction int32) []byte {
+	var inner []byte
+	inner = protowire.AppendTag(inner, 1, protowire.BytesType)
+	inner = protowire.AppendString(inner, trainID)
+	inner = protowire.AppendTag(inner, 2, protowire.VarintType)
+	inner = protowire.AppendVarint(inner, protowire.EncodeBool(assigned))
+	if direction != 0 {
+		inner = protowire.AppendTag(inner, 3, protowire.VarintType)
+		inner = protowire.AppendVarint(inner, uint64(direction))
+	}
+	ext := protowire.AppendTag(nil, nyctExtensionField, protowire.BytesType)
+	return protowire.AppendBytes(ext, inner)
+}
+
+func marshalFeed(tb testing.TB, now time.Time, entities ...*gtfs.FeedEntity) []byte {
+	tb.Helper()
+	data, err := proto.Marshal(&gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Timestamp:           proto.Uint64(uint64(now.Unix())),
+		},
+		Entity: entities,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
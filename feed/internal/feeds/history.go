@@ -0,0 +1,77 @@
+package feeds
+
+import "time"
+
+type HistorySnapshot struct {
+    At       time.Time `json:"at"`
+    Arrivals []Arrival `json:"arrivals"`
+}
+
+// historyRing keeps the last len(buf) snapshots for one stop.
+type historyRing struct {
+    buf   []HistorySnapshot
+    next  int
+    count int
+}
+
+func (r *historyRing) push(s HistorySnapshot) {
+    r.buf[r.next] = s
+    r.next = (r.next + 1) % len(r.buf)
+    if r.count < len(r.buf) {
+        r.count++
+    }
+}
+
+// ordered returns the snapshots oldest first.
+func (r *historyRing) ordered() []HistorySnapshot {
+    result := make([]HistorySnapshot, 0, r.count)
+    start := (r.next - r.count + len(r.buf)) % len(r.buf)
+    for i := 0; i < r.count; i++ {
+        result = append(result, r.buf[(start+i)%len(r.buf)])
+    }
+    return result
+}
+
+// EnableHistory makes the cache keep the last k snapshots of every stop it
+// updates, for inspecting how predictions evolve. Memory is bounded by k
+// per stop. Call before the fetcher starts.
+func (c *ArrivalCache) EnableHistory(k int) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if k <= 0 {
+        c.history = nil
+        return
+    }
+    c.historySize = k
+    c.history = make(map[string]*historyRing)
+}
+
+func (c *ArrivalCache) HistoryEnabled() bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.history != nil
+}
+
+// History returns a stop's recorded snapshots, oldest first.
+func (c *ArrivalCache) History(stopID string) []HistorySnapshot {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    r, ok := c.history[stopID]
+    if !ok {
+        return []HistorySnapshot{}
+    }
+    return r.ordered()
+}
+
+// recordHistory must be called with c.mu held.
+func (c *ArrivalCache) recordHistory(stopID string, at time.Time, list []Arrival) {
+    if c.history == nil {
+        return
+    }
+    r, ok := c.history[stopID]
+    if !ok {
+        r = &historyRing{buf: make([]HistorySnapshot, c.historySize)}
+        c.history[stopID] = r
+    }
+    r.push(HistorySnapshot{At: at, Arrivals: list})
+}
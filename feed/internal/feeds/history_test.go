@@ -0,0 +1,76 @@
+package feeds
+
+import (
+	"slices"
+	"testing"
+)
+
+// historyMinutes flattens snapshots to the minutes of their first arrival,
+// -1 for a snapshot where the train had vanished.
+func historyMinutes(snaps []HistorySnapshot) []int {
+	out := make([]int, len(snaps))
+	for i, s := range snaps {
+		out[i] = -1
+		if len(s.Arrivals) > 0 {
+			out[i] = s.Arrivals[0].Minutes
+		}
+	}
+	return out
+}
+
+func TestHistoryCapsAtKInOrder(t *testing.T) {
+	c := NewArrivalCache()
+	c.EnableHistory(3)
+	if !c.HistoryEnabled() {
+		t.Fatal("history not enabled")
+	}
+
+	// A "3 min" train slips to 5, then disappears from the feed
+	for i, m := range []int{3, 4, 5, 5} {
+		c.Update(map[string][]Arrival{"L08": {{StopID: "L08", Minutes: m, TripID: "t1"}}})
+		want := []int{3, 4, 5, 5}[max(0, i-2) : i+1]
+		if got := historyMinutes(c.History("L08")); !slices.Equal(got, want) {
+			t.Errorf("after update %d: %v, want %v", i+1, got, want)
+		}
+	}
+	c.Update(map[string][]Arrival{"L08": {}})
+
+	snaps := c.History("L08")
+	if got := historyMinutes(snaps); !slices.Equal(got, []int{5, 5, -1}) {
+		t.Errorf("history %v, want the last 3 oldest first: [5 5 -1]", got)
+	}
+	for i := 1; i < len(snaps); i++ {
+		if snaps[i].At.Before(snaps[i-1].At) {
+			t.Errorf("snapshot %d at %s is before snapshot %d at %s", i, snaps[i].At, i-1, snaps[i-1].At)
+		}
+	}
+
+	if got := c.History("L06"); got == nil || len(got) != 0 {
+		t.Errorf("never-updated stop: %#v, want an empty list", got)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	for _, k := range []int{0, -1} {
+		c := NewArrivalCache()
+		c.EnableHistory(k)
+		c.Update(map[string][]Arrival{"L08": {{StopID: "L08", Minutes: 3}}})
+		if c.HistoryEnabled() || len(c.History("L08")) != 0 {
+			t.Errorf("EnableHistory(%d) still records", k)
+		}
+	}
+}
+
+func TestHistoryRingWraps(t *testing.T) {
+	r := &historyRing{buf: make([]HistorySnapshot, 4)}
+	for i := 0; i < 11; i++ {
+		r.push(HistorySnapshot{Arrivals: []Arrival{{Minutes: i}}})
+		want := make([]int, 0, 4)
+		for m := max(0, i-3); m <= i; m++ {
+			want = append(want, m)
+		}
+		if got := historyMinutes(r.ordered()); !slices.Equal(got, want) {
+			t.Fatalf("after %d pushes: %v, want %v", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package feeds
+
+import "sync"
+
+// Notifier fans a "cache updated" signal out to every subscriber. Notify
+// never blocks: each subscriber has a one-slot buffer, so a slow consumer
+// just sees consecutive updates coalesced into one.
+type Notifier struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+	next chan struct{} // closed and replaced on each Notify
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{
+		subs: make(map[chan struct{}]struct{}),
+		next: make(chan struct{}),
+	}
+}
+
+// Subscribe registers a long-lived consumer, such as the SSE hub. The
+// returned cancel func unregisters it; the channel is never closed.
+func (n *Notifier) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	n.subs[ch] = struct{}{}
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		delete(n.subs, ch)
+		n.mu.Unlock()
+	}
+}
+
+// Next returns a channel closed by the next Notify, for one-shot waiters
+// like long-poll requests that don't need to unsubscribe.
+func (n *Notifier) Next() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.next
+}
+
+func (n *Notifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for ch := range n.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	close(n.next)
+	n.next = make(chan struct{})
+}
@@ -0,0 +1,98 @@
+package feeds
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifierWakesEverySubscriber(t *testing.T) {
+	n := NewNotifier()
+
+	// Long-lived subscribers (the SSE hub) and one-shot waiters (long-poll
+	// requests) all block on the same update
+	const subs, waiters = 5, 5
+	var ready, woke sync.WaitGroup
+	for i := 0; i < subs; i++ {
+		ch, cancel := n.Subscribe()
+		defer cancel()
+		ready.Add(1)
+		woke.Add(1)
+		go func() {
+			ready.Done()
+			<-ch
+			woke.Done()
+		}()
+	}
+	for i := 0; i < waiters; i++ {
+		next := n.Next()
+		ready.Add(1)
+		woke.Add(1)
+		go func() {
+			ready.Done()
+			<-next
+			woke.Done()
+		}()
+	}
+	ready.Wait()
+
+	n.Notify()
+	done := make(chan struct{})
+	go func() {
+		woke.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("not every subscriber woke on one Notify")
+	}
+}
+
+func TestNotifierNeverBlocks(t *testing.T) {
+	n := NewNotifier()
+	ch, cancel := n.Subscribe()
+	gone, cancelGone := n.Subscribe()
+	cancelGone()
+
+	// Nobody reads: the one-slot buffer fills and later updates coalesce
+	returned := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			n.Notify()
+		}
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Notify blocked on a subscriber that isn't reading")
+	}
+
+	select {
+	case <-ch:
+	default:
+		t.Fatal("subscriber missed the updates")
+	}
+	select {
+	case <-ch:
+		t.Error("three updates were delivered separately, want them coalesced")
+	default:
+	}
+	select {
+	case <-gone:
+		t.Error("cancelled subscriber still notified")
+	default:
+	}
+
+	// A fresh Next waits for the next update, not the ones already sent
+	next := n.Next()
+	select {
+	case <-next:
+		t.Error("Next already closed before any new Notify")
+	default:
+	}
+	cancel()
+	n.Notify()
+	<-next
+}
@@ -0,0 +1,111 @@
+package feeds
+
+import (
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// NYCT publishes its GTFS-realtime extensions (nyct-subway.proto) under
+// field 1001. The generated bindings don't include them, so they survive
+// unmarshalling as unknown fields and are decoded by hand here.
+const nyctExtensionField protowire.Number = 1001
+
+type nyctTripDescriptor struct {
+	TrainID    string
+	IsAssigned bool
+	Direction  int32 // 1 NORTH, 2 EAST, 3 SOUTH, 4 WEST
+}
+
+func nyctTrip(td *gtfs.TripDescriptor) (nyctTripDescriptor, bool) {
+	var ext nyctTripDescriptor
+	if td == nil {
+		return ext, false
+	}
+
+	b, ok := findBytesField(td.ProtoReflect().GetUnknown(), nyctExtensionField)
+	if !ok {
+		return ext, false
+	}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ext, false
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return ext, false
+			}
+			ext.TrainID = string(v)
+			b = b[n:]
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return ext, false
+			}
+			ext.IsAssigned = protowire.DecodeBool(v)
+			b = b[n:]
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return ext, false
+			}
+			ext.Direction = int32(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return ext, false
+			}
+			b = b[n:]
+		}
+	}
+
+	return ext, true
+}
+
+// findBytesField returns the payload of the first length-delimited field
+// with the given number in a raw protobuf message.
+func findBytesField(b []byte, want protowire.Number) ([]byte, bool) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, false
+		}
+		b = b[n:]
+
+		if num == want && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, false
+			}
+			return v, true
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return nil, false
+		}
+		b = b[n:]
+	}
+	return nil, false
+}
+
+// nyctDirectionCode maps NyctTripDescriptor.Direction to a compass code.
+func nyctDirectionCode(d int32) string {
+	switch d {
+	case 1:
+		return "N"
+	case 2:
+		return "E"
+	case 3:
+		return "S"
+	case 4:
+		return "W"
+	}
+	return ""
+}
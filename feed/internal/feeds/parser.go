@@ -1,7 +1,9 @@
 package feeds
 
 import (
+	"fmt"
 	"math"
+	"sort"
 	"time"
 
 	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
@@ -10,19 +12,93 @@ import (
 	"feed/internal/stations"
 )
 
-func ParseFeed(data []byte, db *stations.StationDB) (map[string][]Arrival, error) {
+type ParseOptions struct {
+	// stop ID -> direction code -> label; takes precedence over the station CSV labels
+	DirectionOverrides map[string]map[string]string
+	// Zone for Arrival.ArrivalClock; left blank when nil
+	Location *time.Location
+	// Static schedule enrichment; may be nil
+	Static *stations.StaticGTFS
+	// Time-to-arrival thresholds for Arrival.Status; zero leaves it unset
+	ArrivingWithin    time.Duration
+	ApproachingWithin time.Duration
+	// How to derive stop and direction from feed stop IDs (DirectionSuffix,
+	// DirectionTrip or DirectionNone); empty means DirectionSuffix
+	DirectionStrategy string
+	// Maps feed stop IDs to station keys (see StopKeyFunc); nil keeps the
+	// direction strategy's base ID
+	StopKey func(string) string
+	// Count minutes from the feed header timestamp instead of the local
+	// clock, for feeds known to publish late
+	UseFeedClock bool
+}
+
+// ParseError means the feed body was received but could not be decoded,
+// as opposed to a network or HTTP failure.
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse feed: %v", e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseStats counts what happened to a feed's contents during parsing, so
+// sparse arrivals can be traced to the feed itself or to our filtering.
+type ParseStats struct {
+	Entities           int `json:"entities"`
+	TripUpdates        int `json:"trip_updates"`
+	StopTimeUpdates    int `json:"stop_time_updates"`
+	ArrivalsKept       int `json:"arrivals_kept"`
+	DroppedPast        int `json:"dropped_past"`
+	DroppedUnknownStop int `json:"dropped_unknown_stop"`
+	DroppedSkipped     int `json:"dropped_skipped"`
+
+	// Distinct base stop IDs missing from the station CSV, sorted; a
+	// non-empty list usually means data/stations.csv is out of date
+	UnknownStops []string `json:"unknown_stops,omitempty"`
+
+	// FeedMessage.Header.Timestamp, Unix seconds; 0 when absent
+	FeedTimestamp int64 `json:"feed_timestamp,omitempty"`
+}
+
+func ParseFeed(data []byte, db *stations.StationDB, opts ParseOptions) (map[string][]Arrival, error) {
+	arrivals, _, err := ParseFeedWithStats(data, db, opts)
+	return arrivals, err
+}
+
+func ParseFeedWithStats(data []byte, db *stations.StationDB, opts ParseOptions) (map[string][]Arrival, ParseStats, error) {
+	var stats ParseStats
+
 	feed := &gtfs.FeedMessage{}
 	if err := proto.Unmarshal(data, feed); err != nil {
-		return nil, err
+		return nil, stats, &ParseError{Err: err}
 	}
 
-	arrivals := make(map[string][]Arrival)
+	// Arrivals are collected flat and grouped by stop at the end, which
+	// costs a couple of allocations instead of growing a slice per stop
+	sizeHint := 0
+	for _, entity := range feed.Entity {
+		sizeHint += len(entity.GetTripUpdate().GetStopTimeUpdate())
+	}
+	kept := make([]Arrival, 0, sizeHint)
+	unknown := make(map[string]bool)
 	now := time.Now().Unix()
+	stats.FeedTimestamp = int64(feed.GetHeader().GetTimestamp())
+	if opts.UseFeedClock && stats.FeedTimestamp > 0 {
+		now = stats.FeedTimestamp
+	}
 
+	stats.Entities = len(feed.Entity)
 	for _, entity := range feed.Entity {
 		if entity.TripUpdate == nil {
 			continue
 		}
+		stats.TripUpdates++
 
 		tu := entity.TripUpdate
 		// MTA extensions sometimes in TripUpdate, but mostly we rely on StopTimeUpdate
@@ -33,32 +109,40 @@ func ParseFeed(data []byte, db *stations.StationDB) (map[string][]Arrival, error
 		if tu.Trip != nil && tu.Trip.RouteId != nil {
 			line = *tu.Trip.RouteId
 		}
+		nyct, _ := nyctTrip(tu.Trip)
+		headsign, ok := opts.Static.TripHeadsign(tu.GetTrip().GetTripId())
+		if !ok {
+			headsign = terminalName(tu, db)
+		}
 
-		for _, stu := range tu.StopTimeUpdate {
+		for i, stu := range tu.StopTimeUpdate {
+			stats.StopTimeUpdates++
 			if stu.StopId == nil {
 				continue
 			}
 
-			stopIDFull := *stu.StopId // e.g. "L08N"
-			if len(stopIDFull) < 3 {
+			// SKIPPED means the train won't stop here (service change) and
+			// NO_DATA carries no prediction; neither is a real arrival.
+			switch stu.GetScheduleRelationship() {
+			case gtfs.TripUpdate_StopTimeUpdate_SKIPPED, gtfs.TripUpdate_StopTimeUpdate_NO_DATA:
+				stats.DroppedSkipped++
 				continue
 			}
 
-			// Last char usually direction
-			dirCode := stopIDFull[len(stopIDFull)-1:]
-			baseStopID := stopIDFull[:len(stopIDFull)-1]
-
-			// Check if last char is N or S
-			if dirCode != "N" && dirCode != "S" {
-				// Sometimes ID doesn't have direction, or is just base?
-				// MTA usually follows convention. safely handle?
-				baseStopID = stopIDFull
-				dirCode = ""
+			stopIDFull := stations.NormalizeStopID(*stu.StopId) // e.g. "L08N"
+			baseStopID, dirCode, ok := stopDirection(opts.DirectionStrategy, stopIDFull, tu.Trip, nyct)
+			if !ok {
+				continue
+			}
+			if opts.StopKey != nil {
+				baseStopID = opts.StopKey(stopIDFull)
 			}
 
 			// Lookup station
 			station, found := db.GetStation(baseStopID)
 			if !found {
+				stats.DroppedUnknownStop++
+				unknown[baseStopID] = true
 				continue
 			}
 
@@ -73,6 +157,7 @@ func ParseFeed(data []byte, db *stations.StationDB) (map[string][]Arrival, error
 
 			// Filter past trains?
 			if arrivalTime < now {
+				stats.DroppedPast++
 				continue
 			}
 
@@ -82,25 +167,123 @@ func ParseFeed(data []byte, db *stations.StationDB) (map[string][]Arrival, error
 			}
 
 			// Determine Label
-			directionLabel := ""
-			if dirCode == "N" {
-				directionLabel = station.NorthLabel
-			} else if dirCode == "S" {
-				directionLabel = station.SouthLabel
+			directionLabel := station.DirectionLabel(dirCode)
+			if label, ok := opts.DirectionOverrides[baseStopID][dirCode]; ok {
+				directionLabel = label
 			}
 
 			arr := Arrival{
 				StopID:        baseStopID, // Group by the station ID, not the specific platform (L08N)
+				Platform:      stopIDFull,
 				Station:       station.Name,
 				Line:          line, // From TripDescriptor
 				Direction:     directionLabel,
 				DirectionCode: dirCode,
 				Minutes:       minutes,
+				// A trip's first update carrying only a departure time is a
+				// train still sitting at its origin terminal
+				Origin:    i == 0 && stu.Arrival == nil,
+				Assigned:  nyct.IsAssigned,
+				Headsign:  headsign,
+				TripID:    tu.GetTrip().GetTripId(),
+				ComplexID: station.ComplexID,
 			}
+			arr.Status = arrivalStatus(time.Duration(arrivalTime-now)*time.Second, opts)
 
-			arrivals[baseStopID] = append(arrivals[baseStopID], arr)
+			// The getters are nil-safe, so absent events just leave zeros
+			arr.ArrivalTime = stu.GetArrival().GetTime()
+			arr.DepartureTime = stu.GetDeparture().GetTime()
+			if ev := stu.GetArrival(); ev != nil && ev.Delay != nil {
+				arr.Delay = int(ev.GetDelay())
+			} else {
+				arr.Delay = int(stu.GetDeparture().GetDelay())
+			}
+			if opts.Location != nil {
+				arr.ArrivalClock = time.Unix(arrivalTime, 0).In(opts.Location).Format("15:04")
+			}
+
+			kept = append(kept, arr)
+			stats.ArrivalsKept++
 		}
 	}
 
-	return arrivals, nil
+	arrivals := groupByStop(kept)
+
+	for id := range unknown {
+		stats.UnknownStops = append(stats.UnknownStops, id)
+	}
+	sort.Strings(stats.UnknownStops)
+
+	return arrivals, stats, nil
+}
+
+// groupByStop splits arrivals into per-stop lists, keeping their order,
+// carved out of one backing array. Each list is capped at its own length
+// so appending to one can't overwrite its neighbour.
+func groupByStop(all []Arrival) map[string][]Arrival {
+	counts := make(map[string]int)
+	for _, a := range all {
+		counts[a.StopID]++
+	}
+
+	backing := make([]Arrival, len(all))
+	grouped := make(map[string][]Arrival, len(counts))
+	offset := 0
+	for stopID, n := range counts {
+		grouped[stopID] = backing[offset : offset : offset+n]
+		offset += n
+	}
+	for _, a := range all {
+		grouped[a.StopID] = append(grouped[a.StopID], a)
+	}
+	return grouped
+}
+
+// arrivalStatus classifies time until arrival so clients can show "Now"
+// instead of "0 min" without each picking their own cutoffs.
+func arrivalStatus(until time.Duration, opts ParseOptions) string {
+	if opts.ArrivingWithin == 0 && opts.ApproachingWithin == 0 {
+		return ""
+	}
+	switch {
+	case until < opts.ArrivingWithin:
+		return "arriving"
+	case until < opts.ApproachingWithin:
+		return "approaching"
+	}
+	return "scheduled"
+}
+
+// splitStopID separates the NYC platform suffix from a feed stop ID,
+// e.g. "L08N" -> ("L08", "N").
+func splitStopID(stopIDFull string) (string, string) {
+	// Last char usually direction
+	dirCode := stopIDFull[len(stopIDFull)-1:]
+	baseStopID := stopIDFull[:len(stopIDFull)-1]
+
+	// Check if last char is a compass direction
+	switch dirCode {
+	case "N", "S", "E", "W":
+	default:
+		// Sometimes ID doesn't have direction, or is just base?
+		// MTA usually follows convention. safely handle?
+		return stopIDFull, ""
+	}
+	return baseStopID, dirCode
+}
+
+// terminalName derives a headsign from the last stop the trip update
+// lists, which is where the train is headed.
+func terminalName(tu *gtfs.TripUpdate, db *stations.StationDB) string {
+	for i := len(tu.StopTimeUpdate) - 1; i >= 0; i-- {
+		stopID := stations.NormalizeStopID(tu.StopTimeUpdate[i].GetStopId())
+		if len(stopID) < 3 {
+			continue
+		}
+		base, _ := splitStopID(stopID)
+		if station, ok := db.GetStation(base); ok {
+			return station.Name
+		}
+	}
+	return ""
 }
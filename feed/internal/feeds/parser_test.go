@@ -0,0 +1,611 @@
+package feeds
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+
+	"feed/internal/stations"
+)
+
+var lStops = []string{"L01", "L02", "L03", "L05", "L06", "L08", "L10", "L11", "L12", "L13", "L14", "L15", "L16", "L17", "L19", "L20", "L21", "L22", "L24", "L25", "L26", "L27", "L28", "L29"}
+
+// largeFeedTrips is roughly a busy feed: the given number of trips over
+// every stop of the L in both directions, two minutes between stops.
+func largeFeedTrips(trips int) []testTrip {
+	var out []testTrip
+	for k := 0; k < trips; k++ {
+		suffix := []string{"N", "S"}[k%2]
+		trip := testTrip{id: fmt.Sprintf("T%03d", k), route: "L"}
+		for i, stop := range lStops {
+			trip.stops = append(trip.stops, stop+suffix)
+			trip.in = append(trip.in, time.Duration(k)*time.Minute+time.Duration(i)*2*time.Minute)
+		}
+		out = append(out, trip)
+	}
+	return out
+}
+
+func TestGroupByStop(t *testing.T) {
+	all := []Arrival{
+		{StopID: "L08", TripID: "a"},
+		{StopID: "L06", TripID: "b"},
+		{StopID: "L08", TripID: "c"},
+	}
+	grouped := groupByStop(all)
+	if len(grouped) != 2 || len(grouped["L08"]) != 2 || len(grouped["L06"]) != 1 {
+		t.Fatalf("grouped = %v", grouped)
+	}
+	if grouped["L08"][0].TripID != "a" || grouped["L08"][1].TripID != "c" {
+		t.Errorf("L08 order = %v, want feed order a, c", grouped["L08"])
+	}
+
+	// Groups share one backing array; appending to one must not clobber
+	// its neighbour
+	grouped["L06"] = append(grouped["L06"], Arrival{StopID: "L06", TripID: "d"})
+	if grouped["L08"][0].TripID != "a" || grouped["L08"][1].TripID != "c" {
+		t.Errorf("append to L06 changed L08: %v", grouped["L08"])
+	}
+}
+
+func TestParseFeedWithStatsCounts(t *testing.T) {
+	db := testStationDB(t)
+	data := buildFeed(t, time.Now(), largeFeedTrips(10))
+	arrivals, stats, err := ParseFeedWithStats(data, db, ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TripUpdates != 10 || stats.StopTimeUpdates != 10*len(lStops) {
+		t.Errorf("stats = %+v", stats)
+	}
+	kept := 0
+	for stopID, list := range arrivals {
+		for _, a := range list {
+			if a.StopID != stopID {
+				t.Errorf("arrival for %s filed under %s", a.StopID, stopID)
+			}
+		}
+		kept += len(list)
+	}
+	if kept != stats.ArrivalsKept || kept != 10*len(lStops) {
+		t.Errorf("kept %d arrivals, stats say %d", kept, stats.ArrivalsKept)
+	}
+}
+
+func BenchmarkParseFeedWithStats(b *testing.B) {
+	db := testStationDB(b)
+	data := buildFeed(b, time.Now(), largeFeedTrips(300))
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseFeedWithStats(data, db, ParseOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGroupByStop(b *testing.B) {
+	db := testStationDB(b)
+	data := buildFeed(b, time.Now(), largeFeedTrips(300))
+	arrivals, err := ParseFeed(data, db, ParseOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var all []Arrival
+	for _, list := range arrivals {
+		all = append(all, list...)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		groupByStop(all)
+	}
+}
+
+func TestParseFeedDirectionOverrides(t *testing.T) {
+	db := testStationDB(t)
+	data := buildFeed(t, time.Now(), []testTrip{
+		{id: "n1", route: "L", stops: []string{"L08N", "L06N"}, in: []time.Duration{2 * time.Minute, 4 * time.Minute}},
+		{id: "s1", route: "L", stops: []string{"L06S", "L08S"}, in: []time.Duration{2 * time.Minute, 4 * time.Minute}},
+	})
+	opts := ParseOptions{DirectionOverrides: map[string]map[string]string{
+		"L08": {"N": "To Manhattan"},
+	}}
+	arrivals, err := ParseFeed(data, db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := func(stopID string) map[string]string {
+		m := map[string]string{}
+		for _, a := range arrivals[stopID] {
+			m[a.DirectionCode] = a.Direction
+		}
+		return m
+	}
+	// L08 north is overridden; its south label and all of L06 come from
+	// the CSV
+	if got := labels("L08"); got["N"] != "To Manhattan" || got["S"] != "Canarsie - Rockaway Parkway" {
+		t.Errorf("L08 labels = %v", got)
+	}
+	if got := labels("L06"); got["N"] != "8 Av" || got["S"] != "Brooklyn" {
+		t.Errorf("L06 labels = %v", got)
+	}
+}
+
+func TestParseFeedClockAcrossDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := testStationDB(t)
+
+	tests := []struct {
+		name   string
+		header time.Time
+		want   []string // clocks for arrivals 5 and 20 minutes later
+	}{
+		// 2:00 EDT falls back to 1:00 EST at 06:00 UTC
+		{"fall back", time.Date(2025, 11, 2, 5, 50, 0, 0, time.UTC), []string{"01:55", "01:10"}},
+		// 2:00 EST springs forward to 3:00 EDT at 07:00 UTC
+		{"spring forward", time.Date(2026, 3, 8, 6, 50, 0, 0, time.UTC), []string{"01:55", "03:10"}},
+	}
+	for _, tt := range tests {
+		data := buildFeed(t, tt.header, []testTrip{
+			{id: "a", route: "L", stops: []string{"L08N"}, in: []time.Duration{5 * time.Minute}},
+			{id: "b", route: "L", stops: []string{"L08N"}, in: []time.Duration{20 * time.Minute}},
+		})
+		arrivals, err := ParseFeed(data, db, ParseOptions{Location: ny, UseFeedClock: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clocks := map[string]string{}
+		minutes := map[string]int{}
+		for _, a := range arrivals["L08"] {
+			clocks[a.TripID] = a.ArrivalClock
+			minutes[a.TripID] = a.Minutes
+		}
+		if clocks["a"] != tt.want[0] || clocks["b"] != tt.want[1] {
+			t.Errorf("%s: clocks %v, want a=%s b=%s", tt.name, clocks, tt.want[0], tt.want[1])
+		}
+		// Minutes count real elapsed time, whatever the wall clock does
+		if minutes["a"] != 5 || minutes["b"] != 20 {
+			t.Errorf("%s: minutes %v, want a=5 b=20", tt.name, minutes)
+		}
+	}
+}
+
+func TestParseFeedHeaderTimestamp(t *testing.T) {
+	db := testStationDB(t)
+	header := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	data := buildFeed(t, header, []testTrip{
+		{id: "a", route: "L", stops: []string{"L08N"}, in: []time.Duration{15 * time.Minute}},
+	})
+
+	arrivals, stats, err := ParseFeedWithStats(data, db, ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FeedTimestamp != header.Unix() {
+		t.Errorf("FeedTimestamp = %d, want %d", stats.FeedTimestamp, header.Unix())
+	}
+	// By the local clock the train is 5 minutes out; by the feed's own
+	// clock, 15
+	if got := arrivals["L08"][0].Minutes; got != 5 && got != 4 {
+		t.Errorf("local clock minutes = %d, want 5", got)
+	}
+	arrivals, err = ParseFeed(data, db, ParseOptions{UseFeedClock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := arrivals["L08"][0].Minutes; got != 15 {
+		t.Errorf("feed clock minutes = %d, want 15", got)
+	}
+
+	// Without a header timestamp the feed clock falls back to local time
+	var msg gtfs.FeedMessage
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.Header.Timestamp = nil
+	if data, err = proto.Marshal(&msg); err != nil {
+		t.Fatal(err)
+	}
+	arrivals, stats, err = ParseFeedWithStats(data, db, ParseOptions{UseFeedClock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FeedTimestamp != 0 {
+		t.Errorf("FeedTimestamp = %d without a header timestamp, want 0", stats.FeedTimestamp)
+	}
+	if got := arrivals["L08"][0].Minutes; got != 5 && got != 4 {
+		t.Errorf("minutes without a header timestamp = %d, want 5", got)
+	}
+}
+
+func TestParseFeedOriginTerminal(t *testing.T) {
+	now := time.Now()
+	at := func(m int) int64 { return now.Add(time.Duration(m) * time.Minute).Unix() }
+	data := marshalFeed(t, now,
+		// Sitting at 8 Av: the first update has only a departure time
+		tripEntity("waiting", "L", nil,
+			stopUpdate("L01S", 0, at(4)),
+			stopUpdate("L02S", at(6), at(6)),
+		),
+		// Already moving: its first update is a downstream arrival
+		tripEntity("moving", "L", nil,
+			stopUpdate("L01S", at(1), at(1)),
+			stopUpdate("L02S", at(3), at(3)),
+		),
+	)
+	arrivals, err := ParseFeed(data, testStationDB(t), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origin := map[string]bool{}
+	for _, a := range arrivals["L01"] {
+		origin[a.TripID] = a.Origin
+		if a.Station != "8 Av" {
+			t.Errorf("L01 station %q, want 8 Av", a.Station)
+		}
+	}
+	if !origin["waiting"] || origin["moving"] {
+		t.Errorf("origin flags at 8 Av = %v, want only the waiting trip", origin)
+	}
+	for _, a := range arrivals["L02"] {
+		if a.Origin {
+			t.Errorf("downstream stop flagged as origin: %+v", a)
+		}
+	}
+}
+
+func TestParseFeedSkippedStops(t *testing.T) {
+	now := time.Now()
+	at := func(m int) int64 { return now.Add(time.Duration(m) * time.Minute).Unix() }
+	skipped := stopUpdate("L06N", at(3), at(3))
+	skipped.ScheduleRelationship = gtfs.TripUpdate_StopTimeUpdate_SKIPPED.Enum()
+	noData := stopUpdate("L05N", 0, 0)
+	noData.ScheduleRelationship = gtfs.TripUpdate_StopTimeUpdate_NO_DATA.Enum()
+
+	data := marshalFeed(t, now, tripEntity("t1", "L", nil,
+		stopUpdate("L08N", at(1), at(1)),
+		skipped,
+		noData,
+		stopUpdate("L03N", at(7), at(7)),
+	))
+	arrivals, stats, err := ParseFeedWithStats(data, testStationDB(t), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arrivals["L06"]) != 0 || len(arrivals["L05"]) != 0 {
+		t.Errorf("skipped/no-data stops kept: L06 %v, L05 %v", arrivals["L06"], arrivals["L05"])
+	}
+	if len(arrivals["L08"]) != 1 || len(arrivals["L03"]) != 1 {
+		t.Errorf("scheduled stops around the skip lost: L08 %v, L03 %v", arrivals["L08"], arrivals["L03"])
+	}
+	if stats.DroppedSkipped != 2 || stats.ArrivalsKept != 2 {
+		t.Errorf("stats = %+v, want 2 skipped and 2 kept", stats)
+	}
+}
+
+func TestParseFeedAssignedFlag(t *testing.T) {
+	now := time.Now()
+	at := func(m int) int64 { return now.Add(time.Duration(m) * time.Minute).Unix() }
+	data := marshalFeed(t, now,
+		tripEntity("assigned", "L", nyctExtension("0L 1234+ 8AV/RPY", true, 1), stopUpdate("L08N", at(4), at(4))),
+		tripEntity("scheduled", "L", nyctExtension("0L 1300+ RPY/8AV", false, 3), stopUpdate("L08S", at(6), at(6))),
+		tripEntity("plain", "L", nil, stopUpdate("L08N", at(9), 0)),
+	)
+	arrivals, err := ParseFeed(data, testStationDB(t), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assigned := map[string]bool{}
+	for _, a := range arrivals["L08"] {
+		assigned[a.TripID] = a.Assigned
+	}
+	if len(assigned) != 3 || !assigned["assigned"] || assigned["scheduled"] || assigned["plain"] {
+		t.Errorf("assigned flags = %v, want only the assigned trip", assigned)
+	}
+}
+
+func TestParseFeedHeadsign(t *testing.T) {
+	now := time.Now()
+	at := func(m int) int64 { return now.Add(time.Duration(m) * time.Minute).Unix() }
+	static, err := stations.LoadStaticGTFS("../stations/testdata/gtfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := marshalFeed(t, now,
+		// Runs to Canarsie; the last update names the terminal
+		tripEntity("t-south", "L", nil,
+			stopUpdate("L08S", at(2), at(2)),
+			stopUpdate("L29S", at(30), 0),
+		),
+		// An unknown trailing stop is passed over for the last station known
+		tripEntity("t-north", "L", nil,
+			stopUpdate("L08N", at(3), at(3)),
+			stopUpdate("L01N", at(12), 0),
+			stopUpdate("X99N", at(14), 0),
+		),
+		// trips.txt knows this one, under its prefixed static ID
+		tripEntity("036850_L..N01R", "L", nil,
+			stopUpdate("L08N", at(5), at(5)),
+			stopUpdate("L06N", at(8), 0),
+		),
+	)
+
+	tests := []struct {
+		name   string
+		static *stations.StaticGTFS
+		want   map[string]string
+	}{
+		{"terminal stop", nil, map[string]string{
+			"t-south": "Canarsie-Rockaway Pkwy", "t-north": "8 Av", "036850_L..N01R": "1 Av",
+		}},
+		{"static first", static, map[string]string{
+			"t-south": "Canarsie-Rockaway Pkwy", "t-north": "8 Av", "036850_L..N01R": "8 Av",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arrivals, err := ParseFeed(data, testStationDB(t), ParseOptions{Static: tt.static})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, a := range arrivals["L08"] {
+				got[a.TripID] = a.Headsign
+			}
+			for trip, want := range tt.want {
+				if got[trip] != want {
+					t.Errorf("%s headsign %q, want %q", trip, got[trip], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFeedNormalizesStopIDs(t *testing.T) {
+	now := time.Now()
+	at := func(m int) int64 { return now.Add(time.Duration(m) * time.Minute).Unix() }
+	data := marshalFeed(t, now, tripEntity("t1", "L", nil,
+		stopUpdate(" l08n", at(2), at(2)),
+		stopUpdate("L06N ", at(5), at(5)),
+	))
+	arrivals, err := ParseFeed(data, testStationDB(t), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stop := range []string{"L08", "L06"} {
+		got := arrivals[stop]
+		if len(got) != 1 || got[0].StopID != stop || got[0].DirectionCode != "N" || got[0].Station == "" {
+			t.Errorf("%s: %+v", stop, got)
+		}
+	}
+}
+
+func TestParseFeedPlatform(t *testing.T) {
+	now := time.Now()
+	at := func(m int) int64 { return now.Add(time.Duration(m) * time.Minute).Unix() }
+	data := marshalFeed(t, now,
+		tripEntity("t1", "L", nil, stopUpdate("L08N", at(2), at(2)), stopUpdate(" l06n ", at(5), at(5))),
+		tripEntity("t2", "L", nil, stopUpdate("L08S", at(3), at(3))),
+	)
+	arrivals, err := ParseFeed(data, testStationDB(t), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"L08": {"L08N", "L08S"}, "L06": {"L06N"}}
+	for stop, platforms := range want {
+		got := arrivals[stop]
+		if len(got) != len(platforms) {
+			t.Fatalf("%s: %d arrivals, want %d", stop, len(got), len(platforms))
+		}
+		for i, a := range got {
+			if a.StopID != stop || a.Platform != platforms[i] {
+				t.Errorf("%s[%d]: stop %q platform %q, want %q %q", stop, i, a.StopID, a.Platform, stop, platforms[i])
+			}
+		}
+	}
+
+	b, err := json.Marshal(arrivals["L08"][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"platform":"L08N"`) {
+		t.Errorf("platform missing from JSON: %s", b)
+	}
+	b, err = json.Marshal(Arrival{StopID: "L08"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"platform"`) {
+		t.Errorf("empty platform not omitted: %s", b)
+	}
+}
+
+func TestParseFeedEastWest(t *testing.T) {
+	db, err := stations.LoadStationDB("../stations/testdata/crosstown_stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	at := func(m int) int64 { return now.Add(time.Duration(m) * time.Minute).Unix() }
+	data := marshalFeed(t, now,
+		// E/W platform suffixes
+		tripEntity("7-east", "7", nil, stopUpdate("725E", at(2), at(2))),
+		tripEntity("7-west", "7", nil, stopUpdate("725W", at(3), at(3))),
+		// No suffix: the NYCT descriptor's direction (2 east, 4 west) applies
+		tripEntity("L-east", "L", nyctExtension("0L 0800 8AV/RPY", true, 2), stopUpdate("L06", at(4), at(4))),
+		tripEntity("L-west", "L", nyctExtension("0L 0810 RPY/8AV", true, 4), stopUpdate("L06", at(5), at(5))),
+	)
+
+	for _, strategy := range []string{DirectionSuffix, DirectionTrip} {
+		t.Run(strategy, func(t *testing.T) {
+			arrivals, err := ParseFeed(data, db, ParseOptions{DirectionStrategy: strategy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, list := range arrivals {
+				for _, a := range list {
+					got[a.TripID] = a.DirectionCode + " " + a.Direction
+				}
+			}
+			want := map[string]string{"L-east": "E Brooklyn", "L-west": "W 8 Av"}
+			if strategy == DirectionSuffix {
+				want["7-east"] = "E Flushing"
+				want["7-west"] = "W Hudson Yards"
+			}
+			for trip, w := range want {
+				if got[trip] != w {
+					t.Errorf("%s: %q, want %q", trip, got[trip], w)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFeedDelayAndRawTimes(t *testing.T) {
+	now := time.Now()
+	at := func(m int) int64 { return now.Add(time.Duration(m) * time.Minute).Unix() }
+	withDelay := func(stu *gtfs.TripUpdate_StopTimeUpdate, arrival, departure *int32) *gtfs.TripUpdate_StopTimeUpdate {
+		if arrival != nil {
+			stu.Arrival.Delay = arrival
+		}
+		if departure != nil {
+			stu.Departure.Delay = departure
+		}
+		return stu
+	}
+	data := marshalFeed(t, now,
+		tripEntity("late", "L", nil, withDelay(stopUpdate("L08N", at(4), at(5)), proto.Int32(120), proto.Int32(90))),
+		tripEntity("early-departure", "L", nil, withDelay(stopUpdate("L08N", 0, at(6)), nil, proto.Int32(-30))),
+		tripEntity("departure-delay-only", "L", nil, withDelay(stopUpdate("L08S", at(7), at(7)), nil, proto.Int32(45))),
+		tripEntity("on-time", "L", nil, stopUpdate("L08S", at(8), 0)),
+	)
+	arrivals, err := ParseFeed(data, testStationDB(t), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]Arrival{
+		"late":                 {Delay: 120, ArrivalTime: at(4), DepartureTime: at(5)},
+		"early-departure":      {Delay: -30, DepartureTime: at(6)},
+		"departure-delay-only": {Delay: 45, ArrivalTime: at(7), DepartureTime: at(7)},
+		"on-time":              {ArrivalTime: at(8)},
+	}
+	for _, a := range arrivals["L08"] {
+		w, ok := want[a.TripID]
+		if !ok {
+			t.Errorf("unexpected trip %s", a.TripID)
+			continue
+		}
+		delete(want, a.TripID)
+		if a.Delay != w.Delay || a.ArrivalTime != w.ArrivalTime || a.DepartureTime != w.DepartureTime {
+			t.Errorf("%s: delay %d arrival %d departure %d, want %d %d %d",
+				a.TripID, a.Delay, a.ArrivalTime, a.DepartureTime, w.Delay, w.ArrivalTime, w.DepartureTime)
+		}
+		if a.TripID == "on-time" {
+			if b, _ := json.Marshal(a); strings.Contains(string(b), `"delay"`) || strings.Contains(string(b), `"departure_time"`) {
+				t.Errorf("absent fields serialized: %s", b)
+			}
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("trips missing from L08: %v", want)
+	}
+}
+
+func TestArrivalStatusBoundaries(t *testing.T) {
+	opts := ParseOptions{ArrivingWithin: 30 * time.Second, ApproachingWithin: 2 * time.Minute}
+	tests := []struct {
+		until time.Duration
+		want  string
+	}{
+		{0, "arriving"},
+		{29 * time.Second, "arriving"},
+		{30 * time.Second, "approaching"},
+		{119 * time.Second, "approaching"},
+		{2 * time.Minute, "scheduled"},
+		{20 * time.Minute, "scheduled"},
+	}
+	for _, tt := range tests {
+		if got := arrivalStatus(tt.until, opts); got != tt.want {
+			t.Errorf("arrivalStatus(%s) = %q, want %q", tt.until, got, tt.want)
+		}
+	}
+	if got := arrivalStatus(10*time.Second, ParseOptions{}); got != "" {
+		t.Errorf("no thresholds: %q, want unset", got)
+	}
+}
+
+func TestParseFeedStatusFromConfig(t *testing.T) {
+	// The feed clock pins "now" to the header, so the offsets are exact
+	cfg := loadTestConfig(t, "polling:\n  use_feed_clock: true\nstatus:\n  arriving: 45s\n  approaching: 3m\n")
+	f, _ := newTestFetcher(t, cfg)
+
+	now := time.Now().Truncate(time.Second)
+	var entities []*gtfs.FeedEntity
+	for _, s := range []int{0, 44, 45, 179, 180} {
+		entities = append(entities, tripEntity(fmt.Sprint(s), "L", nil, stopUpdate("L08N", now.Unix()+int64(s), 0)))
+	}
+	arrivals, err := ParseFeed(marshalFeed(t, now, entities...), testStationDB(t), f.parseOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"0": "arriving", "44": "arriving", "45": "approaching", "179": "approaching", "180": "scheduled"}
+	for _, a := range arrivals["L08"] {
+		if a.Status != want[a.TripID] {
+			t.Errorf("%ss out: status %q, want %q", a.TripID, a.Status, want[a.TripID])
+		}
+		// Minutes stays numeric alongside the label
+		if a.TripID == "0" && a.Minutes != 0 {
+			t.Errorf("arriving train at %d minutes", a.Minutes)
+		}
+	}
+	if len(arrivals["L08"]) != len(want) {
+		t.Errorf("%d arrivals, want %d", len(arrivals["L08"]), len(want))
+	}
+
+	// Turned off, arrivals carry no status at all
+	cfg = loadTestConfig(t, "polling:\n  use_feed_clock: true\nstatus:\n  enabled: false\n")
+	f, _ = newTestFetcher(t, cfg)
+	arrivals, err = ParseFeed(marshalFeed(t, now, entities...), testStationDB(t), f.parseOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range arrivals["L08"] {
+		if a.Status != "" {
+			t.Errorf("status disabled: %ss out has status %q", a.TripID, a.Status)
+		}
+	}
+}
+
+func TestParseFeedRecordsUnknownStops(t *testing.T) {
+	in := []time.Duration{2 * time.Minute, 4 * time.Minute}
+	data := buildFeed(t, time.Now(), []testTrip{
+		{id: "t1", route: "L", stops: []string{"L08N", "X99N"}, in: in},
+		{id: "t2", route: "L", stops: []string{"X99S", "Z01S"}, in: in},
+	})
+	arrivals, stats, err := ParseFeedWithStats(data, testStationDB(t), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stats.UnknownStops, []string{"X99", "Z01"}) {
+		t.Errorf("UnknownStops = %v, want [X99 Z01] once each", stats.UnknownStops)
+	}
+	if stats.DroppedUnknownStop != 3 || stats.ArrivalsKept != 1 || len(arrivals["L08"]) != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,173 @@
+package feeds
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+type FeedStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url,omitempty"` // the URL (primary or fallback) that last succeeded
+	LastFetch   time.Time `json:"last_fetch"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	// ErrorCategory of LastError
+	LastErrorCategory string     `json:"last_error_category,omitempty"`
+	Stats             ParseStats `json:"stats"`
+	Enabled           bool       `json:"enabled"`
+	// Stations in the DB whose lines map to this feed
+	StopsMapped int `json:"stops_mapped"`
+
+	// Seconds between the feed's header timestamp and now, from the last
+	// successful parse; how far behind real time the provider is
+	FeedAge float64 `json:"feed_age_seconds,omitempty"`
+	// Fetches succeed but the header timestamp is older than max_feed_age
+	Stale bool `json:"stale"`
+
+	Breaker             BreakerState `json:"breaker"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+}
+
+// recordStatus must be called with f.mu held.
+func (f *FeedFetcher) recordStatus(name string, at time.Time, url string, stats ParseStats, err error) {
+	st, ok := f.status[name]
+	if !ok {
+		st = &FeedStatus{Name: name}
+		f.status[name] = st
+	}
+
+	st.LastFetch = at
+	if err != nil {
+		st.LastError = err.Error()
+		st.LastErrorCategory = ErrorCategory(err)
+		return
+	}
+	if !slices.Equal(st.Stats.UnknownStops, stats.UnknownStops) && len(stats.UnknownStops) > 0 {
+		fmt.Printf("Feed %s has stops missing from the station CSV: %s\n", name, strings.Join(stats.UnknownStops, ","))
+	}
+	st.LastSuccess = at
+	st.URL = url
+	st.LastError = ""
+	st.LastErrorCategory = ""
+	st.Stats = stats
+}
+
+func (f *FeedFetcher) Status() []FeedStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mapped := f.stationDB.Load().StopsPerFeed()
+	result := make([]FeedStatus, 0, len(f.feeds))
+	for name := range f.feeds {
+		st := FeedStatus{Name: name}
+		if s, ok := f.status[name]; ok {
+			st = *s
+		}
+		st.Enabled = !f.disabled[name]
+		st.StopsMapped = mapped[name]
+		if ts := st.Stats.FeedTimestamp; ts > 0 {
+			st.FeedAge = time.Since(time.Unix(ts, 0)).Seconds()
+		}
+		st.Stale = f.frozen(name, time.Now())
+		if b, ok := f.breakers[name]; ok {
+			st.Breaker = b.state
+			st.ConsecutiveFailures = b.failures
+		}
+		result = append(result, st)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// FeedsHealthy reports whether every named feed (every configured feed
+// when names is empty) is enabled, has fetched successfully at least
+// once, didn't fail its latest fetch and isn't frozen. It tells an empty
+// arrivals list that means "no trains" from one that means "no data".
+func (f *FeedFetcher) FeedsHealthy(names []string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(names) == 0 {
+		for name := range f.feeds {
+			names = append(names, name)
+		}
+	}
+	now := time.Now()
+	for _, name := range names {
+		st, ok := f.status[name]
+		if !ok || f.disabled[name] || st.LastSuccess.IsZero() || st.LastError != "" || f.frozen(name, now) {
+			return false
+		}
+	}
+	return true
+}
+
+type FetchStats struct {
+	Successes    int64   `json:"successes"`
+	Failures     int64   `json:"failures"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	// Failures by ErrorCategory
+	Errors map[string]int64 `json:"errors,omitempty"`
+}
+
+type fetchCounters struct {
+	successes    int64
+	failures     int64
+	totalLatency time.Duration
+	errors       map[string]int64
+}
+
+// recordFetch must be called with f.mu held.
+func (f *FeedFetcher) recordFetch(name string, latency time.Duration, err error) {
+	c, ok := f.counters[name]
+	if !ok {
+		c = &fetchCounters{}
+		f.counters[name] = c
+	}
+	if err != nil {
+		c.failures++
+		if c.errors == nil {
+			c.errors = make(map[string]int64)
+		}
+		c.errors[ErrorCategory(err)]++
+	} else {
+		c.successes++
+	}
+	c.totalLatency += latency
+}
+
+// FetchStats returns per-feed counters accumulated since startup, or since
+// the last call with reset set.
+func (f *FeedFetcher) FetchStats(reset bool) map[string]FetchStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := make(map[string]FetchStats, len(f.feeds))
+	for name := range f.feeds {
+		var st FetchStats
+		if c, ok := f.counters[name]; ok {
+			st.Successes = c.successes
+			st.Failures = c.failures
+			if len(c.errors) > 0 {
+				st.Errors = maps.Clone(c.errors)
+			}
+			if n := c.successes + c.failures; n > 0 {
+				st.AvgLatencyMs = float64(c.totalLatency) / float64(time.Millisecond) / float64(n)
+			}
+		}
+		result[name] = st
+	}
+
+	if reset {
+		f.counters = make(map[string]*fetchCounters)
+	}
+	return result
+}
@@ -3,6 +3,8 @@ package stations
 import (
     "encoding/csv"
     "os"
+    "sort"
+    "strconv"
     "strings"
 )
 
@@ -10,6 +12,18 @@ type StationDB struct {
     stations    map[string]StationInfo
     allStations []StationInfo
     lineToFeed  map[string]string
+    transfers   map[string][]Transfer // from stop ID -> walking transfers
+    lineWeight  float64               // search boost per extra line at a complex
+}
+
+// NewStationDB returns an empty DB; lookups miss and listings are empty.
+func NewStationDB() *StationDB {
+    return &StationDB{
+        stations:    make(map[string]StationInfo),
+        allStations: []StationInfo{},
+        lineToFeed:  makeLineToFeedMap(),
+        lineWeight:  DefaultSearchLineWeight,
+    }
 }
 
 func LoadStationDB(csvPath string) (*StationDB, error) {
@@ -20,14 +34,30 @@ func LoadStationDB(csvPath string) (*StationDB, error) {
     defer f.Close()
 
     reader := csv.NewReader(f)
+    // Short rows are skipped below rather than failing the whole load
+    reader.FieldsPerRecord = -1
     records, err := reader.ReadAll()
     if err != nil {
         return nil, err
     }
 
-    db := &StationDB{
-        stations:   make(map[string]StationInfo),
-        lineToFeed: makeLineToFeedMap(),
+    db := NewStationDB()
+
+    // East/west labels aren't in the MTA export, but are picked up by
+    // header name when a supplemented CSV provides them. ADA is in the
+    // export, but found the same way so trimmed CSVs without it still load
+    eastCol, westCol, adaCol := -1, -1, -1
+    if len(records) > 0 {
+        for i, h := range records[0] {
+            switch strings.TrimSpace(h) {
+            case "East Direction Label":
+                eastCol = i
+            case "West Direction Label":
+                westCol = i
+            case "ADA":
+                adaCol = i
+            }
+        }
     }
 
     // Skip header
@@ -41,32 +71,53 @@ func LoadStationDB(csvPath string) (*StationDB, error) {
             continue
         }
 
-        stopID := record[2]
-        name := record[5]
+        complexID := strings.TrimSpace(record[1])
+        stopID := NormalizeStopID(record[2])
+        name := strings.TrimSpace(record[5])
         linesStr := record[7]
-        northLabel := record[11]
-        southLabel := record[12]
+        lat, _ := strconv.ParseFloat(strings.TrimSpace(record[9]), 64)
+        lon, _ := strconv.ParseFloat(strings.TrimSpace(record[10]), 64)
+        northLabel := strings.TrimSpace(record[11])
+        southLabel := strings.TrimSpace(record[12])
+        var eastLabel, westLabel string
+        if eastCol >= 0 && eastCol < len(record) {
+            eastLabel = strings.TrimSpace(record[eastCol])
+        }
+        if westCol >= 0 && westCol < len(record) {
+            westLabel = strings.TrimSpace(record[westCol])
+        }
+        // 1 is fully accessible, 2 accessible in one direction, 0 not
+        var ada bool
+        if adaCol >= 0 && adaCol < len(record) {
+            v := strings.TrimSpace(record[adaCol])
+            ada = v == "1" || v == "2"
+        }
 
-        lines := strings.Fields(linesStr)
-        
-        // Derive feeds
-        feedsSet := make(map[string]bool)
-        for _, line := range lines {
-            if feed, ok := db.lineToFeed[line]; ok {
-                feedsSet[feed] = true
-            }
+        // Rows without an ID or name would surface as blank entries in
+        // /stations and search
+        if stopID == "" || name == "" {
+            continue
         }
-        var feeds []string
-        for feed := range feedsSet {
-            feeds = append(feeds, feed)
+
+        lines := []string{}
+        for _, l := range strings.Fields(linesStr) {
+            lines = append(lines, strings.ToUpper(l))
         }
 
+        feeds := db.feedsForLines(lines)
+
         info := StationInfo{
             StopID:     stopID,
+            ComplexID:  complexID,
             Name:       name,
             Lines:      lines,
             NorthLabel: northLabel,
             SouthLabel: southLabel,
+            EastLabel:  eastLabel,
+            WestLabel:  westLabel,
+            Lat:        lat,
+            Lon:        lon,
+            ADA:        ada,
             Feeds:      feeds,
         }
 
@@ -77,44 +128,220 @@ func LoadStationDB(csvPath string) (*StationDB, error) {
     return db, nil
 }
 
+// DefaultSearchLineWeight is how much each line beyond the first at a
+// station's complex adds to its search score.
+const DefaultSearchLineWeight = 0.5
+
+// SetSearchLineWeight sets the per-line hub boost in Search; 0 ranks by
+// match quality alone.
+func (db *StationDB) SetSearchLineWeight(w float64) {
+    db.lineWeight = max(w, 0)
+}
+
+// SetLineFeeds replaces the built-in NYC line -> feed mapping, e.g. for
+// another agency's feeds, and re-derives every station's feeds.
+func (db *StationDB) SetLineFeeds(lineToFeed map[string]string) {
+    db.lineToFeed = make(map[string]string, len(lineToFeed))
+    for line, feed := range lineToFeed {
+        db.lineToFeed[strings.ToUpper(strings.TrimSpace(line))] = feed
+    }
+
+    for i, s := range db.allStations {
+        s.Feeds = db.feedsForLines(s.Lines)
+        db.allStations[i] = s
+        db.stations[s.StopID] = s
+    }
+}
+
+// feedsForLines derives the sorted feeds serving a station's lines.
+func (db *StationDB) feedsForLines(lines []string) []string {
+    feedsSet := make(map[string]bool)
+    for _, line := range lines {
+        if feed, ok := db.lineToFeed[line]; ok {
+            feedsSet[feed] = true
+        }
+    }
+    feeds := make([]string, 0, len(feedsSet))
+    for feed := range feedsSet {
+        feeds = append(feeds, feed)
+    }
+    sort.Strings(feeds)
+    return feeds
+}
+
 func (db *StationDB) GetAllStations() []StationInfo {
     return db.allStations
 }
 
 func (db *StationDB) GetStation(stopID string) (StationInfo, bool) {
-    s, ok := db.stations[stopID]
+    s, ok := db.stations[NormalizeStopID(stopID)]
     return s, ok
 }
 
+// NormalizeStopID trims and uppercases a stop ID so lookups tolerate
+// client input like " l08 ".
+func NormalizeStopID(stopID string) string {
+    return strings.ToUpper(strings.TrimSpace(stopID))
+}
+
+// Search matches station names (substring) and lines (exact), best first:
+// exact and prefix name matches rank above the rest, and stations in
+// complexes serving more lines get a boost so hubs lead ambiguous queries.
+// Ties fall back to name, then stop ID.
 func (db *StationDB) Search(query string) []StationInfo {
     query = strings.ToLower(query)
-    var results []StationInfo
+    complexLines := db.complexLineCounts()
+
+    type scored struct {
+        s     StationInfo
+        score float64
+    }
+    var matches []scored
     seen := make(map[string]bool)
 
     for _, s := range db.allStations {
         if seen[s.StopID] {
             continue
         }
-        nameMatch := strings.Contains(strings.ToLower(s.Name), query)
-        lineMatch := false
+        score := matchScore(s, query)
+        if score == 0 {
+            continue
+        }
+        seen[s.StopID] = true
+
+        lines := complexLines[s.ComplexID]
+        if s.ComplexID == "" {
+            lines = len(s.Lines)
+        }
+        if lines > 1 {
+            score += db.lineWeight * float64(lines-1)
+        }
+        matches = append(matches, scored{s, score})
+    }
+
+    sort.SliceStable(matches, func(i, j int) bool {
+        a, b := matches[i], matches[j]
+        if a.score != b.score {
+            return a.score > b.score
+        }
+        if a.s.Name != b.s.Name {
+            return a.s.Name < b.s.Name
+        }
+        return a.s.StopID < b.s.StopID
+    })
+
+    results := make([]StationInfo, len(matches))
+    for i, m := range matches {
+        results[i] = m.s
+    }
+    return results
+}
+
+// matchScore rates how well a station matches a lowercased query; 0 is no
+// match.
+func matchScore(s StationInfo, query string) float64 {
+    name := strings.ToLower(s.Name)
+    var score float64
+    switch {
+    case name == query:
+        score = 4
+    case strings.HasPrefix(name, query):
+        score = 3
+    case strings.Contains(name, query):
+        score = 1
+    }
+    for _, l := range s.Lines {
+        if strings.ToLower(l) == query {
+            score = max(score, 2)
+            break
+        }
+    }
+    return score
+}
+
+// complexLineCounts returns the number of distinct lines served across each
+// station complex.
+func (db *StationDB) complexLineCounts() map[string]int {
+    lines := make(map[string]map[string]bool)
+    for _, s := range db.allStations {
+        if s.ComplexID == "" {
+            continue
+        }
+        set := lines[s.ComplexID]
+        if set == nil {
+            set = make(map[string]bool)
+            lines[s.ComplexID] = set
+        }
         for _, l := range s.Lines {
-            if strings.ToLower(l) == query {
-                lineMatch = true
+            set[l] = true
+        }
+    }
+
+    counts := make(map[string]int, len(lines))
+    for id, set := range lines {
+        counts[id] = len(set)
+    }
+    return counts
+}
+
+// UnknownStops returns, sorted, the IDs with no matching station.
+func (db *StationDB) UnknownStops(stopIDs map[string]bool) []string {
+    var unknown []string
+    for id := range stopIDs {
+        if _, ok := db.GetStation(id); !ok {
+            unknown = append(unknown, id)
+        }
+    }
+    sort.Strings(unknown)
+    return unknown
+}
+
+// StopsInBox returns the stops whose coordinates fall inside the box,
+// inclusive of its edges.
+func (db *StationDB) StopsInBox(minLat, minLon, maxLat, maxLon float64) map[string]bool {
+    stopIDs := make(map[string]bool)
+    for _, s := range db.allStations {
+        if s.Lat >= minLat && s.Lat <= maxLat && s.Lon >= minLon && s.Lon <= maxLon {
+            stopIDs[s.StopID] = true
+        }
+    }
+    return stopIDs
+}
+
+func (db *StationDB) GetStopsForLines(lines []string) []string {
+    wanted := make(map[string]bool)
+    for _, l := range lines {
+        wanted[strings.ToUpper(l)] = true
+    }
+
+    var stopIDs []string
+    for _, s := range db.allStations {
+        for _, l := range s.Lines {
+            if wanted[strings.ToUpper(l)] {
+                stopIDs = append(stopIDs, s.StopID)
                 break
             }
         }
-        if nameMatch || lineMatch {
-            results = append(results, s)
-            seen[s.StopID] = true
+    }
+    return stopIDs
+}
+
+// StopsPerFeed counts the stations each feed serves, as a sanity check on
+// the line -> feed mapping.
+func (db *StationDB) StopsPerFeed() map[string]int {
+    counts := make(map[string]int)
+    for _, s := range db.allStations {
+        for _, feed := range s.Feeds {
+            counts[feed]++
         }
     }
-    return results
+    return counts
 }
 
 func (db *StationDB) GetFeedsForStops(stopIDs []string) []string {
     feedsSet := make(map[string]bool)
     for _, stopID := range stopIDs {
-        if s, ok := db.stations[stopID]; ok {
+        if s, ok := db.stations[NormalizeStopID(stopID)]; ok {
             for _, feed := range s.Feeds {
                 feedsSet[feed] = true
             }
@@ -124,6 +351,7 @@ func (db *StationDB) GetFeedsForStops(stopIDs []string) []string {
     for feed := range feedsSet {
         feeds = append(feeds, feed)
     }
+    sort.Strings(feeds)
     return feeds
 }
 
@@ -0,0 +1,221 @@
+package stations
+
+import (
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestLoadStationDBMessyRows(t *testing.T) {
+	db, err := LoadStationDB("testdata/messy_stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, s := range db.GetAllStations() {
+		ids = append(ids, s.StopID)
+	}
+	// Blank name, blank stop ID and too few columns are all dropped
+	if want := []string{"L08", "A24", "G22"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("stations %v, want %v", ids, want)
+	}
+
+	bedford, _ := db.GetStation("L08")
+	want := StationInfo{
+		StopID: "L08", ComplexID: "611", Name: "Bedford Av", Lines: []string{"L"},
+		NorthLabel: "Manhattan", SouthLabel: "Canarsie - Rockaway Parkway",
+		Lat: 40.717304, Lon: -73.956872, Feeds: []string{"L"},
+	}
+	if !reflect.DeepEqual(bedford, want) {
+		t.Errorf("L08 = %+v\nwant %+v", bedford, want)
+	}
+
+	columbus, _ := db.GetStation("A24")
+	if columbus.Name != "59 St-Columbus Circle" || !reflect.DeepEqual(columbus.Lines, []string{"A", "C", "B", "D"}) {
+		t.Errorf("A24 name %q lines %q", columbus.Name, columbus.Lines)
+	}
+
+	court, _ := db.GetStation("G22")
+	if court.Lines == nil || len(court.Lines) != 0 {
+		t.Errorf("G22 lines %#v, want empty but not nil", court.Lines)
+	}
+	if court.Feeds == nil || len(court.Feeds) != 0 {
+		t.Errorf("G22 feeds %#v, want empty but not nil", court.Feeds)
+	}
+
+	if got := db.Search("bedford"); len(got) != 1 || got[0].StopID != "L08" {
+		t.Errorf("Search(bedford) = %v", got)
+	}
+	for _, s := range db.Search("st") {
+		if s.Name == "" {
+			t.Errorf("Search returned an unnamed station: %+v", s)
+		}
+	}
+}
+
+func TestLoadStationDBADA(t *testing.T) {
+	db, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 is accessible, 2 accessible in one direction, 0 not
+	for id, want := range map[string]bool{"L08": true, "R15": true, "R01": false} {
+		if s, _ := db.GetStation(id); s.ADA != want {
+			t.Errorf("%s ADA = %t, want %t", id, s.ADA, want)
+		}
+	}
+
+	// CSVs without the column load with the flag off
+	messy, err := LoadStationDB("testdata/messy_stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := messy.GetStation("L08"); s.ADA {
+		t.Error("L08 ADA set from a CSV with no ADA column")
+	}
+}
+
+func TestGetStationNormalizesID(t *testing.T) {
+	db, err := LoadStationDB("testdata/messy_stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"L08", "l08", " L08", "l08 \t"} {
+		if s, ok := db.GetStation(id); !ok || s.StopID != "L08" {
+			t.Errorf("GetStation(%q) = %q, %t", id, s.StopID, ok)
+		}
+	}
+	if got := db.GetFeedsForStops([]string{" a24", "l08 "}); !reflect.DeepEqual(got, []string{"ACE", "BDFM", "L"}) {
+		t.Errorf("GetFeedsForStops = %v", got)
+	}
+	if got := db.UnknownStops(map[string]bool{"g22": true, "Z99": true}); !reflect.DeepEqual(got, []string{"Z99"}) {
+		t.Errorf("UnknownStops = %v, want [Z99]", got)
+	}
+}
+
+func TestLoadStationDBEastWestLabels(t *testing.T) {
+	db, err := LoadStationDB("testdata/crosstown_stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := db.GetStation("725")
+	for code, want := range map[string]string{"N": "Queens", "S": "34 St - Hudson Yards", "E": "Flushing", "W": "Hudson Yards", "X": ""} {
+		if got := s.DirectionLabel(code); got != want {
+			t.Errorf("725 DirectionLabel(%s) = %q, want %q", code, got, want)
+		}
+	}
+
+	// The MTA export has no east/west columns
+	plain, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := plain.GetStation("725"); s.EastLabel != "" || s.WestLabel != "" {
+		t.Errorf("east/west labels from nowhere: %+v", s)
+	}
+}
+
+func TestStopsInBox(t *testing.T) {
+	db, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := db.StopsInBox(40.71, -73.96, 40.72, -73.95)
+	want := map[string]bool{"L08": true, "L10": true, "G29": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Williamsburg box = %v, want %v", got, want)
+	}
+
+	// Edges are inclusive: a box shrunk to Bedford Av's point still holds it
+	if got := db.StopsInBox(40.717304, -73.956872, 40.717304, -73.956872); !reflect.DeepEqual(got, map[string]bool{"L08": true}) {
+		t.Errorf("point box = %v, want [L08]", got)
+	}
+	if got := db.StopsInBox(41, -73, 42, -72); len(got) != 0 {
+		t.Errorf("box outside the city = %v", got)
+	}
+}
+
+func TestStationFeedsSorted(t *testing.T) {
+	first, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// E F M R at Forest Hills spans three feeds
+	if s, _ := first.GetStation("G08"); !reflect.DeepEqual(s.Feeds, []string{"ACE", "BDFM", "NQRW"}) {
+		t.Errorf("G08 feeds = %v, want [ACE BDFM NQRW]", s.Feeds)
+	}
+	for _, s := range first.GetAllStations() {
+		if !sort.StringsAreSorted(s.Feeds) {
+			t.Errorf("%s feeds %v not sorted", s.StopID, s.Feeds)
+		}
+	}
+
+	// Reloading gives the same lists, not a new map iteration order
+	for i := 0; i < 5; i++ {
+		again, err := LoadStationDB("../../data/stations.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(again.GetAllStations(), first.GetAllStations()) {
+			t.Fatal("stations differ between loads")
+		}
+	}
+
+	got := first.GetFeedsForStops([]string{"L08", "D14", "G08", "A32", "L08"})
+	if want := []string{"ACE", "BDFM", "L", "NQRW"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetFeedsForStops = %v, want %v", got, want)
+	}
+}
+
+func TestSetLineFeeds(t *testing.T) {
+	db, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another agency's names; line keys are matched like CSV routes
+	db.SetLineFeeds(map[string]string{" l ": "canarsie", "G": "crosstown", "M": "myrtle"})
+
+	tests := map[string][]string{
+		"L08": {"canarsie"},
+		"G29": {"crosstown"},
+		"127": {}, // the 1/2/3 aren't in the custom mapping
+	}
+	for id, want := range tests {
+		s, _ := db.GetStation(id)
+		if !slices.Equal(s.Feeds, want) {
+			t.Errorf("%s feeds = %v, want %v", id, s.Feeds, want)
+		}
+	}
+	for _, s := range db.GetAllStations() {
+		if s.StopID == "L08" && !reflect.DeepEqual(s.Feeds, []string{"canarsie"}) {
+			t.Errorf("GetAllStations L08 feeds = %v", s.Feeds)
+		}
+	}
+	got := db.GetFeedsForStops([]string{"L08", "G29", "127"})
+	if want := []string{"canarsie", "crosstown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetFeedsForStops = %v, want %v", got, want)
+	}
+}
+
+func TestStopsPerFeed(t *testing.T) {
+	db, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Counted independently from the CSV's Daytime Routes column
+	want := map[string]int{
+		"1234567": 187, "ACE": 80, "BDFM": 119, "G": 21,
+		"JZ": 30, "L": 24, "NQRW": 85, "SIR": 21,
+	}
+	if got := db.StopsPerFeed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("StopsPerFeed = %v, want %v", got, want)
+	}
+
+	// A mapping bug shows up as a feed with nothing mapped
+	db.SetLineFeeds(map[string]string{"L": "canarsie"})
+	if got := db.StopsPerFeed(); !reflect.DeepEqual(got, map[string]int{"canarsie": 24}) {
+		t.Errorf("custom mapping: %v", got)
+	}
+}
@@ -0,0 +1,227 @@
+package stations
+
+import (
+    "encoding/csv"
+    "errors"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+type Route struct {
+    RouteID   string `json:"route_id"`
+    ShortName string `json:"short_name"`
+    LongName  string `json:"long_name"`
+    Color     string `json:"color"`
+    TextColor string `json:"text_color"`
+}
+
+// StaticGTFS holds optional enrichment from the static GTFS schedule
+// (routes.txt, trips.txt). Any file that is missing just leaves its
+// lookups empty.
+type StaticGTFS struct {
+    routes    map[string]Route
+    headsigns map[string]string // trip ID -> headsign
+}
+
+func LoadStaticGTFS(dir string) (*StaticGTFS, error) {
+    g := &StaticGTFS{
+        routes:    make(map[string]Route),
+        headsigns: make(map[string]string),
+    }
+    if dir == "" {
+        return g, nil
+    }
+
+    routes, err := readGTFSFile(filepath.Join(dir, "routes.txt"))
+    if err != nil {
+        return nil, err
+    }
+    for _, row := range routes {
+        id := row["route_id"]
+        if id == "" {
+            continue
+        }
+        g.routes[id] = Route{
+            RouteID:   id,
+            ShortName: row["route_short_name"],
+            LongName:  row["route_long_name"],
+            Color:     row["route_color"],
+            TextColor: row["route_text_color"],
+        }
+    }
+
+    trips, err := readGTFSFile(filepath.Join(dir, "trips.txt"))
+    if err != nil {
+        return nil, err
+    }
+    for _, row := range trips {
+        id, headsign := row["trip_id"], row["trip_headsign"]
+        if id == "" || headsign == "" {
+            continue
+        }
+        g.headsigns[id] = headsign
+    }
+    // Static NYCT trip IDs carry a schedule prefix the realtime feed
+    // omits: "ASP23GEN-1093-Weekday-00_036850_1..N03R" vs "036850_1..N03R".
+    // Short keys never replace a full trip ID from the file.
+    for _, row := range trips {
+        id, headsign := row["trip_id"], row["trip_headsign"]
+        if headsign == "" {
+            continue
+        }
+        if prefix := nyctSchedulePrefix.FindString(id); prefix != "" {
+            if _, ok := g.headsigns[id[len(prefix):]]; !ok {
+                g.headsigns[id[len(prefix):]] = headsign
+            }
+        }
+    }
+
+    return g, nil
+}
+
+// nyctSchedulePrefix matches the schedule part of a static NYCT trip ID,
+// e.g. "ASP23GEN-1093-Weekday-00_". Other IDs are indexed as they are.
+var nyctSchedulePrefix = regexp.MustCompile(`^[A-Z0-9]+-[A-Za-z0-9-]+_`)
+
+func (g *StaticGTFS) Route(routeID string) (Route, bool) {
+    if g == nil {
+        return Route{}, false
+    }
+    r, ok := g.routes[routeID]
+    return r, ok
+}
+
+// Lines is AllLines with routes.txt layered on: a route's long name, and
+// its colors where set. Routes the built-in palette doesn't know (another
+// agency's feed) are listed too, as circles.
+func (g *StaticGTFS) Lines() []LineInfo {
+    lines := AllLines()
+    if g == nil || len(g.routes) == 0 {
+        return lines
+    }
+
+    known := make(map[string]bool, len(lines))
+    for i := range lines {
+        known[lines[i].Line] = true
+        if r, ok := g.routes[lines[i].Line]; ok {
+            lines[i] = r.apply(lines[i])
+        }
+    }
+    for id, r := range g.routes {
+        if !known[id] {
+            lines = append(lines, r.apply(LineInfo{Line: id, Shape: "circle"}))
+        }
+    }
+    sort.Slice(lines, func(i, j int) bool {
+        return lines[i].Line < lines[j].Line
+    })
+    return lines
+}
+
+func (r Route) apply(info LineInfo) LineInfo {
+    info.Name = r.LongName
+    if r.Color != "" {
+        info.Color = strings.ToUpper(r.Color)
+    }
+    if r.TextColor != "" {
+        info.TextColor = strings.ToUpper(r.TextColor)
+    }
+    return info
+}
+
+func (g *StaticGTFS) TripHeadsign(tripID string) (string, bool) {
+    if g == nil {
+        return "", false
+    }
+    h, ok := g.headsigns[tripID]
+    return h, ok
+}
+
+// readGTFSFile reads a GTFS CSV into header-keyed rows. A missing file
+// yields no rows rather than an error.
+func readGTFSFile(path string) ([]map[string]string, error) {
+    f, err := os.Open(path)
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    reader := csv.NewReader(f)
+    reader.FieldsPerRecord = -1
+    records, err := reader.ReadAll()
+    if err != nil {
+        return nil, err
+    }
+    if len(records) == 0 {
+        return nil, nil
+    }
+
+    header := records[0]
+    if len(header) > 0 {
+        header[0] = strings.TrimPrefix(header[0], "\ufeff")
+    }
+
+    rows := make([]map[string]string, 0, len(records)-1)
+    for _, record := range records[1:] {
+        row := make(map[string]string, len(header))
+        for i, col := range header {
+            if i < len(record) {
+                row[col] = strings.TrimSpace(record[i])
+            }
+        }
+        rows = append(rows, row)
+    }
+    return rows, nil
+}
+
+type Transfer struct {
+    ToStopID        string   `json:"to_stop_id"`
+    ToName          string   `json:"to_name"`
+    Lines           []string `json:"lines"`
+    MinTransferTime int      `json:"min_transfer_time"` // seconds
+}
+
+// LoadTransfers reads a GTFS transfers.txt into the DB. The file is
+// optional; when it's missing the DB simply has no transfers.
+func (db *StationDB) LoadTransfers(path string) error {
+    rows, err := readGTFSFile(path)
+    if err != nil {
+        return err
+    }
+
+    transfers := make(map[string][]Transfer)
+    for _, row := range rows {
+        from := NormalizeStopID(row["from_stop_id"])
+        to := NormalizeStopID(row["to_stop_id"])
+        // MTA lists every station as a transfer to itself
+        if from == "" || to == "" || from == to {
+            continue
+        }
+        toStation, ok := db.stations[to]
+        if !ok {
+            continue
+        }
+        minTime, _ := strconv.Atoi(row["min_transfer_time"])
+        transfers[from] = append(transfers[from], Transfer{
+            ToStopID:        to,
+            ToName:          toStation.Name,
+            Lines:           toStation.Lines,
+            MinTransferTime: minTime,
+        })
+    }
+
+    db.transfers = transfers
+    return nil
+}
+
+func (db *StationDB) GetTransfers(stopID string) []Transfer {
+    return db.transfers[NormalizeStopID(stopID)]
+}
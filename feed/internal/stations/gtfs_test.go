@@ -0,0 +1,147 @@
+package stations
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadStaticGTFS(t *testing.T) {
+	g, err := LoadStaticGTFS("testdata/gtfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"ASP23GEN-L047-Weekday-00_036850_L..N01R", "036850_L..N01R"} {
+		if h, ok := g.TripHeadsign(id); !ok || h != "8 Av" {
+			t.Errorf("TripHeadsign(%q) = %q, %t; want 8 Av", id, h, ok)
+		}
+	}
+	if _, ok := g.TripHeadsign("no-headsign"); ok {
+		t.Error("trip with an empty headsign was indexed")
+	}
+
+	r, ok := g.Route("L")
+	if !ok || r.LongName != "14 St-Canarsie Local" || r.Color != "a7a9ac" {
+		t.Errorf("Route(L) = %+v, %t", r, ok)
+	}
+}
+
+func TestLoadStaticGTFSUnprefixedTripIDs(t *testing.T) {
+	dir := t.TempDir()
+	trips := `route_id,trip_id,service_id,trip_headsign
+L,L_100_N,Weekday,8 Av
+M,M_100_N,Weekday,Middle Village
+L,L_200,Weekday,Canarsie
+L,200,Weekday,Broadway Junction
+`
+	if err := os.WriteFile(filepath.Join(dir, "trips.txt"), []byte(trips), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := LoadStaticGTFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No schedule prefix, so nothing is cut at the first underscore: each
+	// ID keeps its own headsign
+	for id, want := range map[string]string{
+		"L_100_N": "8 Av", "M_100_N": "Middle Village", "L_200": "Canarsie", "200": "Broadway Junction",
+	} {
+		if h, ok := g.TripHeadsign(id); !ok || h != want {
+			t.Errorf("TripHeadsign(%q) = %q, %t; want %q", id, h, ok, want)
+		}
+	}
+	if h, ok := g.TripHeadsign("100_N"); ok {
+		t.Errorf("TripHeadsign(100_N) = %q from a stripped unprefixed ID", h)
+	}
+}
+
+func TestLoadStaticGTFSMissingFiles(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		g, err := LoadStaticGTFS(dir)
+		if err != nil {
+			t.Fatalf("LoadStaticGTFS(%q): %v", dir, err)
+		}
+		if _, ok := g.TripHeadsign("036850_L..N01R"); ok {
+			t.Errorf("dir %q: headsign from nowhere", dir)
+		}
+		if got, want := len(g.Lines()), len(AllLines()); got != want {
+			t.Errorf("dir %q: %d lines, want the built-in %d", dir, got, want)
+		}
+	}
+
+	var none *StaticGTFS
+	if len(none.Lines()) != len(AllLines()) {
+		t.Error("nil StaticGTFS should list the built-in lines")
+	}
+}
+
+func TestStaticGTFSLines(t *testing.T) {
+	g, err := LoadStaticGTFS("testdata/gtfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := map[string]LineInfo{}
+	for _, l := range g.Lines() {
+		lines[l.Line] = l
+	}
+
+	want := map[string]LineInfo{
+		// Named, colors from routes.txt
+		"L": {Line: "L", Color: "A7A9AC", TextColor: "FFFFFF", Shape: "circle", Name: "14 St-Canarsie Local"},
+		// Express variant keeps its diamond and the palette's text color
+		// when routes.txt leaves route_text_color empty
+		"6X": {Line: "6X", Color: "00933C", TextColor: "FFFFFF", Shape: "diamond", Name: "Pelham Bay Park Express"},
+		// Not in the built-in palette
+		"T": {Line: "T", Color: "00ADD0", TextColor: "000000", Shape: "circle", Name: "2 Av"},
+		// Not in routes.txt: unchanged
+		"G": {Line: "G", Color: "6CBE45", TextColor: "FFFFFF", Shape: "circle"},
+	}
+	for id, w := range want {
+		if got := lines[id]; got != w {
+			t.Errorf("line %s = %+v, want %+v", id, got, w)
+		}
+	}
+}
+
+func TestLoadTransfers(t *testing.T) {
+	db, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LoadTransfers("testdata/gtfs/transfers.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The self-transfer and the one to an unknown stop are dropped
+	got := db.GetTransfers("127")
+	want := []Transfer{
+		{ToStopID: "725", ToName: "Times Sq-42 St", Lines: []string{"7"}, MinTransferTime: 180},
+		{ToStopID: "R16", ToName: "Times Sq-42 St", Lines: []string{"N", "Q", "R", "W"}, MinTransferTime: 300},
+		{ToStopID: "A27", ToName: "42 St-Port Authority Bus Terminal", Lines: []string{"A", "C", "E"}, MinTransferTime: 420},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTransfers(127) = %+v\nwant %+v", got, want)
+	}
+	if got := db.GetTransfers(" a27"); len(got) != 1 || got[0].ToStopID != "127" {
+		t.Errorf("GetTransfers(a27) = %+v, want the padded row back to 127", got)
+	}
+	if got := db.GetTransfers("L08"); got != nil {
+		t.Errorf("GetTransfers(L08) = %+v, want none", got)
+	}
+}
+
+func TestLoadTransfersMissingFile(t *testing.T) {
+	db, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LoadTransfers(t.TempDir() + "/transfers.txt"); err != nil {
+		t.Fatalf("missing transfers.txt: %v", err)
+	}
+	if got := db.GetTransfers("127"); got != nil {
+		t.Errorf("transfers from nowhere: %+v", got)
+	}
+}
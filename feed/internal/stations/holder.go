@@ -0,0 +1,32 @@
+package stations
+
+import "sync/atomic"
+
+// Holder publishes the active StationDB. Readers take a consistent
+// snapshot with Load; a reload swaps in a new DB with Store without
+// blocking them.
+type Holder struct {
+    db  atomic.Pointer[StationDB]
+    gen atomic.Uint64
+}
+
+func NewHolder(db *StationDB) *Holder {
+    h := &Holder{}
+    h.db.Store(db)
+    return h
+}
+
+func (h *Holder) Load() *StationDB {
+    return h.db.Load()
+}
+
+func (h *Holder) Store(db *StationDB) {
+    h.db.Store(db)
+    h.gen.Add(1)
+}
+
+// Generation counts Stores, so anything derived from station data (ETags,
+// rendered responses) can tell when it was built from a replaced DB.
+func (h *Holder) Generation() uint64 {
+    return h.gen.Load()
+}
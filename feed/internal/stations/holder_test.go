@@ -0,0 +1,67 @@
+package stations
+
+import (
+	"sync"
+	"testing"
+)
+
+// Run with -race: readers must never see a half-swapped DB.
+func TestHolderConcurrentSwap(t *testing.T) {
+	full, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := LoadStationDB("testdata/messy_stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[*StationDB]int{full: len(full.GetAllStations()), small: len(small.GetAllStations())}
+
+	h := NewHolder(full)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Every lookup goes through one snapshot, which must be a
+				// whole DB: its list and its index agree
+				db := h.Load()
+				all := db.GetAllStations()
+				if len(all) != sizes[db] {
+					t.Errorf("snapshot with %d stations, want %d", len(all), sizes[db])
+					return
+				}
+				if s, ok := db.GetStation(all[0].StopID); !ok || s.Name != all[0].Name {
+					t.Errorf("GetStation(%s) = %+v, %t", all[0].StopID, s, ok)
+					return
+				}
+				db.Search("bedford")
+			}
+		}()
+	}
+
+	const swaps = 500
+	for i := 0; i < swaps; i++ {
+		if i%2 == 0 {
+			h.Store(small)
+		} else {
+			h.Store(full)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := h.Generation(); got != swaps {
+		t.Errorf("generation %d after %d stores", got, swaps)
+	}
+	if h.Load() != full {
+		t.Error("last store not visible")
+	}
+}
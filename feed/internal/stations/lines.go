@@ -0,0 +1,71 @@
+package stations
+
+import (
+    "sort"
+    "strings"
+)
+
+// LineInfo is what a client needs to draw a line bullet. Colors are hex
+// without the leading "#", as in GTFS routes.txt.
+type LineInfo struct {
+    Line      string `json:"line"`
+    Color     string `json:"color"`
+    TextColor string `json:"text_color"`
+    Shape     string `json:"shape"` // "circle", or "diamond" for express variants
+    // route_long_name from static GTFS routes.txt, e.g. "14 St-Canarsie Local"
+    Name string `json:"name,omitempty"`
+}
+
+// Trunk colors from the MTA's published palette
+var lineColors = map[string][2]string{
+    "1": {"EE352E", "FFFFFF"}, "2": {"EE352E", "FFFFFF"}, "3": {"EE352E", "FFFFFF"},
+    "4": {"00933C", "FFFFFF"}, "5": {"00933C", "FFFFFF"}, "6": {"00933C", "FFFFFF"},
+    "7": {"B933AD", "FFFFFF"},
+    "A": {"0039A6", "FFFFFF"}, "C": {"0039A6", "FFFFFF"}, "E": {"0039A6", "FFFFFF"},
+    "B": {"FF6319", "FFFFFF"}, "D": {"FF6319", "FFFFFF"}, "F": {"FF6319", "FFFFFF"}, "M": {"FF6319", "FFFFFF"},
+    "G": {"6CBE45", "FFFFFF"},
+    "J": {"996633", "FFFFFF"}, "Z": {"996633", "FFFFFF"},
+    "L": {"A7A9AC", "FFFFFF"},
+    "N": {"FCCC0A", "000000"}, "Q": {"FCCC0A", "000000"}, "R": {"FCCC0A", "000000"}, "W": {"FCCC0A", "000000"},
+    "S": {"808183", "FFFFFF"}, "GS": {"808183", "FFFFFF"}, "FS": {"808183", "FFFFFF"}, "H": {"808183", "FFFFFF"},
+    "SI": {"0039A6", "FFFFFF"}, "SIR": {"0039A6", "FFFFFF"},
+}
+
+// Feed route IDs for express (diamond) variants of a line
+var expressLines = map[string]string{
+    "6X": "6",
+    "7X": "7",
+    "FX": "F",
+}
+
+// Line looks up bullet metadata for a line or feed route ID.
+func Line(line string) (LineInfo, bool) {
+    line = strings.ToUpper(strings.TrimSpace(line))
+
+    shape, base := "circle", line
+    if b, ok := expressLines[line]; ok {
+        shape, base = "diamond", b
+    }
+    c, ok := lineColors[base]
+    if !ok {
+        return LineInfo{}, false
+    }
+    return LineInfo{Line: line, Color: c[0], TextColor: c[1], Shape: shape}, true
+}
+
+// AllLines returns every known line, express variants included, sorted.
+func AllLines() []LineInfo {
+    var lines []LineInfo
+    for l := range lineColors {
+        info, _ := Line(l)
+        lines = append(lines, info)
+    }
+    for l := range expressLines {
+        info, _ := Line(l)
+        lines = append(lines, info)
+    }
+    sort.Slice(lines, func(i, j int) bool {
+        return lines[i].Line < lines[j].Line
+    })
+    return lines
+}
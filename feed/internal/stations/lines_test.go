@@ -0,0 +1,50 @@
+package stations
+
+import "testing"
+
+func TestLineExpressDiamonds(t *testing.T) {
+	for express, local := range map[string]string{"6X": "6", "7X": "7", "FX": "F"} {
+		x, ok := Line(express)
+		if !ok {
+			t.Errorf("%s: unknown", express)
+			continue
+		}
+		l, _ := Line(local)
+		if x.Shape != "diamond" {
+			t.Errorf("%s shape = %q, want diamond", express, x.Shape)
+		}
+		if l.Shape != "circle" {
+			t.Errorf("%s shape = %q, want circle", local, l.Shape)
+		}
+		if x.Color != l.Color || x.TextColor != l.TextColor {
+			t.Errorf("%s colors %s/%s differ from %s's %s/%s", express, x.Color, x.TextColor, local, l.Color, l.TextColor)
+		}
+	}
+
+	// Route IDs arrive in feed casing and are matched loosely
+	if info, ok := Line(" 6x "); !ok || info.Line != "6X" || info.Shape != "diamond" {
+		t.Errorf(`Line(" 6x ") = %+v, %t`, info, ok)
+	}
+	if info, _ := Line("N"); info.TextColor != "000000" {
+		t.Errorf("N text color = %s, want black on yellow", info.TextColor)
+	}
+	if _, ok := Line("9"); ok {
+		t.Error("unknown line 9 was found")
+	}
+}
+
+func TestAllLinesIncludesExpress(t *testing.T) {
+	diamonds := map[string]bool{}
+	lines := AllLines()
+	for i, l := range lines {
+		if i > 0 && lines[i-1].Line >= l.Line {
+			t.Errorf("lines not sorted: %s before %s", lines[i-1].Line, l.Line)
+		}
+		if l.Shape == "diamond" {
+			diamonds[l.Line] = true
+		}
+	}
+	if len(diamonds) != 3 || !diamonds["6X"] || !diamonds["7X"] || !diamonds["FX"] {
+		t.Errorf("diamonds = %v, want 6X, 7X and FX", diamonds)
+	}
+}
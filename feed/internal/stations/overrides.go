@@ -0,0 +1,165 @@
+package stations
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// StationOverride patches one station; nil/empty fields keep the CSV value.
+type StationOverride struct {
+    Name       *string  `json:"name"`
+    Lines      []string `json:"lines"`
+    NorthLabel *string  `json:"north_label"`
+    SouthLabel *string  `json:"south_label"`
+    EastLabel  *string  `json:"east_label"`
+    WestLabel  *string  `json:"west_label"`
+    ADA        *bool    `json:"ada"`
+}
+
+// ApplyOverrides merges a local corrections file onto the DB by stop ID.
+// JSON files map stop ID -> StationOverride; CSV files have a stop_id
+// column plus any of name, lines, north_label, south_label, east_label,
+// west_label and ada (true/false), where blank cells are left alone. Unknown stop IDs are an
+// error so typos don't go unnoticed.
+func (db *StationDB) ApplyOverrides(path string) error {
+    var overrides map[string]StationOverride
+    var err error
+    if strings.EqualFold(filepath.Ext(path), ".json") {
+        overrides, err = readJSONOverrides(path)
+    } else {
+        overrides, err = readCSVOverrides(path)
+    }
+    if err != nil {
+        return err
+    }
+
+    ids := make([]string, 0, len(overrides))
+    for id := range overrides {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+
+    for _, id := range ids {
+        stopID := NormalizeStopID(id)
+        info, ok := db.stations[stopID]
+        if !ok {
+            return fmt.Errorf("override for unknown stop %q", id)
+        }
+        o := overrides[id]
+        if o.Name != nil {
+            info.Name = *o.Name
+        }
+        if o.NorthLabel != nil {
+            info.NorthLabel = *o.NorthLabel
+        }
+        if o.SouthLabel != nil {
+            info.SouthLabel = *o.SouthLabel
+        }
+        if o.EastLabel != nil {
+            info.EastLabel = *o.EastLabel
+        }
+        if o.WestLabel != nil {
+            info.WestLabel = *o.WestLabel
+        }
+        if o.ADA != nil {
+            info.ADA = *o.ADA
+        }
+        if len(o.Lines) > 0 {
+            info.Lines = make([]string, 0, len(o.Lines))
+            for _, l := range o.Lines {
+                info.Lines = append(info.Lines, strings.ToUpper(strings.TrimSpace(l)))
+            }
+            info.Feeds = db.feedsForLines(info.Lines)
+        }
+
+        db.stations[stopID] = info
+        for i := range db.allStations {
+            if db.allStations[i].StopID == stopID {
+                db.allStations[i] = info
+            }
+        }
+    }
+    return nil
+}
+
+func readJSONOverrides(path string) (map[string]StationOverride, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var overrides map[string]StationOverride
+    if err := json.Unmarshal(data, &overrides); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return overrides, nil
+}
+
+func readCSVOverrides(path string) (map[string]StationOverride, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    records, err := csv.NewReader(f).ReadAll()
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    if len(records) == 0 {
+        return nil, nil
+    }
+
+    cols := make(map[string]int)
+    for i, h := range records[0] {
+        cols[strings.ToLower(strings.TrimSpace(h))] = i
+    }
+    if _, ok := cols["stop_id"]; !ok {
+        return nil, fmt.Errorf("%s: missing stop_id column", path)
+    }
+
+    // Blank cells mean "keep", so only non-empty values become overrides
+    cell := func(record []string, name string) *string {
+        i, ok := cols[name]
+        if !ok || i >= len(record) {
+            return nil
+        }
+        v := strings.TrimSpace(record[i])
+        if v == "" {
+            return nil
+        }
+        return &v
+    }
+
+    overrides := make(map[string]StationOverride)
+    for _, record := range records[1:] {
+        id := cell(record, "stop_id")
+        if id == nil {
+            continue
+        }
+        o := StationOverride{
+            Name:       cell(record, "name"),
+            NorthLabel: cell(record, "north_label"),
+            SouthLabel: cell(record, "south_label"),
+            EastLabel:  cell(record, "east_label"),
+            WestLabel:  cell(record, "west_label"),
+        }
+        if lines := cell(record, "lines"); lines != nil {
+            o.Lines = strings.Fields(*lines)
+        }
+        if v := cell(record, "ada"); v != nil {
+            ada, err := strconv.ParseBool(*v)
+            if err != nil {
+                return nil, fmt.Errorf("%s: stop %s: invalid ada %q", path, *id, *v)
+            }
+            o.ADA = &ada
+        }
+        overrides[*id] = o
+    }
+    return overrides, nil
+}
@@ -0,0 +1,106 @@
+package stations
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	// The override has to flip the CSV's flag for the test to mean anything
+	if s, _ := mustLoad(t).GetStation("L08"); !s.ADA {
+		t.Fatal("L08 not ADA in stations.csv")
+	}
+
+	for _, path := range []string{"testdata/overrides.csv", "testdata/overrides.json"} {
+		base, err := LoadStationDB("../../data/stations.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := LoadStationDB("../../data/stations.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.ApplyOverrides(path); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		// Overridden fields win; everything else is the CSV's
+		want := func(id string, patch func(*StationInfo)) StationInfo {
+			s, _ := base.GetStation(id)
+			patch(&s)
+			return s
+		}
+		expected := []StationInfo{
+			want("L08", func(s *StationInfo) {
+				s.Name = "Bedford Av (Williamsburg)"
+				s.ADA = false
+			}),
+			want("L06", func(s *StationInfo) {
+				s.Lines = []string{"L", "M"}
+				s.Feeds = []string{"BDFM", "L"}
+			}),
+			want("G29", func(s *StationInfo) { s.NorthLabel = "Court Sq" }),
+		}
+		for _, w := range expected {
+			got, _ := db.GetStation(w.StopID)
+			if !reflect.DeepEqual(got, w) {
+				t.Errorf("%s: %s = %+v, want %+v", path, w.StopID, got, w)
+			}
+		}
+		// Listings see the patched station too
+		for _, s := range db.GetAllStations() {
+			if s.StopID == "L08" && s.Name != "Bedford Av (Williamsburg)" {
+				t.Errorf("%s: GetAllStations has L08 as %q", path, s.Name)
+			}
+		}
+		got, _ := db.GetStation("127")
+		if orig, _ := base.GetStation("127"); !reflect.DeepEqual(got, orig) {
+			t.Errorf("%s: untouched station 127 = %+v, want %+v", path, got, orig)
+		}
+	}
+}
+
+func TestApplyOverridesErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{write("typo.csv", "stop_id,name\nL99,Nowhere\n"), `unknown stop "L99"`},
+		{write("typo.json", `{"L99": {"name": "Nowhere"}}`), `unknown stop "L99"`},
+		{write("nocol.csv", "id,name\nL08,Bedford\n"), "missing stop_id column"},
+		{write("ada.csv", "stop_id,ada\nL08,maybe\n"), `stop L08: invalid ada "maybe"`},
+		{write("ada.json", `{"L08": {"ada": "yes"}}`), "ada.json"},
+		{write("bad.json", `{"L08": `), "bad.json"},
+		{filepath.Join(dir, "absent.csv"), "absent.csv"},
+	}
+	for _, tt := range tests {
+		db, err := LoadStationDB("../../data/stations.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.ApplyOverrides(tt.path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", filepath.Base(tt.path), err, tt.want)
+		}
+	}
+}
+
+func mustLoad(t *testing.T) *StationDB {
+	t.Helper()
+	db, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
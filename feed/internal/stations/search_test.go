@@ -0,0 +1,52 @@
+package stations
+
+import (
+	"reflect"
+	"testing"
+)
+
+func stopIDs(list []StationInfo) []string {
+	ids := make([]string, len(list))
+	for i, s := range list {
+		ids[i] = s.StopID
+	}
+	return ids
+}
+
+func TestSearchRanksHubsFirst(t *testing.T) {
+	db, err := LoadStationDB("../../data/stations.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Six Canal St stops: four platforms of the 7-line complex, then the
+	// 1 and the A/C/E each on their own
+	got := stopIDs(db.Search("canal"))
+	if want := []string{"639", "M20", "Q01", "R23", "A34", "135"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("canal = %v, want %v", got, want)
+	}
+	// Ranking is deterministic: ties break on name, then stop ID
+	for i := 0; i < 5; i++ {
+		if again := stopIDs(db.Search("canal")); !reflect.DeepEqual(again, got) {
+			t.Fatalf("search order changed between calls: %v then %v", got, again)
+		}
+	}
+
+	// A line query: Times Sq serves the 1 and is the biggest complex on it
+	if first := db.Search("1")[0]; first.StopID != "127" {
+		t.Errorf(`"1" led with %s %s, want 127 Times Sq-42 St`, first.StopID, first.Name)
+	}
+
+	// Weight 0 ranks by match alone, so the identically named stops
+	// fall back to stop ID order
+	db.SetSearchLineWeight(0)
+	got = stopIDs(db.Search("canal"))
+	if want := []string{"135", "639", "A34", "M20", "Q01", "R23"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("canal with weight 0 = %v, want %v", got, want)
+	}
+	// Exact names rank above prefix matches
+	got = stopIDs(db.Search("14 st"))[:4]
+	if want := []string{"132", "A31", "D19", "635"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("14 st with weight 0 = %v, want %v", got, want)
+	}
+}
@@ -2,9 +2,32 @@ package stations
 
 type StationInfo struct {
     StopID      string   `json:"stop_id"`
+    ComplexID   string   `json:"complex_id"`
     Name        string   `json:"name"`
     Lines       []string `json:"lines"`
     NorthLabel  string   `json:"north_label"`
     SouthLabel  string   `json:"south_label"`
+    EastLabel   string   `json:"east_label,omitempty"`
+    WestLabel   string   `json:"west_label,omitempty"`
+    Lat         float64  `json:"lat"`
+    Lon         float64  `json:"lon"`
+    // Step-free access per the CSV's ADA column; partially accessible
+    // stations (one direction only) count
+    ADA         bool     `json:"ada"`
     Feeds       []string `json:"-"`
 }
+
+// DirectionLabel maps a compass direction code to this station's label.
+func (s StationInfo) DirectionLabel(code string) string {
+    switch code {
+    case "N":
+        return s.NorthLabel
+    case "S":
+        return s.SouthLabel
+    case "E":
+        return s.EastLabel
+    case "W":
+        return s.WestLabel
+    }
+    return ""
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"syscall"
 
 	"feed/internal/api"
@@ -15,21 +21,78 @@ import (
 )
 
 func main() {
-	cfg, err := config.Load("config.yaml")
+	validate := flag.Bool("validate", false, "load and check config and station data, then exit")
+	fetch := flag.Bool("fetch", false, "with -validate, also fetch and parse every feed once")
+	flag.Parse()
+
+	// CONFIG_PATH may point at a .yaml, .json or .toml file
+	configPath := os.Getenv("CONFIG_PATH")
+	if configPath == "" {
+		configPath = "config.yaml"
+	}
+	cfg, err := config.Load(configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	stationDB, err := stations.LoadStationDB("data/stations.csv")
+	db, err := stations.LoadStationDB("data/stations.csv")
+	if errors.Is(err, fs.ErrNotExist) && cfg.AllowMissingStations {
+		fmt.Printf("Warning: %v; starting with no stations\n", err)
+		db, err = stations.NewStationDB(), nil
+	}
 	if err != nil {
 		log.Fatalf("Failed to load stations: %v", err)
 	}
+	if len(cfg.LineFeeds) > 0 {
+		db.SetLineFeeds(cfg.LineFeeds)
+	}
+	if cfg.SearchLineWeight != 0 {
+		db.SetSearchLineWeight(cfg.SearchLineWeight)
+	}
+	if cfg.StationsOverrides != "" {
+		if err := db.ApplyOverrides(cfg.StationsOverrides); err != nil {
+			log.Fatalf("Failed to apply station overrides: %v", err)
+		}
+	}
+	if cfg.GTFSStaticDir != "" {
+		if err := db.LoadTransfers(filepath.Join(cfg.GTFSStaticDir, "transfers.txt")); err != nil {
+			log.Fatalf("Failed to load transfers: %v", err)
+		}
+	}
+	stationDB := stations.NewHolder(db)
+
+	mapped := db.StopsPerFeed()
+	for _, name := range sortedKeys(cfg.Feeds) {
+		if mapped[name] == 0 {
+			fmt.Printf("Warning: feed %s has no stations mapped to it; check line_feeds\n", name)
+		} else {
+			fmt.Printf("Feed %s: %d stations\n", name, mapped[name])
+		}
+	}
+
+	static, err := stations.LoadStaticGTFS(cfg.GTFSStaticDir)
+	if err != nil {
+		log.Fatalf("Failed to load static GTFS: %v", err)
+	}
 
 	cache := feeds.NewArrivalCache()
-	broadcast := make(chan struct{}, 1) // buffered to avoid blocking fetcher if hub is busy?
+	cache.EnableHistory(cfg.Polling.HistorySize)
+	cache.EnableFrequency(cfg.Polling.FrequencyWindow)
+	notifier := feeds.NewNotifier()
 
-	hub := api.NewSSEHub(cache, broadcast)
-	fetcher := feeds.NewFeedFetcher(cfg, cache, stationDB, broadcast)
+	hub := api.NewSSEHub(cache, stationDB, notifier, api.HubOptions{
+		MinPushInterval: cfg.Server.SSEMinInterval,
+		Keepalive:       cfg.Server.SSEKeepalive,
+		StrictStops:     cfg.Server.StrictStops,
+		AllowAll:        cfg.Server.StreamAll,
+		MaxAll:          cfg.Server.StreamAllMax,
+		MaxStops:        cfg.Server.MaxStops,
+	})
+	fetcher := feeds.NewFeedFetcher(cfg, cache, stationDB, static, notifier)
+
+	if *validate {
+		os.Exit(runValidate(cfg, db, fetcher, *fetch))
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
@@ -37,18 +100,74 @@ func main() {
 	go hub.Run()
 	go fetcher.Start(ctx)
 
-	server := api.NewServer(cfg.Server.Port, hub, stationDB, cache)
+	server, adminServer := api.NewServer(cfg, hub, stationDB, static, cache, fetcher)
 
 	go func() {
-		fmt.Printf("Server listening on port %d\n", cfg.Server.Port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tls := cfg.Server.TLS; tls.Enabled() {
+			fmt.Printf("Server listening on port %d (HTTPS)\n", cfg.Server.Port)
+			err = server.ListenAndServeTLS(tls.CertFile, tls.KeyFile)
+		} else {
+			fmt.Printf("Server listening on port %d\n", cfg.Server.Port)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
 
+	if adminServer != nil {
+		go func() {
+			fmt.Printf("Admin server listening on port %d\n", cfg.Server.AdminPort)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Admin HTTP server error: %v", err)
+			}
+		}()
+	}
+
 	<-ctx.Done()
 	fmt.Println("Shutting down...")
 
 	// Cleanup
 	server.Shutdown(context.Background())
+	if adminServer != nil {
+		adminServer.Shutdown(context.Background())
+	}
+}
+
+// runValidate prints a summary of what loaded and returns the exit status.
+// Load errors have already been fatal by the time it runs.
+func runValidate(cfg *config.Config, db *stations.StationDB, fetcher *feeds.FeedFetcher, fetch bool) int {
+	status := 0
+
+	n := len(db.GetAllStations())
+	fmt.Printf("config: ok (%d feeds)\n", len(cfg.Feeds))
+	fmt.Printf("stations: %d\n", n)
+	if n == 0 {
+		fmt.Println("stations: no stations loaded")
+		status = 1
+	}
+
+	if !fetch {
+		return status
+	}
+
+	res := fetcher.FetchOnce(context.Background())
+	for _, name := range sortedKeys(res.Feeds) {
+		fmt.Printf("feed %s: %s\n", name, res.Feeds[name])
+		if res.Feeds[name] != "ok" {
+			status = 1
+		}
+	}
+	fmt.Printf("stops with arrivals: %d (%s)\n", res.Stops, res.Duration)
+	return status
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }